@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+// A savefileBinding is what a savefile was made for: the seed, the names of
+// its slots, the MW room, and the MW game each slot takes part in.
+type savefileBinding struct {
+	seedName   string
+	apfileHash string
+	slotNames  map[int]string
+	mwGames    map[int]mwGameID
+	// mwServer and mwRoom are empty for savefiles made for solo play, and
+	// unknown unless mwKnown is set.
+	mwKnown  bool
+	mwServer string
+	mwRoom   string
+}
+
+// An mwGameID identifies the MW game generated for a slot.
+type mwGameID struct {
+	randoID int
+	hash    string
+}
+
+// newSavefileBinding returns the binding for a savefile made from the
+// .archipelago file at apfile, holding data, with no MW room.
+func newSavefileBinding(apfile string, data apdata) (savefileBinding, error) {
+	hash, err := hashFile(apfile)
+	if err != nil {
+		return savefileBinding{}, fmt.Errorf("hash .archipelago: %w", err)
+	}
+	return seedBinding(data, hash), nil
+}
+
+func seedBinding(data apdata, apfileHash string) savefileBinding {
+	b := savefileBinding{seedName: data.SeedName, apfileHash: apfileHash, slotNames: map[int]string{}}
+	for _, slot := range playerSlots(data) {
+		b.slotNames[slot] = data.SlotInfo[slot].Name
+	}
+	return b
+}
+
+// withMW returns b bound to the MW room in opts.
+func (b savefileBinding) withMW(opts options) savefileBinding {
+	b.mwKnown = true
+	b.mwServer = opts.mwserver
+	b.mwRoom = opts.mwroom
+	return b
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// mismatches describes how the savefile bound to b differs from what it is
+// being opened with. The MW rooms are only compared if both are known.
+func (b savefileBinding) mismatches(current savefileBinding) []string {
+	var problems []string
+	if b.seedName != current.seedName {
+		problems = append(problems, fmt.Sprintf("savefile is for seed %s, but .archipelago is for seed %s", b.seedName, current.seedName))
+	} else if b.apfileHash != current.apfileHash {
+		problems = append(problems, "savefile was made from a different .archipelago file for the same seed")
+	}
+	for _, slot := range slices.Sorted(maps.Keys(b.slotNames)) {
+		if name, ok := current.slotNames[slot]; ok && name != b.slotNames[slot] {
+			problems = append(problems, fmt.Sprintf("slot %d is %s in the savefile, but %s in .archipelago", slot, b.slotNames[slot], name))
+		}
+	}
+	for _, slot := range slices.Sorted(maps.Keys(b.mwGames)) {
+		if game, ok := current.mwGames[slot]; ok && game != b.mwGames[slot] {
+			problems = append(problems, fmt.Sprintf("slot %d is bound to MW game %d with hash %s, but the savefile has results for game %d with hash %s", slot, b.mwGames[slot].randoID, b.mwGames[slot].hash, game.randoID, game.hash))
+		}
+	}
+	if b.mwKnown && current.mwKnown {
+		switch {
+		case b.mwServer == "":
+			problems = append(problems, fmt.Sprintf("savefile is for solo play (-solo), not MW server %s", current.mwServer))
+		case b.mwServer != current.mwServer:
+			problems = append(problems, fmt.Sprintf("savefile is for MW server %s, not %s", b.mwServer, current.mwServer))
+		case b.mwRoom != current.mwRoom:
+			problems = append(problems, fmt.Sprintf("savefile is for MW room %s, not %s", b.mwRoom, current.mwRoom))
+		}
+	}
+	return problems
+}
+
+// bind checks that the room's savefile was made for its .archipelago file, if
+// apfile is set, and for the MW room in its options, if mw is. Anything that
+// the savefile doesn't record yet is recorded, as is everything if -rebind
+// was given; otherwise, mismatches are an error.
+func (r *room) bind(apfile, mw bool) error {
+	recorded, err := r.state.getBinding()
+	bound := err == nil
+	if err != nil && err != errZeroRows {
+		return err
+	}
+	// The seed's data in a savefile that stores it is always what the
+	// savefile was made for.
+	current := recorded
+	if apfile || !bound {
+		var hash string
+		if apfile {
+			hash, err = hashFile(r.opts.apfile)
+			if err != nil {
+				return fmt.Errorf("hash .archipelago: %w", err)
+			}
+		}
+		current = seedBinding(r.data, hash)
+		slots, err := r.state.getSlots()
+		if err != nil {
+			return err
+		}
+		for slot := range current.slotNames {
+			if _, ok := slots[slot]; !ok {
+				delete(current.slotNames, slot)
+			}
+		}
+	}
+	current.mwGames, err = r.state.getMWGames()
+	if err != nil {
+		return err
+	}
+	current.mwKnown, current.mwServer, current.mwRoom = false, "", ""
+	if mw {
+		current = current.withMW(r.opts)
+	}
+	if !bound {
+		if mw {
+			log.Printf("binding savefile to seed %s and room %s on %s", current.seedName, current.mwRoom, current.mwServer)
+		} else {
+			log.Printf("binding savefile to seed %s", current.seedName)
+		}
+		return r.state.setBinding(current)
+	}
+	if err != nil {
+		return err
+	}
+	problems := recorded.mismatches(current)
+	if len(problems) > 0 && !r.opts.rebind {
+		return fmt.Errorf("%s; use -rebind if this is intended", strings.Join(problems, "; "))
+	}
+	gamesKnown := true
+	for slot := range current.mwGames {
+		if _, ok := recorded.mwGames[slot]; !ok {
+			gamesKnown = false
+		}
+	}
+	if len(problems) == 0 && (recorded.mwKnown || !mw) && gamesKnown {
+		return nil
+	}
+	for _, p := range problems {
+		log.Println("rebinding savefile:", p)
+	}
+	if !mw {
+		current.mwKnown, current.mwServer, current.mwRoom = recorded.mwKnown, recorded.mwServer, recorded.mwRoom
+	} else if !recorded.mwKnown {
+		log.Printf("binding savefile to room %s on %s", current.mwRoom, current.mwServer)
+	}
+	return r.state.setBinding(current)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dpinela/mmm/internal/approto"
+)
+
+func TestBindingChecksMWGames(t *testing.T) {
+	ps := openTestSavefile(t, createLegacySavefile(t), func() (int, error) { return legacySlot, nil })
+	bob := apslot{Name: "Bob", Game: "Hollow Knight"}
+	bob.Type.Code = int(approto.SlotTypePlayer)
+	r := &room{state: ps, data: apdata{SeedName: "SEED", SlotInfo: map[int]apslot{legacySlot: bob}}}
+	if err := r.bind(false, false); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ps.getBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if game := b.mwGames[legacySlot]; game != (mwGameID{randoID: 42, hash: "hash"}) {
+		t.Fatalf("slot is bound to MW game %+v, want 42 with hash \"hash\"", game)
+	}
+	if err := r.bind(false, false); err != nil {
+		t.Errorf("binding again: %v", err)
+	}
+
+	if err := ps.db.Exec("UPDATE mw_global_data SET rando_id = 43"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.bind(false, false); err == nil || !strings.Contains(err.Error(), "MW game 42") {
+		t.Errorf("binding to results for another MW game returned %v", err)
+	}
+	r.opts.rebind = true
+	if err := r.bind(false, false); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ps.getBinding(); err != nil || b.mwGames[legacySlot].randoID != 43 {
+		t.Errorf("after rebinding, slot is bound to MW game %+v (%v), want 43", b.mwGames[legacySlot], err)
+	}
+}
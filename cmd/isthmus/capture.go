@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/dpinela/mmm/internal/capture"
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+func captureCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: isthmus capture show|replay [options] capturefile")
+	}
+	switch args[0] {
+	case "show":
+		return showCapture(args[1:])
+	case "replay":
+		return replayCapture(args[1:])
+	default:
+		return fmt.Errorf("unknown capture command: %s", args[0])
+	}
+}
+
+func showCapture(args []string) error {
+	var protocol string
+	flags := flag.NewFlagSet("capture show", flag.ExitOnError)
+	flags.StringVar(&protocol, "protocol", "", "Only show traffic for `protocol` (mw or ap)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: isthmus capture show [options] capturefile")
+	}
+
+	for rec, err := range capture.Read(flags.Arg(0)) {
+		if err != nil {
+			return err
+		}
+		if protocol != "" && rec.Protocol != protocol {
+			continue
+		}
+		fmt.Printf("%s %s#%d %s %s\n", rec.Time.Format("15:04:05.000"), rec.Protocol, rec.Conn, rec.Direction, rec.Type)
+		if len(rec.Decoded) > 0 {
+			var out []byte
+			var v any
+			if err := json.Unmarshal(rec.Decoded, &v); err == nil {
+				out, _ = json.MarshalIndent(v, "\t", "  ")
+			}
+			fmt.Printf("\t%s\n", out)
+		} else {
+			fmt.Printf("\t% 02x\n", rec.Frame)
+		}
+	}
+	return nil
+}
+
+// replayCapture plays back one side of the captured traffic against a running
+// Isthmus instance: either the MW server's side, by accepting connections from
+// Isthmus, or the AP client's side, by connecting to Isthmus's AP server.
+// What Isthmus sends back is compared with what it sent in the capture, and
+// any differences are logged, but they don't otherwise affect the replay.
+func replayCapture(args []string) error {
+	var (
+		side  string
+		port  int
+		speed float64
+	)
+	flags := flag.NewFlagSet("capture replay", flag.ExitOnError)
+	flags.StringVar(&side, "side", "mw", "Which side to replay: mw (act as the MW server) or ap (act as the AP client)")
+	flags.IntVar(&port, "port", 38281, "For mw, accept connections on port `port`; for ap, connect to Isthmus on that port")
+	flags.Float64Var(&speed, "speed", 1, "Replay `factor` times as fast as the original traffic (0 for no delays)")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: isthmus capture replay [options] capturefile")
+	}
+
+	var protocol string
+	switch side {
+	case "mw":
+		protocol = capture.ProtocolMW
+	case "ap":
+		protocol = capture.ProtocolAP
+	default:
+		return fmt.Errorf("unknown side: %s", side)
+	}
+	conns, err := readCapturedConns(flags.Arg(0), protocol)
+	if err != nil {
+		return err
+	}
+
+	if side == "ap" {
+		for _, recs := range conns {
+			if err := replayAPConn(port, recs, speed); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	log.Println("waiting for Isthmus to connect on", listener.Addr())
+	for _, recs := range conns {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		replayMWConn(conn, recs, speed)
+	}
+	return nil
+}
+
+// readCapturedConns groups the records for protocol by connection, in the
+// order in which the connections were opened.
+func readCapturedConns(name, protocol string) ([][]capture.Record, error) {
+	var (
+		conns [][]capture.Record
+		index = map[int]int{}
+	)
+	for rec, err := range capture.Read(name) {
+		if err != nil {
+			return nil, err
+		}
+		if rec.Protocol != protocol {
+			continue
+		}
+		i, ok := index[rec.Conn]
+		if !ok {
+			i = len(conns)
+			index[rec.Conn] = i
+			conns = append(conns, nil)
+		}
+		conns[i] = append(conns[i], rec)
+	}
+	return conns, nil
+}
+
+func replayMWConn(conn net.Conn, recs []capture.Record, speed float64) {
+	defer conn.Close()
+	responses := newResponseLog(recs, func(rec capture.Record) (any, bool) {
+		env, err := mwproto.DecodeFrame(rec.Frame)
+		if err != nil {
+			return rec.Frame, true
+		}
+		_, isPing := env.Message.(mwproto.PingMessage)
+		return env.Message, !isPing
+	}, func(v any) string { return fmt.Sprintf("%#v", v) })
+	go func() {
+		for {
+			msg, err := mwproto.Read(conn)
+			if err != nil {
+				return
+			}
+			if _, isPing := msg.(mwproto.PingMessage); !isPing {
+				responses.add(msg)
+			}
+		}
+	}()
+	replayRecords(recs, speed, func(rec capture.Record) error {
+		_, err := conn.Write(rec.Frame)
+		return err
+	})
+	responses.summarize()
+}
+
+func replayAPConn(port int, recs []capture.Record, speed float64) error {
+	ctx := context.Background()
+	conn, _, err := websocket.Dial(ctx, fmt.Sprintf("ws://localhost:%d", port), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.CloseNow()
+	responses := newResponseLog(recs, func(rec capture.Record) (any, bool) {
+		return decodeAPPacket(rec.APPacket()), true
+	}, func(v any) string {
+		if b, ok := v.([]byte); ok {
+			return fmt.Sprintf("% 02x", b)
+		}
+		out, _ := json.Marshal(v)
+		return string(out)
+	})
+	go func() {
+		for {
+			_, data, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			responses.add(decodeAPPacket(data))
+		}
+	}()
+	replayRecords(recs, speed, func(rec capture.Record) error {
+		return conn.Write(ctx, websocket.MessageText, rec.APPacket())
+	})
+	responses.summarize()
+	return conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// decodeAPPacket decodes packet so that it can be compared regardless of how
+// its JSON is laid out, or returns it as is if it isn't JSON.
+func decodeAPPacket(packet []byte) any {
+	var v any
+	if err := json.Unmarshal(packet, &v); err != nil {
+		return packet
+	}
+	return v
+}
+
+// A responseLog compares what Isthmus sends during a replay, in order, with
+// what it sent on the same connection in the capture, and logs the
+// differences.
+type responseLog struct {
+	show func(any) string
+
+	mu       sync.Mutex
+	recorded []any
+	received int
+	differed int
+}
+
+// newResponseLog returns a responseLog for the records of one connection.
+// decode returns the message in a record, and whether it is to be compared.
+func newResponseLog(recs []capture.Record, decode func(capture.Record) (any, bool), show func(any) string) *responseLog {
+	l := &responseLog{show: show}
+	for _, rec := range recs {
+		if rec.Direction != capture.DirectionSent {
+			continue
+		}
+		if v, ok := decode(rec); ok {
+			l.recorded = append(l.recorded, v)
+		}
+	}
+	return l
+}
+
+func (l *responseLog) add(msg any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i := l.received
+	l.received++
+	switch {
+	case i >= len(l.recorded):
+		l.differed++
+		log.Printf("Isthmus sent %s, after everything it sent in the capture", l.show(msg))
+	case !reflect.DeepEqual(msg, l.recorded[i]):
+		l.differed++
+		log.Printf("Isthmus sent %s, but %s in the capture", l.show(msg), l.show(l.recorded[i]))
+	}
+}
+
+func (l *responseLog) summarize() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.received < len(l.recorded) {
+		log.Printf("Isthmus sent %d messages, but %d in the capture", l.received, len(l.recorded))
+	}
+	log.Printf("%d of %d messages from Isthmus matched the capture", l.received-l.differed, l.received)
+}
+
+// replayRecords sends each record that Isthmus originally received, keeping
+// the original spacing between records, divided by speed.
+func replayRecords(recs []capture.Record, speed float64, send func(capture.Record) error) {
+	if len(recs) == 0 {
+		return
+	}
+	start := time.Now()
+	origin := recs[0].Time
+	for _, rec := range recs {
+		// Isthmus's sent traffic is what we're playing opposite to, so what
+		// it received is what we must send.
+		if rec.Direction != capture.DirectionReceived {
+			continue
+		}
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(rec.Time.Sub(origin)) / speed))
+			time.Sleep(time.Until(due))
+		}
+		if err := send(rec); err != nil {
+			log.Println("replay stopped:", err)
+			return
+		}
+	}
+	// Give Isthmus a chance to respond to the last message.
+	time.Sleep(time.Second)
+}
+
+func createCapture(name string) (*capture.Writer, error) {
+	if name == "" {
+		return nil, nil
+	}
+	w, err := capture.Create(name)
+	if err != nil {
+		return nil, fmt.Errorf("create capture file: %w", err)
+	}
+	log.Println("capturing traffic to", name)
+	return w, nil
+}
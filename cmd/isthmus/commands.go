@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+
+	"github.com/dpinela/mmm/internal/mwserver"
+)
+
+var subcommands = map[string]func(args []string) error{
+	"createsave": createSaveCommand,
+	"convert":    convertCommand,
+	"export":     exportCommand,
+	"import":     importCommand,
+	"mwserver":   mwServerCommand,
+	"mwbot":      mwBotCommand,
+	"capture":    captureCommand,
+	"quarantine": quarantineCommand,
+	"reverse":    reverseCommand,
+}
+
+// createSaveCommand builds a savefile from a previously saved MW result,
+// without contacting the MW server.
+func createSaveCommand(args []string) error {
+	var savefile, apfile, mwresult string
+	flags := flag.NewFlagSet("createsave", flag.ExitOnError)
+	flags.StringVar(&savefile, "savefile", "./savefile.isthmus", "Create the savefile at `file`")
+	flags.StringVar(&apfile, "apfile", "./AP.archipelago", "The Archipelago seed the MW result was generated from")
+	flags.StringVar(&mwresult, "mwresult", "", "Read the MW shuffle result from `file` (defaults to the savefile path plus "+mwResultFileSuffix+")")
+	flags.Parse(args)
+
+	if mwresult == "" {
+		mwresult = savefile + mwResultFileSuffix
+	}
+	if err := checkNotExists(savefile); err != nil {
+		return err
+	}
+	data, err := readAPFile(apfile)
+	if err != nil {
+		return err
+	}
+	res, saved, err := readMWResults(mwresult, data)
+	if err != nil {
+		return err
+	}
+	b, err := newSavefileBinding(apfile, data)
+	if err != nil {
+		return err
+	}
+	// Results saved by older versions don't record their room, which is
+	// then recorded once the savefile is played.
+	if saved != nil {
+		if saved.SeedName != data.SeedName {
+			return fmt.Errorf("%s holds results for seed %s, but .archipelago is for seed %s", mwresult, saved.SeedName, data.SeedName)
+		}
+		b = b.withMW(options{mwserver: saved.MWServer, mwroom: saved.MWRoom})
+	}
+	return createSavefile(savefile, res, data, b)
+}
+
+func checkNotExists(name string) error {
+	_, err := os.Stat(name)
+	if err == nil {
+		return fmt.Errorf("%s already exists", name)
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func mwServerCommand(args []string) error {
+	var port int
+	var name string
+	flags := flag.NewFlagSet("mwserver", flag.ExitOnError)
+	flags.IntVar(&port, "port", 38281, "Accept MW clients on port `port`")
+	flags.StringVar(&name, "name", "Isthmus Local MW Server", "The server `name` announced to clients")
+	flags.Parse(args)
+
+	server, err := mwserver.Listen(fmt.Sprintf("localhost:%d", port), name)
+	if err != nil {
+		return err
+	}
+	log.Println("serving MW on", server.Addr())
+	server.Serve()
+	return nil
+}
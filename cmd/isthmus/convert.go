@@ -1,65 +1,331 @@
 package main
 
 import (
+	"cmp"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
 
 	"github.com/dpinela/mmm/internal/mwproto"
 )
 
-func apToMWPlacements(data apdata) ([]mwproto.Placement, error) {
-	slotID := singularKey(data.SlotInfo)
+// An apItem is an item as placed by AP: which slot it belongs to, its ID in
+// that slot's game, and its flags.
+type apItem struct {
+	ownerSlot int
+	id        int64
+	flags     int
+}
+
+// A groupRule puts placements into a MW item group by the AP item or
+// location group that their item or location belongs to.
+type groupRule struct {
+	mwGroup  string
+	location bool
+	apGroup  string
+}
+
+// groupRulesFlag holds rules of the form mwgroup=item:apgroup or
+// mwgroup=location:apgroup.
+type groupRulesFlag []groupRule
+
+func (g *groupRulesFlag) String() string {
+	if g == nil {
+		return ""
+	}
+	rules := make([]string, len(*g))
+	for i, r := range *g {
+		kind := "item"
+		if r.location {
+			kind = "location"
+		}
+		rules[i] = r.mwGroup + "=" + kind + ":" + r.apGroup
+	}
+	return strings.Join(rules, ",")
+}
+
+func (g *groupRulesFlag) Set(s string) error {
+	mwGroup, rest, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("group rule must be of the form mwgroup=item:apgroup or mwgroup=location:apgroup: %q", s)
+	}
+	kind, apGroup, ok := strings.Cut(rest, ":")
+	if !ok || !(kind == "item" || kind == "location") {
+		return fmt.Errorf("group rule must be of the form mwgroup=item:apgroup or mwgroup=location:apgroup: %q", s)
+	}
+	*g = append(*g, groupRule{mwGroup: mwGroup, location: kind == "location", apGroup: apGroup})
+	return nil
+}
+
+// nameGroups returns the item or location name groups in a datapackage,
+// keyed by group and then by name.
+func nameGroups(dpkg apgamedata, key string) map[string]map[string]bool {
+	groups := map[string]map[string]bool{}
+	raw, _ := dpkg.Original[key].(map[string]any)
+	for group, names := range raw {
+		members := map[string]bool{}
+		// Groups are lists in data packages, but sets in some games' code.
+		// Both are plain lists in the data stored in savefiles.
+		switch names := names.(type) {
+		case *[]any:
+			for _, name := range *names {
+				if name, ok := name.(string); ok {
+					members[name] = true
+				}
+			}
+		case []any:
+			for _, name := range names {
+				if name, ok := name.(string); ok {
+					members[name] = true
+				}
+			}
+		case map[any]struct{}:
+			for name := range names {
+				if name, ok := name.(string); ok {
+					members[name] = true
+				}
+			}
+		}
+		groups[group] = members
+	}
+	return groups
+}
+
+// convertCommand shows what Isthmus would send to the MW server for each slot
+// in a seed, without joining a room.
+func convertCommand(args []string) error {
+	var (
+		apfile, out, failOn string
+		rules               groupRulesFlag
+		gameNames           bool
+	)
+	flags := flag.NewFlagSet("convert", flag.ExitOnError)
+	flags.StringVar(&apfile, "apfile", "./AP.archipelago", "The Archipelago seed to convert")
+	flags.Var(&rules, "mwgroup", "Put placements in MW item groups by AP group, as `mwgroup=item:apgroup` or `mwgroup=location:apgroup`; may be repeated")
+	flags.BoolVar(&gameNames, "mwgamenames", false, "Tag item and location names with their AP game")
+	flags.StringVar(&out, "out", "", "Write the placements and report to `file` instead of standard output")
+	flags.StringVar(&failOn, "fail", "", "Fail if any slot has locations with any of these comma-separated `problems`: "+strings.Join(conversionProblems, ", "))
+	flags.Parse(args)
+
+	var failProblems []string
+	if failOn != "" {
+		failProblems = strings.Split(failOn, ",")
+		for _, problem := range failProblems {
+			if !slices.Contains(conversionProblems, problem) {
+				return fmt.Errorf("unknown problem %q; must be one of %s", problem, strings.Join(conversionProblems, ", "))
+			}
+		}
+	}
+	data, err := readAPFile(apfile)
+	if err != nil {
+		return err
+	}
+
+	type slotConversion struct {
+		Slot       int                            `json:"slot"`
+		Placements map[string][]mwproto.Placement `json:"placements"`
+		Report     conversionReport               `json:"report"`
+	}
+	conversions := map[string]slotConversion{}
+	var failures []string
+	for _, slotID := range playerSlots(data) {
+		name := data.SlotInfo[slotID].Name
+		placements, _, report, err := apToMWPlacements(data, slotID, rules, gameNames)
+		if err != nil {
+			return fmt.Errorf("convert AP to MW for slot %d: %w", slotID, err)
+		}
+		conversions[name] = slotConversion{Slot: slotID, Placements: placements, Report: report}
+		if s := report.String(); s != "" {
+			log.Printf("slot %d (%s): %s", slotID, name, s)
+		}
+		for _, problem := range failProblems {
+			if n := len(report.locations(problem)); n > 0 {
+				failures = append(failures, fmt.Sprintf("slot %d (%s) has %d %s locations", slotID, name, n, problem))
+			}
+		}
+	}
+
+	encoded, err := json.MarshalIndent(conversions, "", "\t")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+	if out == "" {
+		_, err = os.Stdout.Write(encoded)
+	} else {
+		err = os.WriteFile(out, encoded, 0o644)
+	}
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// A conversionReport lists the locations in a slot's world that
+// apToMWPlacements couldn't convert as they are.
+type conversionReport struct {
+	// Empty locations are in a sphere but have nothing placed at them, and
+	// are left out.
+	Empty []reportedLocation `json:"empty"`
+	// Incomplete locations have a placement that is missing data, and are
+	// left out.
+	Incomplete []reportedLocation `json:"incomplete"`
+	// Unnamed locations aren't in the datapackage, and are sent as
+	// Mystery_Place.
+	Unnamed []reportedLocation `json:"unnamed"`
+	// OutOfSphere locations have a placement but aren't in any sphere, and
+	// are left out.
+	OutOfSphere []reportedLocation `json:"out_of_sphere"`
+}
+
+type reportedLocation struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// conversionProblems are the kinds of location in a conversionReport, as
+// named in the JSON report and by the -fail option of isthmus convert.
+var conversionProblems = []string{"empty", "incomplete", "unnamed", "out_of_sphere"}
+
+func (r conversionReport) locations(problem string) []reportedLocation {
+	switch problem {
+	case "empty":
+		return r.Empty
+	case "incomplete":
+		return r.Incomplete
+	case "unnamed":
+		return r.Unnamed
+	case "out_of_sphere":
+		return r.OutOfSphere
+	default:
+		return nil
+	}
+}
+
+// String summarises r, or returns "" if there's nothing to report.
+func (r conversionReport) String() string {
+	var counts []string
+	for _, problem := range conversionProblems {
+		if n := len(r.locations(problem)); n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, strings.ReplaceAll(problem, "_", " ")))
+		}
+	}
+	if len(counts) == 0 {
+		return ""
+	}
+	return "locations not converted as they are: " + strings.Join(counts, ", ")
+}
+
+// apToMWPlacements converts the placements in the given slot's world into the
+// ones that its MW player contributes to the room, split into item groups
+// according to rules; placements that no rule matches go into
+// singularItemGroup. Names are tagged with their AP game if gameNames is set.
+// In MW, every item a player contributes is considered theirs, so items that
+// AP placed there for other slots are returned in contributed, keyed by their
+// MW name, to be handed over to their real owners when received.
+func apToMWPlacements(data apdata, slotID int, rules []groupRule, gameNames bool) (mwPlacements map[string][]mwproto.Placement, contributed map[string]apItem, report conversionReport, err error) {
 	slot := data.SlotInfo[slotID]
 	dpkg, ok := data.Datapackage[slot.Game]
 	if !ok {
-		return nil, fmt.Errorf(".archipelago does not contain datapackage for main game %s", slot.Game)
+		return nil, nil, report, fmt.Errorf(".archipelago does not contain datapackage for game %s", slot.Game)
 	}
-	itemNames, err := invert(dpkg.ItemNameToID, "duplicate item ID in datapackage")
-	if err != nil {
-		return nil, err
+	itemNames := map[string]map[int64]string{}
+	for _, s := range data.SlotInfo {
+		if _, ok := itemNames[s.Game]; ok {
+			continue
+		}
+		names, err := invert(data.Datapackage[s.Game].ItemNameToID, "duplicate item ID in datapackage")
+		if err != nil {
+			return nil, nil, report, err
+		}
+		itemNames[s.Game] = names
 	}
 	locationNames, err := invert(dpkg.LocationNameToID, "duplicate location ID in datapackage")
 	if err != nil {
-		return nil, err
+		return nil, nil, report, err
 	}
 	placements, ok := data.Locations[slotID]
 	if !ok {
-		return nil, errors.New(".archipelago does not contain location data for its single slot")
+		return nil, nil, report, fmt.Errorf(".archipelago does not contain location data for slot %d", slotID)
+	}
+	locationGroups := nameGroups(dpkg, "location_name_groups")
+	itemGroups := map[string]map[string]map[string]bool{}
+	for _, s := range data.SlotInfo {
+		itemGroups[s.Game] = nameGroups(data.Datapackage[s.Game], "item_name_groups")
 	}
-	var mwPlacements []mwproto.Placement
+	mwPlacements = map[string][]mwproto.Placement{}
+	contributed = map[string]apItem{}
+	inSphere := map[int64]bool{}
 	for _, s := range data.Spheres {
 		for _, loc := range s[slotID] {
-			locName, ok := locationNames[loc]
+			inSphere[loc] = true
+			apLocName, ok := locationNames[loc]
 			if !ok {
-				locName = "Mystery_Place"
+				report.Unnamed = append(report.Unnamed, reportedLocation{ID: loc})
+				apLocName = "Mystery_Place"
+			}
+			locName := mwproto.Name{Name: apLocName, Discriminator: loc, HasDiscriminator: true}
+			if gameNames {
+				locName.Game = slot.Game
 			}
-			locName = fmt.Sprintf("%s_(%d)", locName, loc)
 			p, ok := placements[loc]
 			if !ok {
-				fmt.Println("\tNOTHING @", locName)
+				report.Empty = append(report.Empty, reportedLocation{ID: loc, Name: locationNames[loc]})
 				continue
 			}
-			if len(p) < 2 {
-				fmt.Println("\tMISSING DATA @", locName)
+			if len(p) < 3 {
+				report.Incomplete = append(report.Incomplete, reportedLocation{ID: loc, Name: locationNames[loc]})
 				continue
 			}
-			itemName, ok := itemNames[p[0]]
+			owner, ok := data.SlotInfo[int(p[1])]
+			if !ok {
+				return nil, nil, report, fmt.Errorf("item at %s belongs to unknown slot %d", locName.Encode(), p[1])
+			}
+			apItemName, ok := itemNames[owner.Game][p[0]]
 			if !ok {
-				return nil, fmt.Errorf("item missing from datapackage: %d", p[0])
+				return nil, nil, report, fmt.Errorf("item missing from datapackage: %d", p[0])
+			}
+			group := singularItemGroup
+			for _, r := range rules {
+				if r.location && locationGroups[r.apGroup][apLocName] ||
+					!r.location && itemGroups[owner.Game][r.apGroup][apItemName] {
+					group = r.mwGroup
+					break
+				}
 			}
 			// Ensure that item names as presented to the MW server are unique,
 			// as required by the protocol.
-			// The AP server implementation will strip the discriminator and
-			// look up the real item ID from the data package anyway.
-			itemName = fmt.Sprintf("%s_(%d)", itemName, len(mwPlacements))
+			// The AP server implementation looks up the real item in
+			// contributed anyway.
+			itemName := mwproto.Name{Name: apItemName, Discriminator: int64(len(contributed)), HasDiscriminator: true}
+			if gameNames {
+				itemName.Game = owner.Game
+			}
+			contributed[itemName.Encode()] = apItem{ownerSlot: int(p[1]), id: p[0], flags: int(p[2])}
 
-			mwPlacements = append(mwPlacements, mwproto.Placement{
-				Item:     itemName,
-				Location: locName,
+			mwPlacements[group] = append(mwPlacements[group], mwproto.Placement{
+				Item:     itemName.Encode(),
+				Location: locName.Encode(),
 			})
 		}
 	}
-	return mwPlacements, nil
+	for loc := range placements {
+		if !inSphere[loc] {
+			report.OutOfSphere = append(report.OutOfSphere, reportedLocation{ID: loc, Name: locationNames[loc]})
+		}
+	}
+	for _, problem := range conversionProblems {
+		slices.SortFunc(report.locations(problem), func(a, b reportedLocation) int { return cmp.Compare(a.ID, b.ID) })
+	}
+	return mwPlacements, contributed, report, nil
 }
 
 func invert[K, V comparable](m map[K]V, errmsg string) (map[V]K, error) {
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Name groups read back from a savefile must be the same as the ones
+// unpickled from the .archipelago file.
+func TestNameGroupsFromStoredData(t *testing.T) {
+	unpickled := apgamedata{Original: map[string]any{
+		"item_name_groups": map[string]any{
+			"Charms": &[]any{"Grubsong", "Dashmaster"},
+			"Keys":   map[any]struct{}{"Simple_Key": {}, "Elegant_Key": {}},
+		},
+		"location_name_groups": map[string]any{
+			"Grubs": &[]any{"Grub-Crossroads_Acid"},
+		},
+	}}
+	data := apdata{Datapackage: map[string]apgamedata{"Hollow Knight": unpickled}}
+	encoded, err := json.Marshal(storedAPData(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored apdata
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.UseNumber()
+	if err := dec.Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]bool{
+		"Charms": {"Grubsong": true, "Dashmaster": true},
+		"Keys":   {"Simple_Key": true, "Elegant_Key": true},
+	}
+	for name, dpkg := range map[string]apgamedata{"unpickled": unpickled, "stored": stored.Datapackage["Hollow Knight"]} {
+		if got := nameGroups(dpkg, "item_name_groups"); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s item groups: got %v, want %v", name, got, want)
+		}
+		wantLocations := map[string]map[string]bool{"Grubs": {"Grub-Crossroads_Acid": true}}
+		if got := nameGroups(dpkg, "location_name_groups"); !reflect.DeepEqual(got, wantLocations) {
+			t.Errorf("%s location groups: got %v, want %v", name, got, wantLocations)
+		}
+	}
+}
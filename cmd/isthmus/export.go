@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/dpinela/mmm/internal/sqlite"
+)
+
+// exportFormat is the version of the savefileExport format itself, as
+// opposed to that of the savefile schema it holds.
+const exportFormat = 1
+
+// A savefileExport holds the whole of a savefile as JSON, so that it can be
+// moved to another machine or inspected without SQLite. Savefiles are
+// exported as they are, without upgrading them, and each table carries the
+// statement that creates it, so that they can be rebuilt at their own schema
+// version and upgraded when next opened.
+type savefileExport struct {
+	Format        int                      `json:"format"`
+	SchemaVersion int                      `json:"schema_version"`
+	Redacted      bool                     `json:"redacted"`
+	Tables        map[string]exportedTable `json:"tables"`
+}
+
+type exportedTable struct {
+	Schema  string   `json:"schema"`
+	Columns []string `json:"columns"`
+	// Rows holds a JSON array of rows, each an array of values in the same
+	// order as Columns.
+	Rows json.RawMessage `json:"rows"`
+}
+
+// redactedColumns are the columns holding spoiler logs, which are emptied by
+// export -redact. Nothing needs them once the savefile has been set up.
+// The placements of each slot's own world and items are kept, since the game
+// can't be played without them.
+var redactedColumns = map[string][]string{
+	"mw_players":     {"spoiler_log"},
+	"mw_global_data": {"full_spoiler_log"},
+}
+
+// redactedTables are left empty by export -redact.
+var redactedTables = []string{"mw_spoiler_placements"}
+
+// exportCommand writes a savefile out as JSON.
+func exportCommand(args []string) error {
+	var savefile, out string
+	var redact bool
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	flags.StringVar(&savefile, "savefile", "./savefile.isthmus", "The savefile to export")
+	flags.StringVar(&out, "out", "", "Write the export to `file` instead of standard output")
+	flags.BoolVar(&redact, "redact", false, "Leave out the spoiler logs")
+	flags.Parse(args)
+
+	if _, err := os.Stat(savefile); err != nil {
+		return err
+	}
+	db, err := sqlite.Open(savefile)
+	if err != nil {
+		return fmt.Errorf("open savefile: %w", err)
+	}
+	defer db.Close()
+	export, err := exportSavefile(db, redact)
+	if err != nil {
+		return fmt.Errorf("export savefile: %w", err)
+	}
+	encoded, err := json.MarshalIndent(export, "", "\t")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+	if out == "" {
+		_, err = os.Stdout.Write(encoded)
+		return err
+	}
+	return os.WriteFile(out, encoded, 0o644)
+}
+
+// importCommand creates a savefile from the JSON written by exportCommand.
+func importCommand(args []string) error {
+	var savefile, in string
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	flags.StringVar(&savefile, "savefile", "./savefile.isthmus", "Create the savefile at `file`")
+	flags.StringVar(&in, "in", "", "Read the export from `file` instead of standard input")
+	flags.Parse(args)
+
+	if err := checkNotExists(savefile); err != nil {
+		return err
+	}
+	var (
+		encoded []byte
+		err     error
+	)
+	if in == "" {
+		encoded, err = io.ReadAll(os.Stdin)
+	} else {
+		encoded, err = os.ReadFile(in)
+	}
+	if err != nil {
+		return err
+	}
+	var export savefileExport
+	if err := json.Unmarshal(encoded, &export); err != nil {
+		return fmt.Errorf("decode export: %w", err)
+	}
+	if export.Format != exportFormat {
+		return fmt.Errorf("export is in format %d, but this version of Isthmus only reads format %d", export.Format, exportFormat)
+	}
+	if export.SchemaVersion > savefileVersion {
+		return fmt.Errorf("export was made by a newer version of Isthmus (schema version %d, but this one only supports up to %d)", export.SchemaVersion, savefileVersion)
+	}
+	db, err := sqlite.Open(savefile)
+	if err != nil {
+		return err
+	}
+	err = importSavefile(db, export)
+	db.Close()
+	if err != nil {
+		os.Remove(savefile)
+		return fmt.Errorf("import savefile: %w", err)
+	}
+	return nil
+}
+
+func exportSavefile(db *sqlite.DB, redact bool) (export savefileExport, err error) {
+	export.Format = exportFormat
+	export.Redacted = redact
+	export.Tables = map[string]exportedTable{}
+	export.SchemaVersion, err = schemaVersion(db)
+	if err != nil {
+		return
+	}
+	if err = db.Exec("BEGIN"); err != nil {
+		return
+	}
+	defer db.Exec("ROLLBACK")
+
+	stmt := db.Prepare("SELECT name, sql FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'")
+	err = exec(stmt, func() {
+		export.Tables[stmt.ReadString(0)] = exportedTable{Schema: stmt.ReadString(1)}
+	})
+	stmt.Close()
+	if err != nil {
+		return
+	}
+	for name, table := range export.Tables {
+		stmt := db.Prepare("SELECT name FROM pragma_table_info(?) ORDER BY cid")
+		stmt.BindString(1, name)
+		err = exec(stmt, func() {
+			table.Columns = append(table.Columns, stmt.ReadString(0))
+		})
+		stmt.Close()
+		if err != nil {
+			return
+		}
+		if redact && slices.Contains(redactedTables, name) {
+			table.Rows = json.RawMessage("[]")
+			export.Tables[name] = table
+			continue
+		}
+		values := make([]string, len(table.Columns))
+		for i, col := range table.Columns {
+			if redact && slices.Contains(redactedColumns[name], col) {
+				values[i] = "''"
+			} else {
+				values[i] = quoteIdentifier(col)
+			}
+		}
+		stmt = db.Prepare(fmt.Sprintf("SELECT json_group_array(json_array(%s)) FROM (SELECT * FROM %s ORDER BY rowid)", strings.Join(values, ", "), quoteIdentifier(name)))
+		err = execOnce(stmt, func() {
+			table.Rows = json.RawMessage(stmt.ReadString(0))
+		})
+		stmt.Close()
+		if err != nil {
+			return
+		}
+		export.Tables[name] = table
+	}
+	return
+}
+
+func importSavefile(db *sqlite.DB, export savefileExport) error {
+	if err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d;\nBEGIN", export.SchemaVersion)); err != nil {
+		return err
+	}
+	for _, name := range slices.Sorted(maps.Keys(export.Tables)) {
+		table := export.Tables[name]
+		// Only the statement that creates the table itself is accepted, as
+		// SQLite records it.
+		if !strings.HasPrefix(table.Schema, "CREATE TABLE ") || strings.Contains(table.Schema, ";") {
+			db.Exec("ROLLBACK")
+			return fmt.Errorf("table %s: not a CREATE TABLE statement: %q", name, table.Schema)
+		}
+		if err := db.Exec(table.Schema); err != nil {
+			db.Exec("ROLLBACK")
+			return fmt.Errorf("table %s: %w", name, err)
+		}
+		if err := importRows(db, name, table); err != nil {
+			db.Exec("ROLLBACK")
+			return fmt.Errorf("table %s: %w", name, err)
+		}
+	}
+	return db.Exec("COMMIT")
+}
+
+func importRows(db *sqlite.DB, name string, table exportedTable) error {
+	exists, err := tableExists(db, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("schema creates a different table")
+	}
+	var columns []string
+	stmt := db.Prepare("SELECT name FROM pragma_table_info(?)")
+	stmt.BindString(1, name)
+	err = exec(stmt, func() {
+		columns = append(columns, stmt.ReadString(0))
+	})
+	stmt.Close()
+	if err != nil {
+		return err
+	}
+	if len(table.Columns) == 0 {
+		return errors.New("no columns")
+	}
+	names := make([]string, len(table.Columns))
+	values := make([]string, len(table.Columns))
+	for i, col := range table.Columns {
+		if !slices.Contains(columns, col) {
+			return fmt.Errorf("unknown column %s", col)
+		}
+		names[i] = quoteIdentifier(col)
+		values[i] = fmt.Sprintf("value->>%d", i)
+	}
+	stmt = db.Prepare(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM json_each(?)", quoteIdentifier(name), strings.Join(names, ", "), strings.Join(values, ", ")))
+	defer stmt.Close()
+	stmt.BindBytes(1, table.Rows)
+	return stmt.Exec()
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/sqlite"
+)
+
+// createExportTestSavefile returns a savefile at the current schema version
+// with something in most of its tables, including values that are awkward to
+// carry through JSON.
+func createExportTestSavefile(t *testing.T) *savefile {
+	ps := openTestSavefile(t, createLegacySavefile(t), func() (int, error) { return legacySlot, nil })
+	b := savefileBinding{
+		seedName:   "SEED",
+		apfileHash: "abc123",
+		slotNames:  map[int]string{legacySlot: "Bob"},
+		mwKnown:    true,
+		mwServer:   "localhost:38281",
+		mwRoom:     "eggu",
+	}
+	if err := ps.setBinding(b); err != nil {
+		t.Fatal(err)
+	}
+	data := apdata{
+		SeedName: "SEED",
+		SlotInfo: map[int]apslot{legacySlot: {Name: "Bob", Game: "Hollow Knight"}},
+		Datapackage: map[string]apgamedata{"Hollow Knight": {
+			Checksum:     "hk",
+			ItemNameToID: map[string]int64{"Lantern": 1 << 60},
+			Original:     map[string]any{"item_name_groups": map[string]any{"Tools": &[]any{"Lantern"}}},
+		}},
+	}
+	if err := ps.setAPData(data); err != nil {
+		t.Fatal(err)
+	}
+	// Beyond what a float64 can hold exactly.
+	if _, err := ps.addSentItems(legacySlot, approto.NetworkItem{Item: 1<<53 + 1, Location: -1, Player: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ps.setStoredData("quotes", []byte(`{"text":"\"Ünïcödé\"\n'quoted'"}`)); err != nil {
+		t.Fatal(err)
+	}
+	err := ps.quarantineItem(quarantinedItem{slot: legacySlot, label: "MultiWorld-Item", content: "Mystery_(1)", fromPlayerID: 0, reason: "no such item"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+// importTestSavefile imports export and opens the result as Isthmus would.
+func importTestSavefile(t *testing.T, export savefileExport) *savefile {
+	name := filepath.Join(t.TempDir(), "imported.isthmus")
+	db, err := sqlite.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = importSavefile(db, export)
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return openTestSavefile(t, name, func() (int, error) {
+		return 0, errors.New("legacySlot called for an imported savefile")
+	})
+}
+
+// reencode passes export through JSON, as the export and import commands do.
+func reencode(t *testing.T, export savefileExport) savefileExport {
+	encoded, err := json.MarshalIndent(export, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded savefileExport
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	ps := createExportTestSavefile(t)
+	export, err := exportSavefile(ps.db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imported := importTestSavefile(t, reencode(t, export))
+	again, err := exportSavefile(imported.db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, export) {
+		for name, table := range export.Tables {
+			if !reflect.DeepEqual(again.Tables[name], table) {
+				t.Errorf("table %s was exported as\n%+v\nbut after importing it, as\n%+v", name, table, again.Tables[name])
+			}
+		}
+		t.Fatalf("export changed after importing it")
+	}
+
+	if version, err := schemaVersion(imported.db); err != nil || version != savefileVersion {
+		t.Errorf("imported savefile is at version %d (%v), want %d", version, err, savefileVersion)
+	}
+	for _, check := range []func(ps *savefile) (any, error){
+		func(ps *savefile) (any, error) { return ps.getBinding() },
+		func(ps *savefile) (any, error) { return ps.getAPData() },
+		func(ps *savefile) (any, error) { return ps.getSlots() },
+		func(ps *savefile) (any, error) { return ps.getQuarantinedItems() },
+		func(ps *savefile) (any, error) { return ps.getSentItems(legacySlot, 0) },
+		func(ps *savefile) (any, error) {
+			data, _, err := ps.getStoredData("quotes")
+			return string(data), err
+		},
+	} {
+		want, err := check(ps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := check(imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("imported savefile has %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestRedactedExport(t *testing.T) {
+	ps := createExportTestSavefile(t)
+	export, err := exportSavefile(ps.db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !export.Redacted {
+		t.Error("export isn't marked as redacted")
+	}
+	encoded, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(encoded), "Crossroads") {
+		t.Errorf("redacted export contains the spoiler log: %s", encoded)
+	}
+	slots, err := importTestSavefile(t, reencode(t, export)).getSlots()
+	if err != nil || len(slots) != 1 {
+		t.Errorf("imported savefile has slots %v (%v)", slots, err)
+	}
+}
+
+func TestImportRejectsOtherStatements(t *testing.T) {
+	ps := createExportTestSavefile(t)
+	export, err := exportSavefile(ps.db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, schema := range []string{
+		"CREATE TABLE mw_players (player_id INTEGER); DROP TABLE mw_global_data",
+		"CREATE VIEW mw_players AS SELECT 1",
+		"CREATE TABLE other (player_id INTEGER, nickname TEXT, spoiler_log TEXT)",
+	} {
+		bad := reencode(t, export)
+		table := bad.Tables["mw_players"]
+		table.Schema = schema
+		bad.Tables["mw_players"] = table
+
+		db, err := sqlite.Open(filepath.Join(t.TempDir(), "imported.isthmus"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = importSavefile(db, bad)
+		db.Close()
+		if err == nil {
+			t.Errorf("import with schema %q succeeded", schema)
+		}
+	}
+}
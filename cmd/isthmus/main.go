@@ -11,20 +11,45 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/capture"
 	"github.com/dpinela/mmm/internal/mwproto"
 	"github.com/dpinela/mmm/internal/pickle"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var opts options
 	flag.StringVar(&opts.savefile, "savefile", "./savefile.isthmus", "Store multiworld result and game data in `file`")
 	flag.StringVar(&opts.apfile, "apfile", "./AP.archipelago", "The Archipelago seed to serve")
 	flag.StringVar(&opts.mwserver, "mwserver", "mw.hkmp.org:38281", "The multiworld server to join")
 	flag.StringVar(&opts.mwroom, "mwroom", "eggu", "The room to join")
+	flag.StringVar(&opts.mwresult, "mwresult", "", "Save the MW shuffle result to `file` (defaults to the savefile path plus "+mwResultFileSuffix+")")
 	flag.IntVar(&opts.apport, "apport", 38281, "Serve Archipelago on port `port`")
+	flag.StringVar(&opts.mwnick, "mwnick", "", "Join the room as `nickname` (defaults to the AP slot name)")
+	flag.Var(&opts.mwmetadata, "mwmeta", "Send `key=value` as ready metadata when joining the room; may be repeated")
+	flag.Var(&opts.mwgroups, "mwgroup", "Send placements whose item or location is in an AP group in the given MW item group, as `mwgroup=item:apgroup` or `mwgroup=location:apgroup`; may be repeated")
+	flag.BoolVar(&opts.mwgamenames, "mwgamenames", false, "Show MW players which AP game each of our items and locations comes from")
+	flag.IntVar(&opts.mwseed, "mwseed", 666_666_666, "The `seed` to send along with our placements")
+	flag.IntVar(&opts.mwautostart, "mwautostart", 0, "Start the game once `n` players are in the room (0 to wait for someone else to start it)")
+	flag.IntVar(&opts.mwretries, "mwretries", 3, "Retry joining the room up to `n` times if denied or disconnected during setup")
+	flag.StringVar(&opts.capturefile, "capture", "", "Record all MW and AP traffic to `file`")
+	flag.BoolVar(&opts.solo, "solo", false, "Serve the seed by itself, without joining a MW room")
+	flag.BoolVar(&opts.rebind, "rebind", false, "Use the savefile even if it was made for a different .archipelago file, MW server or room, and record the new ones in it")
 	flag.Parse()
+	opts.apfileGiven = flagGiven(flag.CommandLine, "apfile")
 
 	if err := serve(opts); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -33,11 +58,56 @@ func main() {
 }
 
 type options struct {
-	savefile string
-	apfile   string
-	mwserver string
-	mwroom   string
-	apport   int
+	savefile    string
+	apfile      string
+	apfileGiven bool
+	mwserver    string
+	mwroom      string
+	mwresult    string
+	apport      int
+	mwnick      string
+	mwmetadata  metadataFlag
+	mwgroups    groupRulesFlag
+	mwgamenames bool
+	mwseed      int
+	mwautostart int
+	mwretries   int
+	capturefile string
+	capture     *capture.Writer
+	solo        bool
+	rebind      bool
+}
+
+// flagGiven reports whether the flag called name was set on the command line.
+func flagGiven(flags *flag.FlagSet, name string) (given bool) {
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return
+}
+
+type metadataFlag []mwproto.KeyValuePair
+
+func (m *metadataFlag) String() string {
+	if m == nil {
+		return ""
+	}
+	pairs := make([]string, len(*m))
+	for i, kv := range *m {
+		pairs[i] = kv.Key + "=" + kv.Value
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m *metadataFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok {
+		return fmt.Errorf("metadata must be of the form key=value: %q", s)
+	}
+	*m = append(*m, mwproto.KeyValuePair{Key: k, Value: v})
+	return nil
 }
 
 type placedItem struct {
@@ -46,35 +116,126 @@ type placedItem struct {
 }
 
 func serve(opts options) error {
-	data, err := readAPFile(opts.apfile)
+	cw, err := createCapture(opts.capturefile)
 	if err != nil {
 		return err
 	}
-	if len(data.ConnectNames) != 1 {
-		return fmt.Errorf(".archipelago contains %d worlds, expected only one", len(data.ConnectNames))
-	}
-	if len(data.Version) != approto.VersionNumberSize {
-		return fmt.Errorf("invalid .archipelago version: %v", data.Version)
+	if cw != nil {
+		defer cw.Close()
+		opts.capture = cw
 	}
+	// Once the savefile exists, it has everything needed from the
+	// .archipelago file.
 	_, err = os.Stat(opts.savefile)
 	if err == nil {
-		return playMW(opts, data)
+		return playMW(opts)
 	}
 	if !errors.Is(err, fs.ErrNotExist) {
 		return err
 	}
-	if err := setupMW(opts, data); err != nil {
+	// The savefile is made from the .archipelago file, so there's no need
+	// to check it against the savefile afterwards.
+	opts.apfileGiven = false
+	data, err := readAPFile(opts.apfile)
+	if err != nil {
+		return err
+	}
+	if err := checkAPData(data); err != nil {
+		return err
+	}
+	if opts.solo {
+		log.Println("creating savefile for solo play")
+		if err := createSoloSavefile(opts.savefile, opts.apfile, data); err != nil {
+			return err
+		}
+		return playMW(opts)
+	}
+	resultFile := opts.mwResultFile()
+	if res, saved, err := readMWResults(resultFile, data); err == nil {
+		// Results left over from an earlier game saved at the same path
+		// mustn't be picked up by accident.
+		switch {
+		case saved != nil:
+			if problems := saved.mismatches(opts, data); len(problems) > 0 {
+				return fmt.Errorf("%s: %s; remove it to join the room again", resultFile, strings.Join(problems, "; "))
+			}
+		case opts.mwresult == "":
+			return fmt.Errorf("%s doesn't record the seed and room it is for; pass it with -mwresult to use it anyway, or remove it to join the room again", resultFile)
+		}
+		log.Println("creating savefile from saved MW results in", resultFile)
+		if missing := slotsWithoutResults(data, res); len(missing) > 0 {
+			log.Printf("MW setup failed for slots %v; they won't be served", missing)
+		}
+		b, err := newSavefileBinding(opts.apfile, data)
+		if err != nil {
+			return err
+		}
+		if err := createSavefile(opts.savefile, res, data, b.withMW(opts)); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if err := setupMW(opts, data); err != nil {
 		return err
 	}
 	log.Println("MW setup complete")
-	return playMW(opts, data)
+	return playMW(opts)
 }
 
-func singularKey[K comparable, V any](m map[K]V) K {
-	for k := range m {
-		return k
+// checkAPData checks that data can be served.
+func checkAPData(data apdata) error {
+	if len(playerSlots(data)) == 0 {
+		return errors.New(".archipelago contains no player slots")
+	}
+	if len(data.Version) != approto.VersionNumberSize {
+		return fmt.Errorf("invalid .archipelago version: %v", data.Version)
 	}
-	panic("singularKey undefined on empty map")
+	return nil
+}
+
+func (opts options) mwResultFile() string {
+	if opts.mwresult != "" {
+		return opts.mwresult
+	}
+	return opts.savefile + mwResultFileSuffix
+}
+
+func dialMW(opts options) (*mwproto.Client, error) {
+	return dialMWTapped(opts, nil)
+}
+
+// dialMWTapped is like dialMW, but also passes every frame to tap, if it
+// isn't nil.
+func dialMWTapped(opts options, tap mwproto.Tap) (*mwproto.Client, error) {
+	if opts.capture != nil {
+		captureTap := opts.capture.MWTap()
+		if tap == nil {
+			tap = captureTap
+		} else {
+			outerTap := tap
+			tap = func(outgoing bool, frame []byte, msg mwproto.Message) {
+				captureTap(outgoing, frame, msg)
+				outerTap(outgoing, frame, msg)
+			}
+		}
+	}
+	if tap == nil {
+		return mwproto.Dial(opts.mwserver)
+	}
+	return mwproto.DialTapped(opts.mwserver, tap)
+}
+
+// playerSlots returns the IDs of the slots in data that belong to actual
+// players, as opposed to item link groups or spectators, in ascending order.
+func playerSlots(data apdata) []int {
+	var ids []int
+	for id, slot := range data.SlotInfo {
+		if approto.SlotType(slot.Type.Code) == approto.SlotTypePlayer {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids
 }
 
 type apdata struct {
@@ -143,20 +304,197 @@ func readAPFile(name string) (data apdata, err error) {
 	return
 }
 
+// storedAPData returns the parts of data that are needed to serve the seed
+// once the savefile has been set up, as stored in it. Sets are turned into
+// lists along the way, so that everything can be encoded as JSON.
+func storedAPData(data apdata) apdata {
+	stored := apdata{
+		ConnectNames:      data.ConnectNames,
+		Locations:         map[int]map[int64][]int64{},
+		Datapackage:       make(map[string]apgamedata, len(data.Datapackage)),
+		PrecollectedItems: map[int][]int64{},
+		SlotInfo:          data.SlotInfo,
+		SlotData:          map[int]map[string]any{},
+		Version:           data.Version,
+		Tags:              data.Tags,
+		ServerOptions:     data.ServerOptions,
+		SeedName:          data.SeedName,
+	}
+	for _, slot := range playerSlots(data) {
+		stored.Locations[slot] = data.Locations[slot]
+		stored.PrecollectedItems[slot] = data.PrecollectedItems[slot]
+		stored.SlotData[slot] = jsonCompatible(data.SlotData[slot]).(map[string]any)
+	}
+	for game, dpkg := range data.Datapackage {
+		dpkg.Original = jsonCompatible(dpkg.Original).(map[string]any)
+		stored.Datapackage[game] = dpkg
+	}
+	return stored
+}
+
+// jsonCompatible converts the sets in an unpickled value into lists.
+func jsonCompatible(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		if v == nil {
+			return v
+		}
+		w := make(map[string]any, len(v))
+		for k, x := range v {
+			w[k] = jsonCompatible(x)
+		}
+		return w
+	case *[]any:
+		w := make([]any, len(*v))
+		for i, x := range *v {
+			w[i] = jsonCompatible(x)
+		}
+		return w
+	case map[any]struct{}:
+		w := make([]any, 0, len(v))
+		for x := range v {
+			w = append(w, jsonCompatible(x))
+		}
+		return w
+	default:
+		return v
+	}
+}
+
 var errConnectionLost = errors.New("connection lost")
 
-const mwResultFileName = "mwresult.json"
+const mwResultFileSuffix = ".mwresult.json"
+
+// mwResults holds the MW result for each AP slot, keyed by slot ID.
+type mwResults map[int]mwproto.ResultMessage
 
-func readMWResult(workdir string) (res mwproto.ResultMessage, err error) {
-	f, err := os.Open(filepath.Join(workdir, mwResultFileName))
+// A savedMWResults holds the Result frames received for each AP slot,
+// exactly as the MW server sent them, along with the seed and room they are
+// for.
+type savedMWResults struct {
+	SeedName string         `json:"seed_name"`
+	MWServer string         `json:"mw_server"`
+	MWRoom   string         `json:"mw_room"`
+	Frames   map[int][]byte `json:"frames"`
+}
+
+// readMWResults reads the MW results saved in the named file. Files written
+// by older versions of Isthmus hold the decoded results instead of frames,
+// and don't record what they are for, so saved is nil for them. Those
+// written before Isthmus could serve several slots hold a single result,
+// which is taken to belong to data's only player slot.
+func readMWResults(name string, data apdata) (res mwResults, saved *savedMWResults, err error) {
+	encoded, err := os.ReadFile(name)
 	if err != nil {
 		return
 	}
-	defer f.Close()
-	err = json.NewDecoder(f).Decode(&res)
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("read MW results from %s: %w", name, err)
+		}
+	}()
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(encoded, &fields); err != nil {
+		return
+	}
+	if _, ok := fields["frames"]; ok {
+		saved = &savedMWResults{}
+		if err = json.Unmarshal(encoded, saved); err != nil {
+			return
+		}
+		if saved.Frames == nil {
+			saved.Frames = map[int][]byte{}
+		}
+		res, err = saved.results()
+		if err != nil {
+			saved = nil
+		}
+		return
+	}
+	if _, legacy := fields["PlayerID"]; !legacy {
+		err = json.Unmarshal(encoded, &res)
+		return
+	}
+	slots := playerSlots(data)
+	if len(slots) != 1 {
+		err = fmt.Errorf("file holds a single MW result, but .archipelago contains %d slots", len(slots))
+		return
+	}
+	var single mwproto.ResultMessage
+	if err = json.Unmarshal(encoded, &single); err != nil {
+		return
+	}
+	res = mwResults{slots[0]: single}
 	return
 }
 
+// results decodes the saved frames.
+func (saved *savedMWResults) results() (mwResults, error) {
+	res := mwResults{}
+	for slot, frame := range saved.Frames {
+		env, err := mwproto.DecodeFrame(frame)
+		if err != nil {
+			return nil, fmt.Errorf("slot %d: %w", slot, err)
+		}
+		r, ok := env.Message.(mwproto.ResultMessage)
+		if !ok {
+			return nil, fmt.Errorf("slot %d: got %T instead of a result", slot, env.Message)
+		}
+		res[slot] = r
+	}
+	return res, nil
+}
+
+// mismatches describes how the seed and room that saved is for differ from
+// those in opts and data.
+func (saved *savedMWResults) mismatches(opts options, data apdata) []string {
+	var problems []string
+	if saved.SeedName != data.SeedName {
+		problems = append(problems, fmt.Sprintf("results are for seed %s, but .archipelago is for seed %s", saved.SeedName, data.SeedName))
+	}
+	if saved.MWServer != opts.mwserver {
+		problems = append(problems, fmt.Sprintf("results are from MW server %s, not %s", saved.MWServer, opts.mwserver))
+	} else if saved.MWRoom != opts.mwroom {
+		problems = append(problems, fmt.Sprintf("results are from MW room %s, not %s", saved.MWRoom, opts.mwroom))
+	}
+	return problems
+}
+
+// writeMWResults saves the results to the named file, replacing it
+// atomically so that a crash midway through never leaves a truncated result
+// behind.
+func writeMWResults(name string, saved savedMWResults) error {
+	if err := writeJSONFile(name, saved); err != nil {
+		return fmt.Errorf("save MW results: %w", err)
+	}
+	return nil
+}
+
+// writeJSONFile atomically replaces the named file with the JSON encoding of v.
+func writeJSONFile(name string, v any) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(encoded); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
 // This is the main item group used by the HK rando as well as
 // the sole item group used by Haiku and Death's Door for multiworld
 // purposes.
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+func TestMWResultsRoundTrip(t *testing.T) {
+	result := mwproto.ResultMessage{
+		PlayerID:  1,
+		RandoID:   42,
+		Nicknames: []string{"Other", "Me"},
+		Placements: map[string][]mwproto.ResultPlacement{
+			"Main Item Group": {{Item: "MW(0)_Lantern", Location: "Somewhere_(1)"}},
+		},
+		GeneratedHash: "hash",
+	}
+	var frame bytes.Buffer
+	if err := mwproto.Write(&frame, result); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "savefile"+mwResultFileSuffix)
+	saved := savedMWResults{
+		SeedName: "SEED",
+		MWServer: "localhost:38281",
+		MWRoom:   "room",
+		Frames:   map[int][]byte{3: frame.Bytes()},
+	}
+	if err := writeMWResults(name, saved); err != nil {
+		t.Fatal(err)
+	}
+	res, readBack, err := readMWResults(name, apdata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, mwResults{3: result}) {
+		t.Errorf("results = %#v, want %#v", res, mwResults{3: result})
+	}
+	if readBack == nil || !reflect.DeepEqual(*readBack, saved) {
+		t.Errorf("saved results = %#v, want %#v", readBack, saved)
+	}
+
+	opts := options{mwserver: saved.MWServer, mwroom: saved.MWRoom}
+	if problems := readBack.mismatches(opts, apdata{SeedName: "SEED"}); len(problems) != 0 {
+		t.Errorf("unexpected mismatches: %v", problems)
+	}
+	opts.mwroom = "other"
+	if problems := readBack.mismatches(opts, apdata{SeedName: "OTHER"}); len(problems) != 2 {
+		t.Errorf("mismatches = %v, want one for the seed and one for the room", problems)
+	}
+}
+
+func TestReadLegacyMWResults(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "mwresult.json")
+	if err := os.WriteFile(name, []byte(`{"PlayerID":0,"RandoID":7,"Nicknames":["Me"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	slot := apslot{Name: "Me"}
+	slot.Type.Code = int(approto.SlotTypePlayer)
+	data := apdata{SlotInfo: map[int]apslot{2: slot}}
+	res, saved, err := readMWResults(name, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != nil {
+		t.Errorf("legacy results claim to be for seed %s", saved.SeedName)
+	}
+	if r, ok := res[2]; !ok || r.RandoID != 7 {
+		t.Errorf("results = %#v, want rando 7 for slot 2", res)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+// mwBotCommand runs a simulated MW player, which joins a room with a fixed
+// list of placements, and then plays by itself: it confirms every item it
+// receives and, optionally, checks one of its locations at a time.
+func mwBotCommand(args []string) error {
+	var (
+		server, room, nickname, placementsFile string
+		captureFile                            string
+		numPlacements, autostart, seed         int
+		findInterval                           time.Duration
+	)
+	flags := flag.NewFlagSet("mwbot", flag.ExitOnError)
+	flags.StringVar(&server, "mwserver", "localhost:38281", "The multiworld server to join")
+	flags.StringVar(&room, "mwroom", "eggu", "The room to join")
+	flags.StringVar(&nickname, "nick", "Bot", "Join the room as `nickname`")
+	flags.StringVar(&placementsFile, "placements", "", "Read placements from `file`, a JSON object mapping item groups to lists of placements")
+	flags.IntVar(&numPlacements, "generate", 20, "If -placements is not given, make up `n` placements")
+	flags.IntVar(&autostart, "mwautostart", 0, "Start the game once `n` players are in the room")
+	flags.IntVar(&seed, "mwseed", 0, "The `seed` to send along with our placements")
+	flags.DurationVar(&findInterval, "find", 0, "Check a location every `interval` (0 to never check any)")
+	flags.StringVar(&captureFile, "capture", "", "Record all MW traffic to `file`")
+	flags.Parse(args)
+
+	var placements map[string][]mwproto.Placement
+	if placementsFile != "" {
+		f, err := os.ReadFile(placementsFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(f, &placements); err != nil {
+			return fmt.Errorf("parse %s: %w", placementsFile, err)
+		}
+	} else {
+		placements = map[string][]mwproto.Placement{singularItemGroup: makeBotPlacements(nickname, numPlacements)}
+	}
+
+	cw, err := createCapture(captureFile)
+	if err != nil {
+		return err
+	}
+	var conn *mwproto.Client
+	if cw != nil {
+		defer cw.Close()
+		conn, err = mwproto.DialTapped(server, cw.MWTap())
+	} else {
+		conn, err = mwproto.Dial(server)
+	}
+	if err != nil {
+		return fmt.Errorf("connect to MW: %w", err)
+	}
+	defer conn.Close()
+	session := mwproto.NewSession(conn)
+	session.Timeout = mwTimeout
+	starter := autoStarter{conn: conn, threshold: autostart}
+	session.OnEvent = starter.handleEvent
+
+	if _, err := session.Connect(); err != nil {
+		return err
+	}
+	names, err := session.JoinRoom(mwproto.ReadyMessage{Room: room, Nickname: nickname})
+	if err != nil {
+		return err
+	}
+	log.Printf("joined room %s with players %v", room, names)
+	starter.update(names)
+	if err := session.AwaitRandoRequest(); err != nil {
+		return err
+	}
+	result, err := session.SendRando(mwproto.RandoGeneratedMessage{Items: placements, Seed: int32(seed)})
+	if err != nil {
+		return err
+	}
+	log.Printf("game generated; we are player %d of %v", result.PlayerID, result.Nicknames)
+	if err := session.Join(mwproto.JoinMessage{
+		DisplayName: nickname,
+		RandoID:     result.RandoID,
+		PlayerID:    result.PlayerID,
+	}); err != nil {
+		return err
+	}
+
+	if findInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go findLocations(conn, result, findInterval, done)
+	}
+
+	for {
+		msg, err := session.Next()
+		if err != nil {
+			return err
+		}
+		switch msg := msg.(type) {
+		case mwproto.DataReceiveMessage:
+			log.Printf("received %s from %s", msg.Content, msg.From)
+			conn.Send(mwproto.DataReceiveConfirmMessage{Label: msg.Label, Data: msg.Content, From: msg.From})
+			conn.Send(mwproto.SaveMessage{})
+		case mwproto.DatasReceiveMessage:
+			log.Printf("received %d items from %s", len(msg.Items), msg.From)
+			conn.Send(mwproto.DatasReceiveConfirmMessage{Count: int32(len(msg.Items)), From: msg.From})
+			conn.Send(mwproto.SaveMessage{})
+		case mwproto.DataSendConfirmMessage:
+			log.Printf("player %d confirmed receiving %s", msg.To, msg.Content)
+		case mwproto.RequestCharmNotchCostsMessage:
+			conn.Send(mwproto.AnnounceCharmNotchCostsMessage{PlayerID: result.PlayerID, NotchCosts: map[int]int{}})
+		default:
+			log.Printf("ignoring %#v", msg)
+		}
+	}
+}
+
+func makeBotPlacements(nickname string, n int) []mwproto.Placement {
+	placements := make([]mwproto.Placement, n)
+	for i := range placements {
+		placements[i] = mwproto.Placement{
+			Item:     mwproto.Name{Name: nickname + "_Item", Discriminator: int64(i), HasDiscriminator: true}.Encode(),
+			Location: mwproto.Name{Name: nickname + "_Location", Discriminator: int64(i), HasDiscriminator: true}.Encode(),
+		}
+	}
+	return placements
+}
+
+// findLocations checks each location in our world in turn, sending the
+// items found in them to their owners.
+func findLocations(conn *mwproto.Client, result mwproto.ResultMessage, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for _, group := range slices.Sorted(maps.Keys(result.Placements)) {
+		for _, p := range result.Placements[group] {
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+			owner, item, ok := mwproto.ParseQualifiedName(p.Item)
+			if !ok {
+				log.Println("item without qualifier:", p.Item)
+				continue
+			}
+			if owner == int(result.PlayerID) {
+				log.Printf("found own item %s at %s", item, p.Location)
+				continue
+			}
+			log.Printf("found %s for player %d at %s", item, owner, p.Location)
+			conn.Send(mwproto.DataSendMessage{
+				Label:   mwproto.LabelMultiworldItem,
+				Content: item,
+				To:      int32(owner),
+				TTL:     sentItemTTL,
+			})
+		}
+	}
+	log.Println("all locations checked")
+}
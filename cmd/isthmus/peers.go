@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"runtime/debug"
+
+	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+// Ready metadata keys through which Isthmus players in a room tell each other
+// which AP games their worlds really are.
+const (
+	metadataKeyVersion     = "isthmus.version"
+	metadataKeyGame        = "isthmus.game"
+	metadataKeyDatapackage = "isthmus.datapackage"
+)
+
+// A peerDatapackage is the part of a game's datapackage that other players in
+// a MW room need to know about: the items a player contributes to the room and
+// the locations in their world.
+type peerDatapackage struct {
+	// Checksum is that of the full datapackage, so that peers that have it
+	// can use it instead.
+	Checksum  string           `json:"checksum"`
+	Items     map[string]int64 `json:"items"`
+	Locations map[string]int64 `json:"locations"`
+}
+
+// peerMetadata returns the ready metadata that describes a slot's world to
+// other Isthmus players, given the placements it sends to the room.
+func peerMetadata(data apdata, slotID int, placements map[string][]mwproto.Placement) ([]mwproto.KeyValuePair, error) {
+	game := data.SlotInfo[slotID].Game
+	dpkg := data.Datapackage[game]
+	peerPkg := peerDatapackage{
+		Checksum:  dpkg.Checksum,
+		Items:     map[string]int64{},
+		Locations: map[string]int64{},
+	}
+	for _, group := range placements {
+		for _, p := range group {
+			// Items that AP placed here for slots playing other games
+			// aren't in this game's datapackage, and are left for peers
+			// to work out for themselves.
+			if id, ok := dpkg.ItemNameToID[mwproto.StripDiscriminator(p.Item)]; ok {
+				peerPkg.Items[mwproto.StripDiscriminator(p.Item)] = id
+			}
+			if id, ok := mwproto.ParseDiscriminator(p.Location); ok {
+				peerPkg.Locations[mwproto.StripDiscriminator(p.Location)] = id
+			}
+		}
+	}
+	encoded, err := json.Marshal(peerPkg)
+	if err != nil {
+		return nil, err
+	}
+	return []mwproto.KeyValuePair{
+		{Key: metadataKeyVersion, Value: isthmusVersion()},
+		{Key: metadataKeyGame, Value: game},
+		{Key: metadataKeyDatapackage, Value: string(encoded)},
+	}, nil
+}
+
+func isthmusVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// A peerGame is what another Isthmus player told us about their world.
+type peerGame struct {
+	version, game string
+	datapackage   peerDatapackage
+}
+
+func parsePeerMetadata(metadata []mwproto.KeyValuePair) (peer peerGame, ok bool) {
+	var encodedPkg string
+	for _, kv := range metadata {
+		switch kv.Key {
+		case metadataKeyVersion:
+			peer.version = kv.Value
+		case metadataKeyGame:
+			peer.game = kv.Value
+		case metadataKeyDatapackage:
+			encodedPkg = kv.Value
+		}
+	}
+	if peer.game == "" || encodedPkg == "" {
+		return peer, false
+	}
+	if err := json.Unmarshal([]byte(encodedPkg), &peer.datapackage); err != nil {
+		log.Printf("invalid datapackage from Isthmus %s player: %v", peer.version, err)
+		return peer, false
+	}
+	return peer, true
+}
+
+// loadPeerGames replaces the synthetic worlds of other Isthmus players with
+// their real games, for those that published them. A player keeps their
+// synthetic world if any of their items or locations that we know of is
+// missing from what they published, or if it conflicts with what we already
+// know about their game.
+func (r *room) loadPeerGames() error {
+	metadata, err := r.state.getPlayerMetadata()
+	if err != nil {
+		return err
+	}
+	neededItems := map[int]map[string]bool{}
+	neededLocations := map[int]map[string]bool{}
+	for p, err := range r.state.getOwnWorldPlacements() {
+		if err != nil {
+			return err
+		}
+		addName(neededItems, p.ownerID, mwproto.StripDiscriminator(p.name))
+	}
+	for loc, err := range r.state.getOwnItemLocations() {
+		if err != nil {
+			return err
+		}
+		addName(neededLocations, loc.playerID, mwproto.StripDiscriminator(loc.name))
+	}
+
+	for i, nick := range r.nicknames {
+		if _, local := r.slotsByPlayer[i]; local {
+			continue
+		}
+		peer, ok := parsePeerMetadata(metadata[i])
+		if !ok {
+			continue
+		}
+		if err := r.addPeerGame(i, peer, neededItems[i], neededLocations[i]); err != nil {
+			log.Printf("showing %s's world as %q: %v", nick, r.games[i], err)
+			continue
+		}
+		log.Printf("%s is playing %s through Isthmus %s", nick, peer.game, peer.version)
+	}
+	return nil
+}
+
+func addName(names map[int]map[string]bool, playerID int, name string) {
+	if names[playerID] == nil {
+		names[playerID] = map[string]bool{}
+	}
+	names[playerID][name] = true
+}
+
+func (r *room) addPeerGame(playerID int, peer peerGame, items, locations map[string]bool) error {
+	if full, ok := r.data.Datapackage[peer.game]; ok {
+		if full.Checksum != peer.datapackage.Checksum {
+			return fmt.Errorf("their %s datapackage differs from ours", peer.game)
+		}
+		if err := checkNames(items, full.ItemNameToID, "item"); err != nil {
+			return err
+		}
+		if err := checkNames(locations, full.LocationNameToID, "location"); err != nil {
+			return err
+		}
+		r.games[playerID] = peer.game
+		r.realGames[playerID] = true
+		return nil
+	}
+
+	if err := checkNames(items, peer.datapackage.Items, "item"); err != nil {
+		return err
+	}
+	if err := checkNames(locations, peer.datapackage.Locations, "location"); err != nil {
+		return err
+	}
+	// Other players may have published other parts of the same game.
+	dp, ok := r.peerPackages[peer.game]
+	if !ok {
+		dp = &approto.DataPackage{
+			ItemNameToID:     map[string]int64{},
+			LocationNameToID: map[string]int64{},
+		}
+	}
+	if err := checkConsistent(dp.ItemNameToID, peer.datapackage.Items, "item"); err != nil {
+		return err
+	}
+	if err := checkConsistent(dp.LocationNameToID, peer.datapackage.Locations, "location"); err != nil {
+		return err
+	}
+	maps.Copy(dp.ItemNameToID, peer.datapackage.Items)
+	maps.Copy(dp.LocationNameToID, peer.datapackage.Locations)
+	r.peerPackages[peer.game] = dp
+	r.games[playerID] = peer.game
+	r.realGames[playerID] = true
+	return nil
+}
+
+func checkNames(names map[string]bool, ids map[string]int64, kind string) error {
+	for name := range names {
+		if _, ok := ids[name]; !ok {
+			return fmt.Errorf("%s %q is missing from their datapackage", kind, name)
+		}
+	}
+	return nil
+}
+
+func checkConsistent(known, published map[string]int64, kind string) error {
+	for name, id := range published {
+		if knownID, ok := known[name]; ok && knownID != id {
+			return fmt.Errorf("%s %q has ID %d, but another player gave it ID %d", kind, name, id, knownID)
+		}
+	}
+	return nil
+}
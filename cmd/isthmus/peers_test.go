@@ -0,0 +1,177 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"testing"
+
+	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+func TestPeerMetadataRoundTrip(t *testing.T) {
+	data := apdata{
+		SlotInfo: map[int]apslot{1: {Name: "Tunic Player", Game: "TUNIC"}},
+		Datapackage: map[string]apgamedata{"TUNIC": {
+			Checksum:     "tunic-checksum",
+			ItemNameToID: map[string]int64{"Stick": 10, "Sword": 11, "Shield": 12},
+		}},
+	}
+	placements := map[string][]mwproto.Placement{
+		"Main Item Group": {
+			{
+				Item:     mwproto.Name{Name: "Sword", Discriminator: 0, HasDiscriminator: true}.Encode(),
+				Location: mwproto.Name{Name: "Chest_(West)", Discriminator: 500, HasDiscriminator: true}.Encode(),
+			},
+			{
+				// Placed by AP for a slot playing another game.
+				Item:     mwproto.Name{Name: "Grubsong", Game: "Hollow Knight", Discriminator: 1, HasDiscriminator: true}.Encode(),
+				Location: mwproto.Name{Name: "Well", Discriminator: 501, HasDiscriminator: true}.Encode(),
+			},
+		},
+	}
+	metadata, err := peerMetadata(data, 1, placements)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, ok := parsePeerMetadata(append([]mwproto.KeyValuePair{{Key: "other", Value: "x"}}, metadata...))
+	if !ok {
+		t.Fatalf("metadata %v wasn't recognised", metadata)
+	}
+	want := peerDatapackage{
+		Checksum:  "tunic-checksum",
+		Items:     map[string]int64{"Sword": 11},
+		Locations: map[string]int64{"Chest_(West)": 500, "Well": 501},
+	}
+	if peer.game != "TUNIC" || !reflect.DeepEqual(peer.datapackage, want) {
+		t.Errorf("got %s %+v, want TUNIC %+v", peer.game, peer.datapackage, want)
+	}
+}
+
+func TestParsePeerMetadataIgnoresOtherPlayers(t *testing.T) {
+	for _, metadata := range [][]mwproto.KeyValuePair{
+		nil,
+		{{Key: metadataKeyGame, Value: "TUNIC"}},
+		{{Key: metadataKeyGame, Value: "TUNIC"}, {Key: metadataKeyDatapackage, Value: "{"}},
+	} {
+		if peer, ok := parsePeerMetadata(metadata); ok {
+			t.Errorf("metadata %v was taken as %+v", metadata, peer)
+		}
+	}
+}
+
+func newPeerTestRoom(players int) *room {
+	r := &room{
+		data:         apdata{Datapackage: map[string]apgamedata{}},
+		games:        make([]string, players),
+		realGames:    map[int]bool{},
+		peerPackages: map[string]*approto.DataPackage{},
+	}
+	for i := range r.games {
+		r.games[i] = "Synthetic World"
+	}
+	return r
+}
+
+func tunicPeer(items, locations map[string]int64) peerGame {
+	return peerGame{
+		version:     "v1",
+		game:        "TUNIC",
+		datapackage: peerDatapackage{Checksum: "tunic-checksum", Items: items, Locations: locations},
+	}
+}
+
+func TestPeerDatapackagesAreMerged(t *testing.T) {
+	r := newPeerTestRoom(3)
+	first := tunicPeer(map[string]int64{"Sword": 11}, map[string]int64{"Chest": 500})
+	second := tunicPeer(map[string]int64{"Sword": 11, "Shield": 12}, map[string]int64{"Well": 501})
+	if err := r.addPeerGame(0, first, map[string]bool{"Sword": true}, map[string]bool{"Chest": true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.addPeerGame(2, second, map[string]bool{"Shield": true}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	dp := r.peerPackages["TUNIC"]
+	wantItems := map[string]int64{"Sword": 11, "Shield": 12}
+	wantLocations := map[string]int64{"Chest": 500, "Well": 501}
+	if !maps.Equal(dp.ItemNameToID, wantItems) || !maps.Equal(dp.LocationNameToID, wantLocations) {
+		t.Errorf("merged datapackage has items %v and locations %v, want %v and %v", dp.ItemNameToID, dp.LocationNameToID, wantItems, wantLocations)
+	}
+	if want := []string{"TUNIC", "Synthetic World", "TUNIC"}; !reflect.DeepEqual(r.games, want) {
+		t.Errorf("games are %v, want %v", r.games, want)
+	}
+	if !r.realGames[0] || r.realGames[1] || !r.realGames[2] {
+		t.Errorf("real games are %v, want players 0 and 2", r.realGames)
+	}
+}
+
+func peerItems(r *room, game string) map[string]int64 {
+	if dp, ok := r.peerPackages[game]; ok {
+		return dp.ItemNameToID
+	}
+	return nil
+}
+
+func TestPeerGameRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(r *room)
+		peer  peerGame
+		items map[string]bool
+	}{
+		{
+			name:  "conflicting IDs",
+			setup: func(r *room) { r.addPeerGame(1, tunicPeer(map[string]int64{"Sword": 11}, nil), nil, nil) },
+			peer:  tunicPeer(map[string]int64{"Sword": 99}, nil),
+		},
+		{
+			name:  "needed item missing",
+			peer:  tunicPeer(map[string]int64{"Sword": 11}, nil),
+			items: map[string]bool{"Shield": true},
+		},
+		{
+			name: "different full datapackage",
+			setup: func(r *room) {
+				r.data.Datapackage["TUNIC"] = apgamedata{Checksum: "other-checksum"}
+			},
+			peer: tunicPeer(nil, nil),
+		},
+	}
+	for _, test := range tests {
+		r := newPeerTestRoom(2)
+		if test.setup != nil {
+			test.setup(r)
+		}
+		before := maps.Clone(peerItems(r, "TUNIC"))
+		if err := r.addPeerGame(0, test.peer, test.items, nil); err == nil {
+			t.Errorf("%s: peer game was accepted", test.name)
+			continue
+		}
+		if r.games[0] != "Synthetic World" || r.realGames[0] {
+			t.Errorf("%s: player 0's world was replaced", test.name)
+		}
+		if after := peerItems(r, "TUNIC"); !maps.Equal(after, before) {
+			t.Errorf("%s: merged items changed from %v to %v", test.name, before, after)
+		}
+	}
+}
+
+// A peer playing a game whose full datapackage we have is shown with it, not
+// with what they published.
+func TestPeerGameWithFullDatapackage(t *testing.T) {
+	r := newPeerTestRoom(1)
+	r.data.Datapackage["TUNIC"] = apgamedata{
+		Checksum:     "tunic-checksum",
+		ItemNameToID: map[string]int64{"Sword": 11, "Shield": 12},
+	}
+	if err := r.addPeerGame(0, tunicPeer(map[string]int64{"Sword": 11}, nil), map[string]bool{"Shield": true}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.games[0] != "TUNIC" || !r.realGames[0] {
+		t.Errorf("player 0 is shown as %s", r.games[0])
+	}
+	if _, ok := r.peerPackages["TUNIC"]; ok {
+		t.Error("published datapackage was kept alongside the full one")
+	}
+}
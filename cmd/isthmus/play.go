@@ -2,660 +2,1088 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"maps"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dpinela/mmm/internal/approto"
 	"github.com/dpinela/mmm/internal/mwproto"
 )
 
-func playMW(opts options, data apdata) error {
-	server := approto.Serve(opts.apport)
+func playMW(opts options) error {
+	// In solo mode, the savefile may still be for a MW room, which is simply
+	// not joined.
+	r, err := openRoom(opts, !opts.solo)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	serveOpts := approto.ServeOptions{Port: opts.apport, MaxConnections: len(r.slots)}
+	if opts.capture != nil {
+		serveOpts.NewTap = opts.capture.APTap
+	}
+	server := approto.ServeWith(serveOpts)
 	defer server.Close()
-	for {
-		conn := server.Accept()
-		err := playMWWithConn(opts, data, conn)
-		if err == errConnectionLost {
-			continue
-		}
-		if err != nil {
-			return err
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			conn := server.Accept()
+			go func() {
+				err := r.serveConn(conn)
+				if err == nil || err == errConnectionLost {
+					return
+				}
+				select {
+				case errs <- err:
+				default:
+				}
+			}()
 		}
-	}
+	}()
+	return <-errs
 }
 
-func playMWWithConn(opts options, data apdata, apconn *approto.ClientConn) error {
-	defer apconn.Close()
-	state, err := openSavefile(opts.savefile)
+// A room holds what the sessions for all of the AP slots being served share:
+// the savefile, the MW players, and what we know of the games of the players
+// that aren't ours. Everything in it is guarded by mu.
+type room struct {
+	mu    sync.Mutex
+	opts  options
+	data  apdata
+	state *savefile
+
+	nicknames []string
+	// games, checksums and realGames are indexed by MW player ID.
+	games     []string
+	checksums []string
+	// realGames marks the players, other than ours, whose worlds are shown
+	// as their real games, as published by their Isthmus instances.
+	realGames map[int]bool
+	// dataPackages holds the synthetic datapackages for the worlds of
+	// players we don't know the real games of, while peerPackages holds
+	// what other Isthmus players published about games that we don't have
+	// the datapackages of.
+	dataPackages map[string]*approto.DataPackage
+	peerPackages map[string]*approto.DataPackage
+	dataStorage  map[string]any
+
+	slots         map[int]slotParams // by AP slot
+	slotsByPlayer map[int]int        // AP slots by MW player ID
+	sessions      map[int]*slotSession
+}
+
+// openRoom opens the savefile and loads the room from it, after checking
+// that it was made for the MW room in opts if mw is set. The .archipelago
+// file is only read for savefiles that don't store the seed's data yet,
+// which is then checked against the savefile and stored in it.
+func openRoom(opts options, mw bool) (*room, error) {
+	readAPData := sync.OnceValues(func() (apdata, error) {
+		data, err := readAPFile(opts.apfile)
+		if err != nil {
+			return data, err
+		}
+		return data, checkAPData(data)
+	})
+	state, err := openSavefile(opts.savefile, func() (int, error) {
+		data, err := readAPData()
+		if err != nil {
+			return 0, err
+		}
+		return playerSlots(data)[0], nil
+	})
 	if err != nil {
-		return fmt.Errorf("open persistent state DB: %w", err)
+		return nil, fmt.Errorf("open persistent state DB: %w", err)
 	}
-	defer state.close()
-
-	if len(data.SlotInfo) != 1 {
-		return fmt.Errorf(".archipelago contains %d slots, expected only one", len(data.SlotInfo))
+	data, err := state.getAPData()
+	fromAPFile := err == errZeroRows
+	if fromAPFile {
+		data, err = readAPData()
+	} else if err == nil && opts.apfileGiven {
+		err = checkIgnoredAPFile(opts.apfile, data)
 	}
-	conn, err := mwproto.Dial(opts.mwserver)
 	if err != nil {
-		return fmt.Errorf("connect to MW: %w", err)
+		state.close()
+		return nil, err
 	}
-	defer conn.Close()
-
-	conn.Send(mwproto.ConnectMessage{})
+	r := &room{
+		opts:          opts,
+		data:          data,
+		state:         state,
+		realGames:     map[int]bool{},
+		dataPackages:  map[string]*approto.DataPackage{},
+		peerPackages:  map[string]*approto.DataPackage{},
+		dataStorage:   map[string]any{},
+		slotsByPlayer: map[int]int{},
+		sessions:      map[int]*slotSession{},
+	}
+	if err := r.bind(fromAPFile, mw); err != nil {
+		state.close()
+		return nil, err
+	}
+	if fromAPFile {
+		log.Println("storing the seed's data in the savefile; the .archipelago file is no longer needed")
+		if err := state.setAPData(data); err != nil {
+			state.close()
+			return nil, err
+		}
+	}
+	if err := r.load(); err != nil {
+		state.close()
+		return nil, err
+	}
+	return r, nil
+}
 
-	slotID := singularKey(data.SlotInfo)
-	slot := data.SlotInfo[slotID]
+// checkIgnoredAPFile checks that an .archipelago file given for a savefile
+// that already stores the seed's data is for the same seed, since the stored
+// data is what gets used.
+func checkIgnoredAPFile(apfile string, stored apdata) error {
+	data, err := readAPFile(apfile)
+	if err != nil {
+		return err
+	}
+	if data.SeedName != stored.SeedName {
+		return fmt.Errorf("savefile stores the data for seed %s, but %s is for seed %s", stored.SeedName, apfile, data.SeedName)
+	}
+	log.Printf("ignoring %s: the savefile already stores the data for seed %s", apfile, stored.SeedName)
+	return nil
+}
 
-	nicknames, err := state.getNicknames()
+func (r *room) load() error {
+	var err error
+	r.nicknames, err = r.state.getNicknames()
 	if err != nil {
 		return err
 	}
-	playerID, randoID, err := state.getConnectionParams()
+	r.slots, err = r.state.getSlots()
 	if err != nil {
 		return err
 	}
-
-	games := make([]string, len(nicknames))
-	checksums := make([]string, len(nicknames))
-	dataPackages := map[string]*approto.DataPackage{}
-	for i, name := range nicknames {
-		if i == playerID {
-			games[i] = slot.Game
-		} else {
-			games[i] = fmt.Sprintf("%s's World", name)
+	for slot, params := range r.slots {
+		if _, ok := r.data.SlotInfo[slot]; !ok {
+			return fmt.Errorf("savefile contains slot %d, which is not in .archipelago", slot)
 		}
-		dataPackages[games[i]] = &approto.DataPackage{
-			LocationNameToID: map[string]int64{},
-			ItemNameToID:     map[string]int64{},
+		if !(params.playerID >= 0 && params.playerID < len(r.nicknames)) {
+			return fmt.Errorf("slot %d has MW player ID out of range: %d", slot, params.playerID)
 		}
+		r.slotsByPlayer[params.playerID] = slot
 	}
 
-	nextSynthItemID := int64(1)
-	nextSynthLocationID := int64(1)
-	for p, err := range state.getOwnWorldPlacements() {
-		if err != nil {
-			return err
+	synthetic, err := r.state.getSyntheticGames()
+	if err != nil {
+		return err
+	}
+	r.games = make([]string, len(r.nicknames))
+	r.checksums = make([]string, len(r.nicknames))
+	for i, name := range r.nicknames {
+		if slot, ok := r.slotsByPlayer[i]; ok {
+			r.games[i] = r.data.SlotInfo[slot].Game
+		} else if g, ok := synthetic[i]; ok {
+			r.games[i] = g.name
+		} else {
+			return fmt.Errorf("savefile has no AP game for %s's world", name)
 		}
-		if !(p.ownerID >= 0 && p.ownerID < len(games)) {
-			log.Println("MW item has world out of range:", p.placedItem.name)
-			continue
+	}
+	if err := r.loadPeerGames(); err != nil {
+		return err
+	}
+	for i, g := range synthetic {
+		if !r.realGames[i] {
+			r.dataPackages[g.name] = g.datapackage
 		}
-		game := games[p.ownerID]
-		dp := dataPackages[game]
-		prettyItem := strings.ReplaceAll(mwproto.StripDiscriminator(p.placedItem.name), "_", " ")
-		if _, ok := dp.ItemNameToID[prettyItem]; !ok {
-			dp.ItemNameToID[prettyItem] = nextSynthItemID
-			nextSynthItemID++
+	}
+	for _, dp := range r.peerPackages {
+		dp.SetChecksum()
+	}
+	for i, g := range r.games {
+		if dp, ok := r.dataPackages[g]; ok {
+			r.checksums[i] = dp.Checksum
+		} else if dp, ok := r.peerPackages[g]; ok {
+			r.checksums[i] = dp.Checksum
+		} else {
+			r.checksums[i] = r.data.Datapackage[g].Checksum
 		}
 	}
 
-	for loc, err := range state.getOwnItemLocations() {
-		if err != nil {
-			return err
-		}
-		pid := loc.playerID
-		if !(pid >= 0 && pid < len(games)) {
-			log.Println("MW location has world out of range:", pid)
-			continue
-		}
-		game := games[pid]
-		dp := dataPackages[game]
-		if _, ok := dp.LocationNameToID[loc.name]; !ok {
-			dp.LocationNameToID[loc.name] = nextSynthLocationID
-			nextSynthLocationID++
+	for i := range r.nicknames {
+		r.dataStorage[fmt.Sprintf(approto.ReadOnlyKeyPrefix+"hints_0_%d", i+1)] = []any{}
+		r.dataStorage[fmt.Sprintf(approto.ReadOnlyKeyPrefix+"client_status_0_%d", i+1)] = approto.ClientStatusUnknown
+		itemGroupsKey := approto.ReadOnlyKeyPrefix + "item_name_groups_" + r.games[i]
+		locationGroupsKey := approto.ReadOnlyKeyPrefix + "location_name_groups_" + r.games[i]
+		slotDataKey := fmt.Sprintf(approto.ReadOnlyKeyPrefix+"slot_data_%d", i+1)
+		if dpkg, ok := r.data.Datapackage[r.games[i]]; ok {
+			r.dataStorage[itemGroupsKey] = dpkg.Original["item_name_groups"]
+			r.dataStorage[locationGroupsKey] = dpkg.Original["location_name_groups"]
+		} else {
+			r.dataStorage[itemGroupsKey] = map[string][]string{}
+			r.dataStorage[locationGroupsKey] = map[string][]string{}
 		}
-	}
-	for i, g := range games {
-		if i == playerID {
-			checksums[i] = data.Datapackage[slot.Game].Checksum
+		if slot, ok := r.slotsByPlayer[i]; ok {
+			r.dataStorage[slotDataKey] = r.data.SlotData[slot]
 		} else {
-			dp := dataPackages[g]
-			dp.SetChecksum()
-			checksums[i] = dp.Checksum
+			r.dataStorage[slotDataKey] = map[string]any{}
 		}
 	}
+	r.dataStorage[approto.ReadOnlyKeyPrefix+"race_mode"] = 0
+	return nil
+}
+
+func (r *room) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state.close()
+}
 
-	apconn.Send(approto.RoomInfo{
+func (r *room) roomInfo() approto.RoomInfo {
+	return approto.RoomInfo{
 		Cmd:     "RoomInfo",
 		Version: apServerVersion,
 		// This would panic if data.Version is not of the
 		// correct length, but we check for this right after
 		// loading the .archipelago file.
-		GeneratorVersion: approto.MakeVersion(*(*[approto.VersionNumberSize]int)(data.Version)),
-		Tags:             data.Tags,
+		GeneratorVersion: approto.MakeVersion(*(*[approto.VersionNumberSize]int)(r.data.Version)),
+		Tags:             r.data.Tags,
 		Password:         false,
 		Permissions: approto.RoomPermissions{
-			Release:   approto.PermissionForMode(data.ServerOptions.ReleaseMode),
-			Collect:   approto.PermissionForMode(data.ServerOptions.CollectMode),
-			Remaining: approto.PermissionForMode(data.ServerOptions.RemainingMode),
+			Release:   approto.PermissionForMode(r.data.ServerOptions.ReleaseMode),
+			Collect:   approto.PermissionForMode(r.data.ServerOptions.CollectMode),
+			Remaining: approto.PermissionForMode(r.data.ServerOptions.RemainingMode),
 		},
-		HintCost:             data.ServerOptions.HintCost,
-		LocationCheckPoints:  data.ServerOptions.LocationCheckPoints,
-		Games:                games,
-		DataPackageChecksums: checksums,
-		SeedName:             data.SeedName,
+		HintCost:             r.data.ServerOptions.HintCost,
+		LocationCheckPoints:  r.data.ServerOptions.LocationCheckPoints,
+		Games:                r.games,
+		DataPackageChecksums: r.checksums,
+		SeedName:             r.data.SeedName,
 		Time:                 float64(time.Now().UnixMilli()) / float64(time.Millisecond),
-	})
+	}
+}
 
-	var (
-		itemHandling approto.ItemHandlingMode
-		dataStorage  = map[string]any{}
-		watchedKeys  = map[string]struct{}{}
-	)
-
-	for i := range nicknames {
-		dataStorage[fmt.Sprintf(approto.ReadOnlyKeyPrefix+"hints_0_%d", i+1)] = []any{}
-		dataStorage[fmt.Sprintf(approto.ReadOnlyKeyPrefix+"client_status_0_%d", i+1)] = approto.ClientStatusUnknown
-		itemGroupsKey := approto.ReadOnlyKeyPrefix + "item_name_groups_" + games[i]
-		locationGroupsKey := approto.ReadOnlyKeyPrefix + "location_name_groups_" + games[i]
-		if i == playerID {
-			dpkg := data.Datapackage[slot.Game]
-			dataStorage[itemGroupsKey] = dpkg.Original["item_name_groups"]
-			dataStorage[locationGroupsKey] = dpkg.Original["location_name_groups"]
-		} else {
-			dataStorage[itemGroupsKey] = map[string][]string{}
-			dataStorage[locationGroupsKey] = map[string][]string{}
-		}
+func (r *room) dataPackage(games []string) approto.DataPackageMessage {
+	resp := approto.MakeDataPackageMessage()
+	if games == nil {
+		games = r.games
 	}
-	dataStorage[approto.ReadOnlyKeyPrefix+"race_mode"] = 0
-	for i := range nicknames {
-		key := fmt.Sprintf(approto.ReadOnlyKeyPrefix+"slot_data_%d", i+1)
-		if i == playerID {
-			dataStorage[key] = data.SlotData[slotID]
-		} else {
-			dataStorage[key] = map[string]any{}
+	for _, g := range games {
+		if dp, ok := r.dataPackages[g]; ok {
+			resp.Data.Games[g] = dp
+		} else if dp, ok := r.peerPackages[g]; ok {
+			resp.Data.Games[g] = dp
+		} else if dp, ok := r.data.Datapackage[g]; ok {
+			resp.Data.Games[g] = dp.Original
 		}
 	}
+	return resp
+}
 
-mainMessageLoop:
+// serveConn talks to an AP client until it disconnects. Until the client
+// connects to one of our slots, it can only fetch datapackages.
+func (r *room) serveConn(apconn *approto.ClientConn) error {
+	defer apconn.Close()
+	apconn.Send(r.roomInfo())
 	for {
+		switch msg := (<-apconn.Inbox()).(type) {
+		case nil:
+			return errConnectionLost
+		case approto.GetDataPackage:
+			apconn.Send(r.dataPackage(msg.Games))
+		case approto.Connect:
+			s := r.claimSlot(apconn, msg.Name)
+			if s == nil {
+				apconn.Send(approto.ConnectionRefused{
+					Cmd:    "ConnectionRefused",
+					Errors: []string{"InvalidSlot"},
+				})
+				continue
+			}
+			return s.run(msg)
+		default:
+			log.Printf("ignoring %T from AP client that hasn't connected to a slot", msg)
+		}
+	}
+}
+
+// claimSlot starts a session for the slot with the given name, unless there
+// is no such slot or it already has one.
+func (r *room) claimSlot(apconn *approto.ClientConn, name string) *slotSession {
+	ids, ok := r.data.ConnectNames[name]
+	if !ok || len(ids) != 2 {
+		log.Printf("AP client tried to connect to unknown slot %q", name)
+		return nil
+	}
+	params, ok := r.slots[ids[1]]
+	if !ok {
+		log.Printf("AP client tried to connect to slot %q, which isn't in the savefile", name)
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, active := r.sessions[ids[1]]; active {
+		log.Printf("AP client tried to connect to slot %q, which already has a client", name)
+		return nil
+	}
+	s := &slotSession{
+		room:        r,
+		slot:        ids[1],
+		name:        name,
+		game:        r.data.SlotInfo[ids[1]].Game,
+		slotParams:  params,
+		apconn:      apconn,
+		watchedKeys: map[string]struct{}{},
+		notify:      make(chan struct{}, 1),
+	}
+	r.sessions[s.slot] = s
+	return s
+}
+
+// apSlotOf returns the slot that an AP client would see for the given
+// AP slot.
+func (r *room) apSlotOf(slot int) int {
+	return r.slots[slot].playerID + 1
+}
+
+// apItem returns which slot an item that a slot's MW player received is for,
+// along with its ID and flags in that slot's game.
+func (r *room) apItem(slot int, name string) (toSlot int, id int64, flags int, err error) {
+	item, err := r.state.getContributedItem(slot, name)
+	if err == errZeroRows {
+		// Savefiles from before contributed items were recorded only have
+		// the item's name to go on.
+		_, err = r.state.getLocationOfOwnItem(slot, name)
+		if err == errZeroRows {
+			err = fmt.Errorf("%w: %q is not one of slot %d's items", errUnknownItem, name, slot)
+		}
+		if err != nil {
+			return
+		}
+		game := r.data.SlotInfo[slot].Game
+		var ok bool
+		id, ok = r.data.Datapackage[game].ItemNameToID[mwproto.StripDiscriminator(name)]
+		if !ok {
+			err = fmt.Errorf("%w: %q is not in the %s datapackage", errUnknownItem, mwproto.StripDiscriminator(name), game)
+			return
+		}
+		return slot, id, 0, nil
+	}
+	if err != nil {
+		return
+	}
+	if _, ok := r.slots[item.ownerSlot]; !ok {
+		log.Printf("item %s belongs to slot %d, which isn't being served; giving it to slot %d", name, item.ownerSlot, slot)
+		return slot, item.id, item.flags, nil
+	}
+	return item.ownerSlot, item.id, item.flags, nil
+}
+
+// errUnknownItem is returned for items that don't stand for any AP item we
+// know of.
+var errUnknownItem = errors.New("unknown item")
+
+// receivedItem turns an item that a slot's MW player received from fromID's
+// world into the AP item that it stands for. fromID is -1 if the item's
+// source isn't known.
+func (r *room) receivedItem(slot int, content string, fromID int) (toSlot int, item approto.NetworkItem, err error) {
+	toSlot, item.Item, item.Flags, err = r.apItem(slot, content)
+	if err != nil {
+		return
+	}
+	item.Player, item.Location, err = r.itemSource(slot, content, fromID)
+	return
+}
+
+// itemSource returns the AP player and location that an item received by a
+// slot's MW player from fromID's world came from.
+func (r *room) itemSource(slot int, content string, fromID int) (player int, location int64, err error) {
+	if fromID == -1 {
+		return approto.ServerSlot, approto.ServerLocation, nil
+	}
+	player = fromID + 1
+	loc, err := r.state.getLocationOfOwnItem(slot, content)
+	if err == errZeroRows {
+		err = nil
+		return
+	}
+	if err == nil {
+		location = r.locationID(fromID, loc)
+	}
+	return
+}
+
+// locationID returns the AP ID of a location in a MW player's world.
+func (r *room) locationID(playerID int, name string) int64 {
+	if _, ok := r.slotsByPlayer[playerID]; ok {
+		id, _ := mwproto.ParseDiscriminator(name)
+		return id
+	}
+	if !(playerID >= 0 && playerID < len(r.games)) {
+		return 0
+	}
+	if r.realGames[playerID] {
+		_, locations := r.gameIDs(r.games[playerID])
+		return locations[mwproto.StripDiscriminator(name)]
+	}
+	return r.dataPackages[r.games[playerID]].LocationNameToID[name]
+}
+
+// foreignItemID returns the AP ID of an item belonging to another MW player.
+func (r *room) foreignItemID(playerID int, name string) int64 {
+	if !(playerID >= 0 && playerID < len(r.games)) {
+		return 0
+	}
+	if r.realGames[playerID] {
+		items, _ := r.gameIDs(r.games[playerID])
+		return items[mwproto.StripDiscriminator(name)]
+	}
+	return r.dataPackages[r.games[playerID]].ItemNameToID[prettifyName(name)]
+}
+
+// gameIDs returns the item and location IDs of a real game.
+func (r *room) gameIDs(game string) (items, locations map[string]int64) {
+	if dp, ok := r.peerPackages[game]; ok {
+		return dp.ItemNameToID, dp.LocationNameToID
+	}
+	dp := r.data.Datapackage[game]
+	return dp.ItemNameToID, dp.LocationNameToID
+}
+
+// deliver adds items to those sent to a slot, and has its session, if any,
+// pass them on to its client.
+func (r *room) deliver(slot int, items ...approto.NetworkItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if _, err := r.state.addSentItems(slot, items...); err != nil {
+		return err
+	}
+	if s, ok := r.sessions[slot]; ok {
+		s.poke()
+	}
+	return nil
+}
+
+// A slotSession serves the AP client connected to one of our slots, through
+// its own connection to the MW server.
+type slotSession struct {
+	room *room
+	slot int
+	name string
+	game string
+	slotParams
+
+	apconn *approto.ClientConn
+	// mwconn is nil in solo mode.
+	mwconn *mwproto.Client
+
+	itemHandling approto.ItemHandlingMode
+	watchedKeys  map[string]struct{}
+	// sentItems is how many of the slot's items the client has been sent.
+	sentItems      int
+	pendingReplies []approto.SetReplyMessage
+	notify         chan struct{}
+}
+
+// sendMW sends msg to the MW server, if connected to it. In solo mode, items
+// found for other players are still recorded as unconfirmed, and are sent
+// the next time the slot joins the MW room.
+func (s *slotSession) sendMW(msg mwproto.Message) {
+	if s.mwconn != nil {
+		s.mwconn.Send(msg)
+	}
+}
+
+// receiveItem records an item that the slot's MW player received from
+// fromID's world and delivers it, unless it was received before or has to be
+// quarantined. It returns the slot the item was delivered to, or -1 if it
+// wasn't.
+func (s *slotSession) receiveItem(label, content string, fromID int) (toSlot int, err error) {
+	state := s.room.state
+	duplicate, err := state.hasReceivedItem(s.slot, label, content)
+	if err != nil {
+		return -1, err
+	}
+	if duplicate {
+		log.Printf("ignoring duplicate item %q for %s", content, s.name)
+		return -1, nil
+	}
+	toSlot, ni, err := s.room.receivedItem(s.slot, content, fromID)
+	switch {
+	case errors.Is(err, errUnknownItem):
+		toSlot = -1
+		if err := s.quarantine(label, content, fromID, err); err != nil {
+			return -1, err
+		}
+	case err != nil:
+		return -1, err
+	default:
+		if err := s.room.deliver(toSlot, ni); err != nil {
+			return -1, err
+		}
+	}
+	return toSlot, state.addReceivedItem(s.slot, label, content)
+}
+
+// quarantine sets aside an item that the slot's MW player received, but
+// that couldn't be matched to an AP item, instead of delivering it.
+func (s *slotSession) quarantine(label, content string, fromID int, reason error) error {
+	log.Printf("quarantining %q for %s: %v", content, s.name, reason)
+	return s.room.state.quarantineItem(quarantinedItem{
+		slot:         s.slot,
+		label:        label,
+		content:      content,
+		fromPlayerID: fromID,
+		reason:       reason.Error(),
+	})
+}
+
+func (s *slotSession) poke() {
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *slotSession) run(connect approto.Connect) error {
+	r := s.room
+	defer func() {
+		r.mu.Lock()
+		delete(r.sessions, s.slot)
+		r.mu.Unlock()
+	}()
+
+	// In solo mode, there is no MW connection, and mwInbox stays nil, so
+	// that the main loop only ever hears from the AP client.
+	var mwInbox <-chan mwproto.Message
+	if !r.opts.solo {
+		conn, err := dialMW(r.opts)
+		if err != nil {
+			return fmt.Errorf("connect to MW: %w", err)
+		}
+		defer conn.Close()
+		session := mwproto.NewSession(conn)
+		session.Timeout = mwTimeout
+		session.OnEvent = logSessionEvent
+		err = s.joinMW(session)
+		if errors.Is(err, mwproto.ErrDisconnected) {
+			return errConnectionLost
+		}
+		if err != nil {
+			return err
+		}
+		done := make(chan struct{})
+		defer close(done)
+		mwInbox = session.Messages(done)
+	}
+
+	r.mu.Lock()
+	err := s.handleConnect(connect)
+	r.mu.Unlock()
+	for err == nil {
 		select {
-		case msg, ok := <-conn.Inbox():
+		case msg, ok := <-mwInbox:
 			if !ok {
 				return errConnectionLost
 			}
-			switch msg := msg.(type) {
-			case mwproto.JoinConfirmMessage:
-				unconfirmedItems, err := state.getUnconfirmedItems()
-				if err != nil {
-					return err
-				}
-				log.Println("resending", len(unconfirmedItems), "unconfirmed items")
-				for _, it := range unconfirmedItems {
-					conn.Send(it)
-				}
-			case mwproto.DataReceiveMessage:
-				if msg.Label != mwproto.LabelMultiworldItem {
-					log.Println("unknown label for received item:", msg.Label)
-					continue
-				}
-				if !(msg.FromID >= 0 && int(msg.FromID) < len(games)) {
-					log.Println("invalid FromID:", msg.FromID)
-					continue
-				}
-				duplicate, err := state.hasReceivedItem(msg.Label, msg.Content)
-				if err != nil {
-					return err
-				}
-				if duplicate {
-					log.Printf("ignoring duplicate item %q from %q", msg.Content, msg.From)
+			r.mu.Lock()
+			err = s.handleMW(msg)
+			r.mu.Unlock()
+		case msg := <-s.apconn.Inbox():
+			if msg == nil {
+				return errConnectionLost
+			}
+			r.mu.Lock()
+			err = s.handleAP(msg)
+			r.mu.Unlock()
+		case <-s.notify:
+			r.mu.Lock()
+			err = s.flush()
+			r.mu.Unlock()
+		}
+	}
+	return err
+}
+
+// joinMW joins the slot's MW player to the game, and resends the items that
+// the server hadn't confirmed receiving before.
+func (s *slotSession) joinMW(session *mwproto.Session) error {
+	if _, err := session.Connect(); err != nil {
+		return err
+	}
+	err := session.Join(mwproto.JoinMessage{
+		DisplayName: s.name,
+		PlayerID:    int32(s.playerID),
+		RandoID:     int32(s.randoID),
+	})
+	if err != nil {
+		return err
+	}
+	s.mwconn = session.Client
+	s.room.mu.Lock()
+	defer s.room.mu.Unlock()
+	unconfirmedItems, err := s.room.state.getUnconfirmedItems(s.slot)
+	if err != nil {
+		return err
+	}
+	log.Println("resending", len(unconfirmedItems), "unconfirmed items for", s.name)
+	for _, it := range unconfirmedItems {
+		s.mwconn.Send(it)
+	}
+	return nil
+}
+
+func (s *slotSession) handleConnect(msg approto.Connect) error {
+	r := s.room
+	players := make([]approto.NetworkPlayer, len(r.nicknames))
+	slots := make(map[int]approto.NetworkSlot, len(r.nicknames))
+	for i, nick := range r.nicknames {
+		slot := i + 1
+		players[i] = approto.NetworkPlayer{
+			Team:  0,
+			Slot:  slot,
+			Alias: nick,
+			Name:  nick,
+		}
+		slots[slot] = approto.NetworkSlot{
+			Class:        "NetworkSlot",
+			Name:         nick,
+			Game:         r.games[i],
+			Type:         approto.SlotTypePlayer,
+			GroupMembers: []int{},
+		}
+	}
+	missingLocationSet := map[int64]struct{}{}
+	for _, locID := range r.data.Datapackage[s.game].LocationNameToID {
+		missingLocationSet[locID] = struct{}{}
+	}
+	checkedLocations, err := r.state.clearedLocations(s.slot)
+	if err != nil {
+		return err
+	}
+	for _, locID := range checkedLocations {
+		delete(missingLocationSet, locID)
+	}
+	if msg.ItemsHandling == nil {
+		s.itemHandling = approto.ReceiveOthersItems
+	} else {
+		s.itemHandling = *msg.ItemsHandling
+	}
+	resp := approto.Connected{
+		Cmd:              "Connected",
+		Team:             0,
+		Slot:             s.playerID + 1,
+		Players:          players,
+		SlotInfo:         slots,
+		CheckedLocations: checkedLocations,
+		MissingLocations: slices.Sorted(maps.Keys(missingLocationSet)),
+		HintPoints:       0,
+	}
+	if msg.SlotData {
+		resp.SlotData = r.data.SlotData[s.slot]
+	}
+	s.apconn.Send(resp)
+	log.Printf("%s connected to game", s.name)
+	return s.sendAllItems()
+}
+
+// sendAllItems sends the client every item sent to its slot so far.
+func (s *slotSession) sendAllItems() error {
+	items, err := s.room.state.getSentItems(s.slot, 0)
+	if err != nil {
+		return err
+	}
+	log.Printf("sending %d items to %s", len(items), s.name)
+	// ignore item handling flags for now (can't send only *some* items)
+	s.apconn.Send(approto.ReceivedItems{
+		Cmd:   "ReceivedItems",
+		Index: 0,
+		Items: items,
+	})
+	s.sentItems = len(items)
+	return nil
+}
+
+// flush sends the client the items it hasn't been sent yet, and any data
+// storage changes it's watching for.
+func (s *slotSession) flush() error {
+	for _, reply := range s.pendingReplies {
+		s.apconn.Send(reply)
+	}
+	s.pendingReplies = nil
+	if s.itemHandling == 0 {
+		return nil
+	}
+	items, err := s.room.state.getSentItems(s.slot, s.sentItems)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	s.apconn.Send(approto.ReceivedItems{
+		Cmd:   "ReceivedItems",
+		Index: s.sentItems,
+		Items: items,
+	})
+	s.sentItems += len(items)
+	return nil
+}
+
+func (s *slotSession) handleMW(msg mwproto.Message) error {
+	r := s.room
+	state := r.state
+	switch msg := msg.(type) {
+	case mwproto.DataReceiveMessage:
+		if msg.Label != mwproto.LabelMultiworldItem {
+			log.Println("unknown label for received item:", msg.Label)
+			return nil
+		}
+		if !(msg.FromID >= 0 && int(msg.FromID) < len(r.games)) {
+			log.Println("invalid FromID:", msg.FromID)
+			return nil
+		}
+		var toSlot int
+		err := state.transaction(func() (err error) {
+			toSlot, err = s.receiveItem(msg.Label, msg.Content, int(msg.FromID))
+			return
+		})
+		if err != nil {
+			return err
+		}
+		if toSlot != -1 {
+			log.Printf("%s received %s from player %d (%s); sent to slot %d", s.name, msg.Content, msg.FromID, msg.From, toSlot)
+		}
+		// Items are only confirmed once they've been stored, and duplicates
+		// are confirmed too, in case we stopped before confirming them the
+		// first time around.
+		s.sendMW(mwproto.DataReceiveConfirmMessage{
+			Label: msg.Label,
+			Data:  msg.Content,
+			From:  msg.From,
+		})
+		s.sendMW(mwproto.SaveMessage{})
+	case mwproto.DatasReceiveMessage:
+		fromID := slices.Index(r.nicknames, msg.From)
+		if fromID == -1 {
+			log.Println("receiving released items from unknown player", msg.From)
+		}
+		received := 0
+		err := state.transaction(func() error {
+			for _, item := range msg.Items {
+				if item.Label != mwproto.LabelMultiworldItem {
+					log.Println("unknown label for received item:", item.Label)
 					continue
 				}
-				ownPkg := data.Datapackage[slot.Game]
-				itemID := ownPkg.ItemNameToID[mwproto.StripDiscriminator(msg.Content)]
-				var locID int64
-				loc, err := state.getLocationOfOwnItem(msg.Content)
-				if err == nil {
-					fromPkg := dataPackages[games[msg.FromID]]
-					locID = fromPkg.LocationNameToID[loc]
-				} else if err != errZeroRows {
-					return err
-				}
-				ni := approto.NetworkItem{
-					Item:     itemID,
-					Location: locID,
-					Player:   int(msg.FromID) + 1,
-					Flags:    0,
-				}
-				index, err := state.addSentItems(ni)
-				if err != nil {
-					return err
-				}
-				log.Printf("received %s from player %d (%s); AP index %d", msg.Content, msg.FromID, msg.From, index)
-				if itemHandling&approto.ReceiveOthersItems != 0 {
-					apconn.Send(approto.ReceivedItems{
-						Cmd:   "ReceivedItems",
-						Index: index,
-						Items: []approto.NetworkItem{ni},
-					})
-				}
-				conn.Send(mwproto.DataReceiveConfirmMessage{
-					Label: msg.Label,
-					Data:  msg.Content,
-					From:  msg.From,
-				})
-				err = state.addReceivedItem(msg.Label, msg.Content)
+				toSlot, err := s.receiveItem(item.Label, item.Content, fromID)
 				if err != nil {
 					return err
 				}
-				conn.Send(mwproto.SaveMessage{})
-			case mwproto.DatasReceiveMessage:
-				fromID := slices.Index(nicknames, msg.From)
-				if fromID == -1 {
-					log.Println("receiving released items from unknown player", msg.From)
+				if toSlot != -1 {
+					received++
 				}
-				items := make([]approto.NetworkItem, 0, len(msg.Items))
-				for _, item := range msg.Items {
-					if item.Label != mwproto.LabelMultiworldItem {
-						log.Println("unknown label for received item:", item.Label)
-						continue
-					}
-					duplicate, err := state.hasReceivedItem(item.Label, item.Content)
-					if err != nil {
-						return err
-					}
-					if duplicate {
-						log.Printf("ignoring duplicate item %q from %q", item.Content, msg.From)
-						continue
-					}
-					ownPkg := data.Datapackage[slot.Game]
-					itemID := ownPkg.ItemNameToID[mwproto.StripDiscriminator(item.Content)]
-					sentItem := approto.NetworkItem{
-						Item:  itemID,
-						Flags: 0,
-					}
-					if fromID == -1 {
-						sentItem.Location = -2
-						sentItem.Player = 0
-					} else {
-						sentItem.Player = fromID + 1
-						loc, err := state.getLocationOfOwnItem(item.Content)
-						if err == nil {
-							fromPkg := dataPackages[games[fromID]]
-							sentItem.Location = fromPkg.LocationNameToID[loc]
-						} else if err != errZeroRows {
-							return err
-						}
-					}
-					items = append(items, sentItem)
-					err = state.addReceivedItem(item.Label, item.Content)
-					if err != nil {
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		log.Printf("%s received %d released items from %s", s.name, received, msg.From)
+		s.sendMW(mwproto.DatasReceiveConfirmMessage{
+			Count: int32(len(msg.Items)),
+			From:  msg.From,
+		})
+		s.sendMW(mwproto.SaveMessage{})
+	case mwproto.DataSendConfirmMessage:
+		confirmed, err := state.confirmItem(s.slot, msg)
+		if err != nil {
+			return err
+		}
+		if !confirmed {
+			log.Printf("received confirmation for item that wasn't sent: label=%q content=%q to=%d", msg.Label, msg.Content, msg.To)
+		}
+	case mwproto.RequestCharmNotchCostsMessage:
+		// We have nothing to announce.
+		s.sendMW(mwproto.AnnounceCharmNotchCostsMessage{
+			PlayerID:   int32(s.playerID),
+			NotchCosts: map[int]int{},
+		})
+	case mwproto.AnnounceCharmNotchCostsMessage:
+		log.Println("got charm notch costs for player", msg.PlayerID)
+		for charm := range slices.Sorted(maps.Keys(msg.NotchCosts)) {
+			log.Println("charm", charm, "costs", msg.NotchCosts[charm], "notches")
+		}
+		s.sendMW(mwproto.ConfirmCharmNotchCostsReceived{
+			PlayerID: msg.PlayerID,
+		})
+	case mwproto.RawMessage:
+		log.Printf("ignoring MW message of unknown type %d (%d bytes)", msg.Type, len(msg.Payload))
+	}
+	return nil
+}
+
+func (s *slotSession) handleAP(msg approto.ClientMessage) error {
+	r := s.room
+	state := r.state
+	switch msg := msg.(type) {
+	case approto.GetDataPackage:
+		s.apconn.Send(r.dataPackage(msg.Games))
+	case approto.Connect:
+		if ids := r.data.ConnectNames[msg.Name]; !(len(ids) == 2 && ids[1] == s.slot) {
+			log.Printf("client connected as %s tried to switch to %q", s.name, msg.Name)
+			s.apconn.Send(approto.ConnectionRefused{
+				Cmd:    "ConnectionRefused",
+				Errors: []string{"InvalidSlot"},
+			})
+			return nil
+		}
+		return s.handleConnect(msg)
+	case approto.SayMessage:
+		switch msg.Text {
+		case "!collect":
+			ps, err := state.getCollectablePlacements(s.slot, s.playerID)
+			if err != nil {
+				return err
+			}
+			// Collected items count as received, so that they aren't
+			// delivered again when their locations are checked.
+			return state.transaction(func() error {
+				for _, p := range ps {
+					if _, err := s.receiveItem(mwproto.LabelMultiworldItem, p.itemName, p.location.playerID); err != nil {
 						return err
 					}
 				}
-				startIndex, err := state.addSentItems(items...)
+				return nil
+			})
+		case "!release":
+			var messages []mwproto.DataSendMessage
+			var locations []int64
+			for p, err := range state.getOwnWorldPlacements() {
 				if err != nil {
 					return err
 				}
-				log.Printf("received %d released items from %s", len(items), msg.From)
-				if itemHandling&approto.ReceiveOthersItems != 0 {
-					apconn.Send(approto.ReceivedItems{
-						Cmd:   "ReceivedItems",
-						Index: startIndex,
-						Items: items,
-					})
+				if p.apSlot != s.slot || p.ownerID == s.playerID {
+					continue
 				}
-				conn.Send(mwproto.DatasReceiveConfirmMessage{
-					Count: int32(len(msg.Items)),
-					From:  msg.From,
-				})
-				conn.Send(mwproto.SaveMessage{})
-			case mwproto.DataSendConfirmMessage:
-				confirmed, err := state.confirmItem(msg)
+				cleared, err := state.isLocationCleared(s.slot, p.apLocationID)
 				if err != nil {
 					return err
 				}
-				if !confirmed {
-					log.Printf("received confirmation for item that wasn't sent: label=%q content=%q to=%d", msg.Label, msg.Content, msg.To)
+				if cleared {
+					continue
 				}
-			case mwproto.RequestCharmNotchCostsMessage:
-				// We have nothing to announce.
-				conn.Send(mwproto.AnnounceCharmNotchCostsMessage{
-					PlayerID:   int32(playerID),
-					NotchCosts: map[int]int{},
+
+				messages = append(messages, mwproto.DataSendMessage{
+					Label:   mwproto.LabelMultiworldItem,
+					Content: p.name,
+					To:      int32(p.ownerID),
+					TTL:     sentItemTTL,
 				})
-			case mwproto.AnnounceCharmNotchCostsMessage:
-				log.Println("got charm notch costs for player", msg.PlayerID)
-				for charm := range slices.Sorted(maps.Keys(msg.NotchCosts)) {
-					log.Println("charm", charm, "costs", msg.NotchCosts[charm], "notches")
+				locations = append(locations, p.apLocationID)
+			}
+			err := state.transaction(func() error {
+				if err := state.addUnconfirmedItems(s.slot, messages...); err != nil {
+					return err
 				}
-				conn.Send(mwproto.ConfirmCharmNotchCostsReceived{
-					PlayerID: msg.PlayerID,
-				})
+				return state.clearLocations(s.slot, locations...)
+			})
+			if err != nil {
+				return err
 			}
-		case msg := <-apconn.Inbox():
-			if msg == nil {
-				return errConnectionLost
+			for _, m := range messages {
+				s.sendMW(m)
 			}
-			switch msg := msg.(type) {
-			case approto.GetDataPackage:
-				resp := approto.MakeDataPackageMessage()
-				pickedGames := msg.Games
-				if pickedGames == nil {
-					pickedGames = games
-				}
-				for _, g := range pickedGames {
-					if g == slot.Game {
-						resp.Data.Games[g] = data.Datapackage[slot.Game].Original
-					} else {
-						resp.Data.Games[g] = dataPackages[g]
-					}
+		default:
+			log.Printf("%s says %q", s.name, msg.Text)
+		}
+	case approto.SyncMessage:
+		if s.itemHandling&approto.ReceiveOwnItems == 0 {
+			return nil
+		}
+		log.Println("syncing", s.name)
+		return s.sendAllItems()
+	case approto.SetMessage:
+		oldV, newV, err := updateDataStorage(state, msg)
+		if err != nil {
+			log.Println(err)
+			return nil
+		}
+		reply := approto.SetReplyMessage{
+			Cmd:           "SetReply",
+			Key:           msg.Key,
+			Value:         newV,
+			OriginalValue: oldV,
+			Slot:          s.playerID + 1,
+		}
+		if _, watching := s.watchedKeys[msg.Key]; msg.WantReply || watching {
+			s.apconn.Send(reply)
+		}
+		for _, other := range r.sessions {
+			if _, watching := other.watchedKeys[msg.Key]; watching && other != s {
+				other.pendingReplies = append(other.pendingReplies, reply)
+				other.poke()
+			}
+		}
+	case approto.SetNotifyMessage:
+		for _, k := range msg.Keys {
+			log.Println(s.name, "watching key", k)
+			s.watchedKeys[k] = struct{}{}
+		}
+	case approto.GetMessage:
+		values := make(map[string]any, len(msg.Keys))
+		for _, k := range msg.Keys {
+			if strings.HasPrefix(k, approto.ReadOnlyKeyPrefix) {
+				values[k] = r.dataStorage[k]
+				continue
+			}
+			val, found, err := state.getStoredData(k)
+			if err != nil {
+				return err
+			}
+			if found {
+				values[k] = json.RawMessage(val)
+			} else {
+				values[k] = nil
+			}
+		}
+		s.apconn.Send(approto.MakeRetrievedMessage(values, msg.Rest))
+	case approto.LocationScoutsMessage:
+		scoutedItems := make([]approto.NetworkItem, 0, len(msg.Locations))
+		for _, locID := range msg.Locations {
+			p, err := state.getPlacedItem(s.slot, locID)
+			switch {
+			case err == nil:
+				item := approto.NetworkItem{
+					Location: locID,
+					Player:   p.ownerID + 1,
 				}
-				apconn.Send(resp)
-			case approto.Connect:
-				conn.Send(mwproto.JoinMessage{
-					DisplayName: slot.Name,
-					PlayerID:    int32(playerID),
-					RandoID:     int32(randoID),
-				})
-				players := make([]approto.NetworkPlayer, len(nicknames))
-				slots := make(map[int]approto.NetworkSlot, len(nicknames))
-				for i, nick := range nicknames {
-					slot := i + 1
-					players[i] = approto.NetworkPlayer{
-						Team:  0,
-						Slot:  slot,
-						Alias: nick,
-						Name:  nick,
+				if ownerSlot, ok := r.slotsByPlayer[p.ownerID]; ok {
+					var toSlot int
+					toSlot, item.Item, item.Flags, err = r.apItem(ownerSlot, p.name)
+					if errors.Is(err, errUnknownItem) {
+						log.Printf("not scouting location %d: %v", locID, err)
+						continue
 					}
-					slots[slot] = approto.NetworkSlot{
-						Class:        "NetworkSlot",
-						Name:         nick,
-						Game:         games[i],
-						Type:         approto.SlotTypePlayer,
-						GroupMembers: []int{},
+					if err != nil {
+						return err
 					}
-				}
-				missingLocationSet := map[int64]struct{}{}
-				for _, locID := range data.Datapackage[slot.Game].LocationNameToID {
-					missingLocationSet[locID] = struct{}{}
-				}
-				checkedLocations, err := state.clearedLocations()
-				if err != nil {
-					return err
-				}
-				for _, locID := range checkedLocations {
-					delete(missingLocationSet, locID)
-				}
-				if msg.ItemsHandling == nil {
-					itemHandling = approto.ReceiveOthersItems
+					item.Player = r.apSlotOf(toSlot)
 				} else {
-					itemHandling = *msg.ItemsHandling
-				}
-				itemHandling = *msg.ItemsHandling
-				// handle start inv? (precollected_items, dict[slot id -> list[item id]] in the apdata) from location -2 and slot 0
-				resp := approto.Connected{
-					Cmd:              "Connected",
-					Team:             0,
-					Slot:             playerID + 1,
-					Players:          players,
-					SlotInfo:         slots,
-					CheckedLocations: checkedLocations,
-					MissingLocations: slices.Sorted(maps.Keys(missingLocationSet)),
-					HintPoints:       0,
+					item.Item = r.foreignItemID(p.ownerID, p.name)
 				}
-				if msg.SlotData {
-					resp.SlotData = data.SlotData[slotID]
+				scoutedItems = append(scoutedItems, item)
+			case err == errZeroRows:
+				toSlot, item, ok := s.apPlacedItem(locID)
+				if !ok {
+					continue
 				}
-				apconn.Send(resp)
-
-				items, err := state.getSentItems()
+				item.Player = r.apSlotOf(toSlot)
+				scoutedItems = append(scoutedItems, item)
+			default:
+				return err
+			}
+		}
+		s.apconn.Send(approto.LocationInfoMessage{
+			Cmd:       "LocationInfo",
+			Locations: scoutedItems,
+		})
+	case approto.LocationChecksMessage:
+		// Items for other players are only sent once the checks have been
+		// stored; if we stop before then, they're sent again on reconnecting,
+		// as unconfirmed items.
+		var sends []mwproto.DataSendMessage
+		err := state.transaction(func() error {
+			for _, locID := range msg.Locations {
+				checked, err := state.isLocationCleared(s.slot, locID)
 				if err != nil {
 					return err
 				}
+				if checked {
+					continue
+				}
 
-				log.Println("connected to game; sending", len(items), "items")
-
-				// ignore item handling flags for now (can't send only *some* items)
-				apconn.Send(approto.ReceivedItems{
-					Cmd:   "ReceivedItems",
-					Index: 0,
-					Items: items,
-				})
-			case approto.SayMessage:
-				switch msg.Text {
-				case "!collect":
-					ps, err := state.getCollectablePlacements(playerID)
-					if err != nil {
-						return err
-					}
-					items := make([]approto.NetworkItem, len(ps))
-					for i, p := range ps {
-						fromPkg := dataPackages[games[p.location.playerID]]
-						itemID := data.Datapackage[slot.Game].ItemNameToID[mwproto.StripDiscriminator(p.itemName)]
-						items[i] = approto.NetworkItem{
-							Item:     itemID,
-							Player:   p.location.playerID + 1,
-							Location: fromPkg.LocationNameToID[p.location.name],
-							Flags:    0,
-						}
-					}
-					index, err := state.addSentItems(items...)
-					if err != nil {
-						return err
-					}
-					apconn.Send(approto.ReceivedItems{
-						Cmd:   "ReceivedItems",
-						Index: index,
-						Items: items,
-					})
-				case "!release":
-					var messages []mwproto.DataSendMessage
-					var locations []int64
-					for p, err := range state.getOwnWorldPlacements() {
-						if err != nil {
+				p, err := state.getPlacedItem(s.slot, locID)
+				switch {
+				case err == nil && p.ownerID == s.playerID:
+					toSlot, id, flags, err := r.apItem(s.slot, p.name)
+					if errors.Is(err, errUnknownItem) {
+						if err := s.quarantine(mwproto.LabelMultiworldItem, p.name, s.playerID, err); err != nil {
 							return err
 						}
-						if p.ownerID == playerID {
-							continue
-						}
-						cleared, err := state.isLocationCleared(p.apLocationID)
-						if err != nil {
-							return err
-						}
-						if cleared {
-							continue
-						}
-
-						messages = append(messages, mwproto.DataSendMessage{
-							Label:   mwproto.LabelMultiworldItem,
-							Content: p.name,
-							To:      int32(p.ownerID),
-							TTL:     sentItemTTL,
-						})
-						locations = append(locations, p.apLocationID)
+						break
 					}
-					if err := state.addUnconfirmedItems(messages...); err != nil {
-						return err
-					}
-					if err := state.clearLocations(locations...); err != nil {
-						return err
-					}
-					for _, m := range messages {
-						conn.Send(m)
-					}
-				default:
-					log.Printf("client says %q", msg.Text)
-				}
-			case approto.SyncMessage:
-				if itemHandling&approto.ReceiveOwnItems == 0 {
-					continue mainMessageLoop
-				}
-				log.Println("syncing")
-				items, err := state.getSentItems()
-				if err != nil {
-					return err
-				}
-
-				// ignore item handling flags for now (can't send only *some* items)
-				apconn.Send(approto.ReceivedItems{
-					Cmd:   "ReceivedItems",
-					Index: 0,
-					Items: items,
-				})
-			case approto.SetMessage:
-				oldV, newV, err := updateDataStorage(state, msg)
-				if err != nil {
-					log.Println(err)
-					continue mainMessageLoop
-				}
-				_, watching := watchedKeys[msg.Key]
-				if msg.WantReply || watching {
-					apconn.Send(approto.SetReplyMessage{
-						Cmd:           "SetReply",
-						Key:           msg.Key,
-						Value:         newV,
-						OriginalValue: oldV,
-						Slot:          playerID,
-					})
-				}
-			case approto.SetNotifyMessage:
-				for _, k := range msg.Keys {
-					log.Println("client watching key", k)
-					watchedKeys[k] = struct{}{}
-				}
-			case approto.GetMessage:
-				values := make(map[string]any, len(msg.Keys))
-				for _, k := range msg.Keys {
-					if strings.HasPrefix(k, approto.ReadOnlyKeyPrefix) {
-						values[k] = dataStorage[k]
-						continue
-					}
-					val, found, err := state.getStoredData(k)
 					if err != nil {
 						return err
 					}
-					if found {
-						values[k] = json.RawMessage(val)
-					} else {
-						values[k] = nil
-					}
-				}
-				apconn.Send(approto.MakeRetrievedMessage(values, msg.Rest))
-			case approto.LocationScoutsMessage:
-				scoutedItems := make([]approto.NetworkItem, 0, len(msg.Locations))
-				for _, locID := range msg.Locations {
-					p, err := state.getPlacedItem(locID)
-					if err != nil && err != errZeroRows {
-						return err
+					item := approto.NetworkItem{
+						Location: locID,
+						Player:   s.playerID + 1,
+						Item:     id,
+						Flags:    flags,
 					}
-					if err == nil {
-						var itemID int64
-						if p.ownerID == playerID {
-							itemID = data.Datapackage[slot.Game].ItemNameToID[mwproto.StripDiscriminator(p.name)]
-						} else {
-							name := prettifyName(p.name)
-							itemID = dataPackages[games[p.ownerID]].ItemNameToID[name]
-						}
-						scoutedItems = append(scoutedItems, approto.NetworkItem{
-							Location: locID,
-							Player:   p.ownerID + 1,
-							Item:     itemID,
-							Flags:    0,
-						})
-					} else {
-						ownItem, ok := data.Locations[slotID][locID]
-						if !(ok && len(ownItem) >= 3) {
-							continue
-						}
-						scoutedItems = append(scoutedItems, approto.NetworkItem{
-							Location: locID,
-							Player:   playerID + 1,
-							Item:     ownItem[0],
-							Flags:    int(ownItem[2]),
-						})
-					}
-				}
-				apconn.Send(approto.LocationInfoMessage{
-					Cmd:       "LocationInfo",
-					Locations: scoutedItems,
-				})
-			case approto.LocationChecksMessage:
-				for _, locID := range msg.Locations {
-					checked, err := state.isLocationCleared(locID)
-					if err != nil {
+					if err := r.deliver(toSlot, item); err != nil {
 						return err
 					}
-					if checked {
-						continue
+				case err == nil:
+					msg := mwproto.DataSendMessage{
+						Label:   mwproto.LabelMultiworldItem,
+						Content: p.name,
+						To:      int32(p.ownerID),
+						TTL:     sentItemTTL,
 					}
-
-					p, err := state.getPlacedItem(locID)
-					if err != nil && err != errZeroRows {
+					if err := state.addUnconfirmedItems(s.slot, msg); err != nil {
 						return err
 					}
-
-					if err == nil {
-						if p.ownerID == playerID {
-							name := mwproto.StripDiscriminator(p.name)
-							itemID := data.Datapackage[slot.Game].ItemNameToID[name]
-							item := approto.NetworkItem{
-								Location: locID,
-								Player:   playerID + 1,
-								Item:     itemID,
-								Flags:    0,
-							}
-							index, err := state.addSentItems(item)
-							if err != nil {
-								return err
-							}
-							if itemHandling&approto.ReceiveOwnItems != 0 {
-								apconn.Send(approto.ReceivedItems{
-									Cmd:   "ReceivedItems",
-									Index: index,
-									Items: []approto.NetworkItem{item},
-								})
-							}
-						} else {
-							msg := mwproto.DataSendMessage{
-								Label:   mwproto.LabelMultiworldItem,
-								Content: p.name,
-								To:      int32(p.ownerID),
-								TTL:     sentItemTTL,
-							}
-							if err := state.addUnconfirmedItems(msg); err != nil {
-								return err
-							}
-							conn.Send(msg)
-						}
-					} else {
-						if itemHandling&approto.ReceiveOwnItems == 0 {
-							continue
-						}
-						ownItem, ok := data.Locations[slotID][locID]
-						if !(ok && len(ownItem) >= 3) {
-							continue
-						}
-						item := approto.NetworkItem{
-							Location: locID,
-							Player:   playerID + 1,
-							Item:     ownItem[0],
-							Flags:    int(ownItem[2]),
-						}
-						index, err := state.addSentItems(item)
-						if err != nil {
+					sends = append(sends, msg)
+				case err == errZeroRows:
+					toSlot, item, ok := s.apPlacedItem(locID)
+					if ok {
+						if err := r.deliver(toSlot, item); err != nil {
 							return err
 						}
-						if itemHandling&approto.ReceiveOwnItems != 0 {
-							apconn.Send(approto.ReceivedItems{
-								Cmd:   "ReceivedItems",
-								Index: index,
-								Items: []approto.NetworkItem{item},
-							})
-						}
 					}
+				default:
+					return err
+				}
 
-					if err := state.clearLocations(locID); err != nil {
-						return err
-					}
+				if err := state.clearLocations(s.slot, locID); err != nil {
+					return err
 				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, msg := range sends {
+			s.sendMW(msg)
 		}
 	}
+	return nil
+}
+
+// apPlacedItem returns the item that AP placed at one of the slot's
+// locations, for locations that MW doesn't know about, along with the slot
+// it's for.
+func (s *slotSession) apPlacedItem(locID int64) (toSlot int, item approto.NetworkItem, ok bool) {
+	placed, ok := s.room.data.Locations[s.slot][locID]
+	if !(ok && len(placed) >= 3) {
+		return 0, item, false
+	}
+	toSlot = int(placed[1])
+	if _, served := s.room.slots[toSlot]; !served {
+		toSlot = s.slot
+	}
+	item = approto.NetworkItem{
+		Location: locID,
+		Player:   s.playerID + 1,
+		Item:     placed[0],
+		Flags:    int(placed[2]),
+	}
+	return toSlot, item, true
 }
 
 func prettifyName(name string) string {
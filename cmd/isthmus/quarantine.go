@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+// quarantineCommand shows the items that Isthmus received but couldn't make
+// sense of, and delivers or discards them.
+func quarantineCommand(args []string) error {
+	const usage = "usage: isthmus quarantine list|deliver|discard [options] [id]"
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	var opts options
+	var itemName string
+	flags := flag.NewFlagSet("quarantine "+args[0], flag.ExitOnError)
+	flags.StringVar(&opts.savefile, "savefile", "./savefile.isthmus", "The savefile holding the quarantined items")
+	flags.StringVar(&opts.apfile, "apfile", "./AP.archipelago", "The Archipelago seed the savefile was created from; only needed for savefiles from older versions of Isthmus")
+	if args[0] == "deliver" {
+		flags.StringVar(&itemName, "item", "", "Deliver the AP item named `name` instead of the one in the quarantined item's name")
+	}
+	flags.Parse(args[1:])
+	opts.apfileGiven = flagGiven(flags, "apfile")
+
+	var id int
+	switch args[0] {
+	case "list":
+		if flags.NArg() != 0 {
+			return errors.New(usage)
+		}
+	case "deliver", "discard":
+		n, err := strconv.Atoi(flags.Arg(0))
+		if flags.NArg() != 1 || err != nil {
+			return errors.New(usage)
+		}
+		id = n
+	default:
+		return fmt.Errorf("unknown quarantine command: %s", args[0])
+	}
+
+	if _, err := os.Stat(opts.savefile); err != nil {
+		return err
+	}
+	r, err := openRoom(opts, false)
+	if err != nil {
+		return err
+	}
+	defer r.close()
+
+	items, err := r.state.getQuarantinedItems()
+	if err != nil {
+		return err
+	}
+	if args[0] == "list" {
+		return listQuarantinedItems(r, items)
+	}
+	i := slices.IndexFunc(items, func(item quarantinedItem) bool { return item.id == id })
+	if i == -1 {
+		return fmt.Errorf("no quarantined item with ID %d", id)
+	}
+	item := items[i]
+	return r.state.transaction(func() error {
+		if args[0] == "deliver" {
+			if err := deliverQuarantinedItem(r, item, itemName); err != nil {
+				return err
+			}
+		}
+		_, err := r.state.releaseQuarantinedItem(id)
+		return err
+	})
+}
+
+func listQuarantinedItems(r *room, items []quarantinedItem) error {
+	if len(items) == 0 {
+		fmt.Println("no quarantined items")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSLOT\tFROM\tITEM\tREASON")
+	for _, item := range items {
+		from := "(server)"
+		if item.fromPlayerID >= 0 && item.fromPlayerID < len(r.nicknames) {
+			from = r.nicknames[item.fromPlayerID]
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", item.id, r.data.SlotInfo[item.slot].Name, from, item.content, item.reason)
+	}
+	return w.Flush()
+}
+
+// deliverQuarantinedItem gives a quarantined item to the slot that received
+// it, as the AP item in its game named itemName, or by the item's own name if
+// that is empty.
+func deliverQuarantinedItem(r *room, item quarantinedItem, itemName string) error {
+	if itemName == "" {
+		itemName = mwproto.StripDiscriminator(item.content)
+	}
+	game := r.data.SlotInfo[item.slot].Game
+	id, ok := r.data.Datapackage[game].ItemNameToID[itemName]
+	if !ok {
+		return fmt.Errorf("%q is not an item in %s; use -item to choose one", itemName, game)
+	}
+	ni := approto.NetworkItem{Item: id}
+	var err error
+	ni.Player, ni.Location, err = r.itemSource(item.slot, item.content, item.fromPlayerID)
+	if err != nil {
+		return err
+	}
+	return r.deliver(item.slot, ni)
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+// reverseCommand runs the bridge in the opposite direction from the default
+// one: it hosts an MW server for HK MultiWorld clients, and connects each of
+// them to an Archipelago room as the slot named after their MW nickname.
+func reverseCommand(args []string) error {
+	var (
+		opts reverseOptions
+		host string
+		port int
+	)
+	flags := flag.NewFlagSet("reverse", flag.ExitOnError)
+	flags.StringVar(&opts.apserver, "apserver", "localhost:38281", "The Archipelago server to connect to, as a URL or host:port")
+	flags.StringVar(&opts.password, "password", "", "The `password` of the Archipelago room")
+	flags.StringVar(&opts.game, "game", "Hollow Knight", "The AP `game` that the MW players' slots are for")
+	flags.StringVar(&host, "host", "localhost", "Accept MW clients on the network interface with address `host`; empty to accept them on all interfaces")
+	flags.IntVar(&port, "port", 38282, "Accept MW clients on port `port`")
+	flags.StringVar(&opts.statefile, "statefile", "./reverse.isthmus.json", "Keep track of generated games in `file`")
+	flags.Parse(args)
+
+	store, err := loadReverseStore(opts.statefile)
+	if err != nil {
+		return err
+	}
+	l, err := mwproto.Listen(net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Println("accepting MW clients on", l.Addr())
+	var nextUID atomic.Uint64
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		b := &reverseBridge{opts: opts, store: store, conn: conn, uid: nextUID.Add(1)}
+		go b.run()
+	}
+}
+
+type reverseOptions struct {
+	apserver, password, game string
+	statefile                string
+}
+
+// reverseArchipelagoNick is the name of the pseudo-player that owns the MW
+// player's own items when they are placed at AP locations. Routing those
+// items through the bridge is what lets us report every location check to
+// AP.
+const reverseArchipelagoNick = "Archipelago"
+
+// A reverseBridge serves one MW client.
+type reverseBridge struct {
+	opts  reverseOptions
+	store *reverseStore
+	conn  *mwproto.ServerConn
+	uid   uint64
+
+	ap      *apSlot
+	randoID int32
+	game    reverseGame
+	joined  bool
+	// forwarded is the AP index of the next received item to send to the
+	// MW client.
+	forwarded int
+	// unconfirmed holds the items forwarded to the MW client that it hasn't
+	// confirmed yet, in the order they were sent.
+	unconfirmed []forwardedItem
+}
+
+type forwardedItem struct {
+	index          int
+	label, content string
+}
+
+func (b *reverseBridge) run() {
+	defer b.conn.Close()
+	defer func() {
+		if b.ap != nil {
+			b.ap.client.Close()
+		}
+	}()
+	log.Println("MW client connected from", b.conn.RemoteAddr())
+	for {
+		var apInbox <-chan approto.ServerMessage
+		if b.ap != nil {
+			apInbox = b.ap.client.Inbox()
+		}
+		select {
+		case msg, ok := <-b.conn.Inbox():
+			if !ok {
+				log.Println("MW client disconnected from", b.conn.RemoteAddr())
+				return
+			}
+			if err := b.handleMW(msg); err != nil {
+				log.Println("reverse bridge:", err)
+				return
+			}
+		case msg, ok := <-apInbox:
+			if !ok {
+				log.Printf("lost connection to AP for slot %s", b.ap.name)
+				return
+			}
+			if err := b.handleAP(msg); err != nil {
+				log.Println("reverse bridge:", err)
+				return
+			}
+		}
+	}
+}
+
+func (b *reverseBridge) handleMW(msg mwproto.Message) error {
+	switch msg := msg.(type) {
+	case mwproto.ConnectMessage:
+		b.conn.SendEnvelope(mwproto.Envelope{
+			SenderUID: b.uid,
+			Message:   mwproto.ConnectMessage{ServerName: "Isthmus"},
+		})
+	case mwproto.DisconnectMessage:
+		return errConnectionLost
+	case mwproto.ReadyMessage:
+		if b.ap != nil {
+			b.ap.client.Close()
+			b.ap = nil
+		}
+		ap, err := connectAPSlot(b.opts, msg.Nickname)
+		if err != nil {
+			b.conn.Send(mwproto.ReadyDenyMessage{Description: err.Error()})
+			return nil
+		}
+		b.ap = ap
+		b.conn.Send(mwproto.ReadyConfirmMessage{Ready: 1, Names: []string{msg.Nickname}})
+	case mwproto.UnreadyMessage:
+		if b.ap != nil {
+			b.ap.client.Close()
+			b.ap = nil
+		}
+	case mwproto.InitiateGameMessage:
+		if b.ap != nil {
+			b.conn.Send(mwproto.RequestRandoMessage{})
+		}
+	case mwproto.RandoGeneratedMessage:
+		if b.ap == nil {
+			return errors.New("received placements before joining a room")
+		}
+		return b.generate(msg)
+	case mwproto.JoinMessage:
+		return b.join(msg)
+	case mwproto.DataSendMessage:
+		_, name, _ := mwproto.ParseQualifiedName(msg.Content)
+		if name == "" {
+			name = msg.Content
+		}
+		locID, ok := mwproto.ParseDiscriminator(name)
+		if !ok || b.ap == nil {
+			log.Printf("cannot send %s: not found at an AP location", msg.Content)
+			return nil
+		}
+		b.ap.client.LocationChecks(locID)
+		// AP doesn't acknowledge checks, so this is the best we can do.
+		b.conn.Send(mwproto.DataSendConfirmMessage{Label: msg.Label, Content: msg.Content, To: msg.To})
+	case mwproto.DataReceiveConfirmMessage:
+		return b.confirm(msg.Label, msg.Data)
+	case mwproto.DatasReceiveConfirmMessage:
+		// We only ever send items one at a time, so there's nothing this
+		// can be confirming.
+		log.Printf("ignoring confirmation of %d items that weren't sent together", msg.Count)
+	case mwproto.RequestCharmNotchCostsMessage:
+		b.conn.Send(mwproto.AnnounceCharmNotchCostsMessage{PlayerID: b.game.PlayerID, NotchCosts: map[int]int{}})
+	case mwproto.AnnounceCharmNotchCostsMessage:
+		b.conn.Send(mwproto.ConfirmCharmNotchCostsReceived{PlayerID: msg.PlayerID})
+	case mwproto.SaveMessage:
+	default:
+		log.Printf("ignoring %T from MW client", msg)
+	}
+	return nil
+}
+
+// generate lays out the MW client's world according to where AP placed the
+// items at the locations it knows about; other locations keep the items the
+// client chose for them.
+// confirm records that the MW client received the oldest unconfirmed item
+// with the given label and content. Confirmations that don't match any such
+// item, such as repeated ones, are ignored.
+func (b *reverseBridge) confirm(label, content string) error {
+	i := slices.IndexFunc(b.unconfirmed, func(f forwardedItem) bool {
+		return f.label == label && f.content == content
+	})
+	if i == -1 {
+		log.Printf("ignoring confirmation of %s, which is not awaiting one", content)
+		return nil
+	}
+	b.unconfirmed = slices.Delete(b.unconfirmed, i, i+1)
+	// Items confirmed out of order don't count until the ones before them
+	// are, so that none are skipped when the client rejoins.
+	b.game.ItemsDelivered = b.forwarded
+	if len(b.unconfirmed) > 0 {
+		b.game.ItemsDelivered = b.unconfirmed[0].index
+	}
+	return b.store.put(b.randoID, b.game)
+}
+
+func (b *reverseBridge) generate(rando mwproto.RandoGeneratedMessage) error {
+	ap := b.ap
+	own := ap.dataPackages[b.opts.game]
+	valid := map[int64]bool{}
+	for _, id := range ap.connected.MissingLocations {
+		valid[id] = true
+	}
+	for _, id := range ap.connected.CheckedLocations {
+		valid[id] = true
+	}
+	locIDs := map[string]int64{}
+	for _, ps := range rando.Items {
+		for _, p := range ps {
+			id, ok := own.LocationNameToID[p.Location]
+			if !ok {
+				id, ok = own.LocationNameToID[mwproto.StripDiscriminator(p.Location)]
+			}
+			if ok && valid[id] {
+				locIDs[p.Location] = id
+			}
+		}
+	}
+	scouted, err := ap.scout(slices.Sorted(maps.Values(locIDs)))
+	if err != nil {
+		return err
+	}
+
+	nicknames := ap.nicknames()
+	playerID := int32(ap.connected.Slot - 1)
+	archipelagoID := len(nicknames)
+	nicknames = append(nicknames, reverseArchipelagoNick)
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%d", ap.seedName, ap.connected.Slot)
+	randoID := int32(h.Sum32() & 0x7fffffff)
+
+	res := mwproto.ResultMessage{
+		PlayerID:              playerID,
+		RandoID:               randoID,
+		Nicknames:             nicknames,
+		ReadyMetadata:         make([][]mwproto.KeyValuePair, len(nicknames)),
+		Placements:            map[string][]mwproto.ResultPlacement{},
+		PlayerItemsPlacements: map[string]string{},
+		GeneratedHash:         ap.seedName,
+		ItemsSpoiler:          mwproto.SpoilerLogs{IndividualWorldSpoilers: map[string]string{}},
+	}
+	for i := range res.ReadyMetadata {
+		res.ReadyMetadata[i] = []mwproto.KeyValuePair{}
+	}
+	for group, ps := range rando.Items {
+		out := make([]mwproto.ResultPlacement, len(ps))
+		for i, p := range ps {
+			out[i].Location = mwproto.QualifyName(int(playerID), p.Location)
+			ni, ok := scouted[locIDs[p.Location]]
+			if !ok {
+				out[i].Item = mwproto.QualifyName(int(playerID), p.Item)
+				continue
+			}
+			owner := ni.Player - 1
+			if ni.Player == ap.connected.Slot {
+				owner = archipelagoID
+			}
+			name := mwproto.Name{Name: ap.itemName(ni.Player, ni.Item), Discriminator: ni.Location, HasDiscriminator: true}
+			out[i].Item = mwproto.QualifyName(owner, name.Encode())
+		}
+		res.Placements[group] = out
+	}
+
+	b.randoID = randoID
+	b.game = reverseGame{Slot: ap.name, PlayerID: playerID}
+	b.unconfirmed = nil
+	if old, ok := b.store.get(randoID); ok {
+		b.game.ItemsDelivered = old.ItemsDelivered
+	}
+	if err := b.store.put(randoID, b.game); err != nil {
+		return err
+	}
+	log.Printf("generated game for slot %s: %d of its locations are on AP", ap.name, len(scouted))
+	b.conn.Send(res)
+	return nil
+}
+
+func (b *reverseBridge) join(msg mwproto.JoinMessage) error {
+	game, ok := b.store.get(msg.RandoID)
+	if !ok || game.PlayerID != msg.PlayerID {
+		return fmt.Errorf("MW client tried to join unknown game %d as player %d", msg.RandoID, msg.PlayerID)
+	}
+	if b.ap == nil || b.ap.name != game.Slot {
+		if b.ap != nil {
+			b.ap.client.Close()
+		}
+		ap, err := connectAPSlot(b.opts, game.Slot)
+		if err != nil {
+			return err
+		}
+		b.ap = ap
+	}
+	b.randoID = msg.RandoID
+	b.game = game
+	b.joined = true
+	b.forwarded = game.ItemsDelivered
+	b.unconfirmed = nil
+	b.conn.Send(mwproto.JoinConfirmMessage{})
+	log.Printf("slot %s joined; %d items already delivered", game.Slot, game.ItemsDelivered)
+	// Get AP to resend everything we've received so far.
+	b.ap.client.Sync()
+	return nil
+}
+
+func (b *reverseBridge) handleAP(msg approto.ServerMessage) error {
+	switch msg := msg.(type) {
+	case approto.ReceivedItems:
+		if !b.joined {
+			return nil
+		}
+		if msg.Index > b.forwarded {
+			// We missed some items; AP will send them all again.
+			b.ap.client.Sync()
+			return nil
+		}
+		for i, ni := range msg.Items {
+			if msg.Index+i < b.forwarded {
+				continue
+			}
+			fromID := ni.Player - 1
+			if ni.Player == approto.ServerSlot {
+				fromID = len(b.ap.nicknames())
+			}
+			item := mwproto.DataReceiveMessage{
+				Label:   mwproto.LabelMultiworldItem,
+				Content: b.ap.itemName(b.ap.connected.Slot, ni.Item),
+				From:    b.ap.playerName(ni.Player),
+				FromID:  int32(fromID),
+			}
+			b.conn.Send(item)
+			b.unconfirmed = append(b.unconfirmed, forwardedItem{index: b.forwarded, label: item.Label, content: item.Content})
+			b.forwarded++
+		}
+	}
+	return nil
+}
+
+// An apSlot is a connection to an AP room as one of its slots.
+type apSlot struct {
+	client       *approto.Client
+	name         string
+	seedName     string
+	connected    approto.Connected
+	dataPackages map[string]approto.DataPackage
+	itemNames    map[string]map[int64]string
+}
+
+func connectAPSlot(opts reverseOptions, name string) (*apSlot, error) {
+	client, err := approto.Dial(opts.apserver, mwTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect to AP: %w", err)
+	}
+	ap := &apSlot{
+		client:       client,
+		name:         name,
+		dataPackages: map[string]approto.DataPackage{},
+		itemNames:    map[string]map[int64]string{},
+	}
+	handling := approto.ReceiveOthersItems | approto.ReceiveOwnItems | approto.ReceiveStartingItems
+	room, connected, err := client.Handshake(approto.Connect{
+		Password:      opts.password,
+		Game:          opts.game,
+		Name:          name,
+		UUID:          "isthmus-" + name,
+		Version:       apServerVersion,
+		ItemsHandling: &handling,
+		Tags:          []string{},
+	}, mwTimeout)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	ap.seedName = room.SeedName
+	ap.connected = connected
+	client.GetDataPackage(room.Games...)
+	msg, err := awaitAP[approto.DataPackageMessage](client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	for game, data := range msg.Data.Games {
+		var dp approto.DataPackage
+		if err := remarshal(data, &dp); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("read data package for %s: %w", game, err)
+		}
+		ap.dataPackages[game] = dp
+		names := make(map[int64]string, len(dp.ItemNameToID))
+		for name, id := range dp.ItemNameToID {
+			names[id] = name
+		}
+		ap.itemNames[game] = names
+	}
+	log.Printf("connected to AP as slot %d (%s)", ap.connected.Slot, name)
+	return ap, nil
+}
+
+// scout finds out which items are at the given locations in our world.
+func (ap *apSlot) scout(locations []int64) (map[int64]approto.NetworkItem, error) {
+	items := make(map[int64]approto.NetworkItem, len(locations))
+	if len(locations) == 0 {
+		return items, nil
+	}
+	ap.client.LocationScouts(locations...)
+	info, err := awaitAP[approto.LocationInfoMessage](ap.client)
+	if err != nil {
+		return nil, err
+	}
+	for _, ni := range info.Locations {
+		items[ni.Location] = ni
+	}
+	return items, nil
+}
+
+// awaitAP waits for the next message of type T from the server, discarding
+// any others; it must only be used before the game starts.
+func awaitAP[T approto.ServerMessage](client *approto.Client) (T, error) {
+	var zero T
+	timeout := time.After(mwTimeout)
+	for {
+		select {
+		case msg, ok := <-client.Inbox():
+			if !ok {
+				return zero, approto.ErrDisconnected
+			}
+			if m, ok := msg.(T); ok {
+				return m, nil
+			}
+		case <-timeout:
+			return zero, fmt.Errorf("waiting for %T: %w", zero, approto.ErrTimeout)
+		}
+	}
+}
+
+// nicknames lists the players in the room, indexed by slot number minus one.
+func (ap *apSlot) nicknames() []string {
+	var names []string
+	for _, p := range ap.connected.Players {
+		for len(names) < p.Slot {
+			names = append(names, "")
+		}
+		names[p.Slot-1] = p.Alias
+	}
+	return names
+}
+
+func (ap *apSlot) playerName(slot int) string {
+	if slot == approto.ServerSlot {
+		return reverseArchipelagoNick
+	}
+	for _, p := range ap.connected.Players {
+		if p.Slot == slot {
+			return p.Alias
+		}
+	}
+	return fmt.Sprintf("Player %d", slot)
+}
+
+// itemName returns the name of an item from the game of the given slot.
+func (ap *apSlot) itemName(slot int, item int64) string {
+	if name, ok := ap.itemNames[ap.connected.SlotInfo[slot].Game][item]; ok {
+		return name
+	}
+	return fmt.Sprintf("Item %d", item)
+}
+
+func remarshal(in, out any) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// A reverseGame records what we need to rejoin a generated game after the
+// MW client reconnects.
+type reverseGame struct {
+	Slot     string `json:"slot"`
+	PlayerID int32  `json:"player_id"`
+	// ItemsDelivered is how many AP items, counting from the first, the MW
+	// client has confirmed without a gap.
+	ItemsDelivered int `json:"items_delivered"`
+}
+
+type reverseStore struct {
+	mu    sync.Mutex
+	name  string
+	games map[int32]reverseGame
+}
+
+func loadReverseStore(name string) (*reverseStore, error) {
+	s := &reverseStore{name: name, games: map[int32]reverseGame{}}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.games); err != nil {
+		return nil, fmt.Errorf("read %s: %w", name, err)
+	}
+	return s, nil
+}
+
+func (s *reverseStore) get(randoID int32) (reverseGame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.games[randoID]
+	return g, ok
+}
+
+func (s *reverseStore) put(randoID int32, g reverseGame) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.games[randoID] = g
+	if err := writeJSONFile(s.name, s.games); err != nil {
+		return fmt.Errorf("save reverse bridge state: %w", err)
+	}
+	return nil
+}
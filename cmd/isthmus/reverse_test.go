@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+func TestReverseConfirmsMatchForwardedItems(t *testing.T) {
+	store, err := loadReverseStore(filepath.Join(t.TempDir(), "reverse.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &reverseBridge{store: store, randoID: 42, game: reverseGame{Slot: "Bob", ItemsDelivered: 5}, forwarded: 8}
+	b.unconfirmed = []forwardedItem{
+		{index: 5, label: mwproto.LabelMultiworldItem, content: "Lantern"},
+		{index: 6, label: mwproto.LabelMultiworldItem, content: "Grub"},
+		{index: 7, label: mwproto.LabelMultiworldItem, content: "Grub"},
+	}
+	steps := []struct {
+		msg  mwproto.Message
+		want int
+	}{
+		// Out of order, so item 5 is still missing.
+		{mwproto.DataReceiveConfirmMessage{Label: mwproto.LabelMultiworldItem, Data: "Grub"}, 5},
+		{mwproto.DataReceiveConfirmMessage{Label: mwproto.LabelMultiworldItem, Data: "Lantern"}, 7},
+		{mwproto.DataReceiveConfirmMessage{Label: mwproto.LabelMultiworldItem, Data: "Lantern"}, 7},
+		{mwproto.DataReceiveConfirmMessage{Label: "Other-Label", Data: "Grub"}, 7},
+		{mwproto.DatasReceiveConfirmMessage{Count: 10}, 7},
+		{mwproto.DataReceiveConfirmMessage{Label: mwproto.LabelMultiworldItem, Data: "Grub"}, 8},
+		{mwproto.DataReceiveConfirmMessage{Label: mwproto.LabelMultiworldItem, Data: "Grub"}, 8},
+	}
+	for _, step := range steps {
+		if err := b.handleMW(step.msg); err != nil {
+			t.Fatal(err)
+		}
+		if b.game.ItemsDelivered != step.want {
+			t.Errorf("after %#v, %d items delivered, want %d", step.msg, b.game.ItemsDelivered, step.want)
+		}
+		if g, _ := store.get(42); g.ItemsDelivered != b.game.ItemsDelivered {
+			t.Errorf("after %#v, %d items delivered were stored, want %d", step.msg, g.ItemsDelivered, b.game.ItemsDelivered)
+		}
+	}
+}
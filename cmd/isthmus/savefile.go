@@ -1,15 +1,23 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"iter"
+	"log"
+	"maps"
+	"slices"
 
 	"github.com/dpinela/mmm/internal/approto"
 	"github.com/dpinela/mmm/internal/mwproto"
 	"github.com/dpinela/mmm/internal/sqlite"
 )
 
+// A savefile holds the state of every AP slot being served. Most of it is
+// kept per slot, but the MW players and AP data storage are shared by all
+// slots, just as they would be in a real room.
 type savefile struct {
 	db                         *sqlite.DB
 	selectClearedLocationsStmt *sqlite.Statement
@@ -26,6 +34,8 @@ type savefile struct {
 	setStoredDataStmt          *sqlite.Statement
 	getLocationOfOwnItemStmt   *sqlite.Statement
 	getPlacedItemStmt          *sqlite.Statement
+	getContributedItemStmt     *sqlite.Statement
+	quarantineItemStmt         *sqlite.Statement
 }
 
 func exec(stmt *sqlite.Statement, rowHandler func()) error {
@@ -76,12 +86,30 @@ func (ps *savefile) getNicknames() (names []string, err error) {
 	return
 }
 
-func (ps *savefile) getConnectionParams() (playerID, randoID int, err error) {
-	stmt := ps.db.Prepare("SELECT player_id, rando_id FROM mw_global_data")
+// getPlayerMetadata returns the ready metadata that each MW player joined the
+// room with.
+func (ps *savefile) getPlayerMetadata() (metadata map[int][]mwproto.KeyValuePair, err error) {
+	stmt := ps.db.Prepare("SELECT player_id, key, value FROM mw_player_metadata ORDER BY player_id, position")
 	defer stmt.Close()
-	err = execOnce(stmt, func() {
-		playerID = stmt.ReadInt32(0)
-		randoID = stmt.ReadInt32(1)
+	metadata = map[int][]mwproto.KeyValuePair{}
+	err = exec(stmt, func() {
+		pid := stmt.ReadInt32(0)
+		metadata[pid] = append(metadata[pid], mwproto.KeyValuePair{Key: stmt.ReadString(1), Value: stmt.ReadString(2)})
+	})
+	return
+}
+
+type slotParams struct {
+	playerID, randoID int
+}
+
+// getSlots returns the MW connection parameters for each AP slot.
+func (ps *savefile) getSlots() (slots map[int]slotParams, err error) {
+	stmt := ps.db.Prepare("SELECT ap_slot, player_id, rando_id FROM mw_global_data")
+	defer stmt.Close()
+	slots = map[int]slotParams{}
+	err = exec(stmt, func() {
+		slots[stmt.ReadInt32(0)] = slotParams{playerID: stmt.ReadInt32(1), randoID: stmt.ReadInt32(2)}
 	})
 	return
 }
@@ -96,6 +124,8 @@ type ownItemPlacement struct {
 	location qualifiedLocation
 }
 
+// getOwnItemLocations returns the locations in other worlds of every slot's
+// own items.
 func (ps *savefile) getOwnItemLocations() iter.Seq2[qualifiedLocation, error] {
 	stmt := ps.db.Prepare("SELECT location_name, source_player_id FROM mw_own_item_placements ORDER BY location_name")
 	return execIter(stmt, func() qualifiedLocation {
@@ -103,11 +133,13 @@ func (ps *savefile) getOwnItemLocations() iter.Seq2[qualifiedLocation, error] {
 	})
 }
 
-// Gets all of our own items that are in other worlds and haven't been received yet.
-func (ps *savefile) getCollectablePlacements(selfID int) (placements []ownItemPlacement, err error) {
-	stmt := ps.db.Prepare("SELECT item_name, location_name, source_player_id FROM mw_own_item_placements WHERE source_player_id != ? AND NOT EXISTS (SELECT 1 FROM mw_received_items WHERE label = ? AND content = item_name)")
-	stmt.BindInt(1, selfID)
-	stmt.BindString(2, mwproto.LabelMultiworldItem)
+// Gets all of a slot's own items that are in other worlds and haven't been received yet.
+func (ps *savefile) getCollectablePlacements(slot, selfID int) (placements []ownItemPlacement, err error) {
+	stmt := ps.db.Prepare("SELECT item_name, location_name, source_player_id FROM mw_own_item_placements p WHERE ap_slot = ?1 AND source_player_id != ?2 AND NOT EXISTS (SELECT 1 FROM mw_received_items r WHERE r.ap_slot = ?1 AND label = ?3 AND content = item_name)")
+	defer stmt.Close()
+	stmt.BindInt(1, slot)
+	stmt.BindInt(2, selfID)
+	stmt.BindString(3, mwproto.LabelMultiworldItem)
 	err = exec(stmt, func() {
 		placements = append(placements, ownItemPlacement{
 			itemName: stmt.ReadString(0),
@@ -117,28 +149,32 @@ func (ps *savefile) getCollectablePlacements(selfID int) (placements []ownItemPl
 	return
 }
 
+// getOwnWorldPlacements returns the placements in every slot's world.
 func (ps *savefile) getOwnWorldPlacements() iter.Seq2[ownWorldPlacement, error] {
-	stmt := ps.db.Prepare("SELECT ap_location_id, item_name, dest_player_id FROM mw_own_world_placements ORDER BY ap_location_id")
+	stmt := ps.db.Prepare("SELECT ap_slot, ap_location_id, item_name, dest_player_id FROM mw_own_world_placements ORDER BY ap_slot, ap_location_id")
 	return execIter(stmt, func() ownWorldPlacement {
 		return ownWorldPlacement{
-			apLocationID: stmt.ReadInt64(0),
-			placedItem:   placedItem{name: stmt.ReadString(1), ownerID: stmt.ReadInt32(2)},
+			apSlot:       stmt.ReadInt32(0),
+			apLocationID: stmt.ReadInt64(1),
+			placedItem:   placedItem{name: stmt.ReadString(2), ownerID: stmt.ReadInt32(3)},
 		}
 	})
 }
 
-func (ps *savefile) getLocationOfOwnItem(itemName string) (locName string, err error) {
+func (ps *savefile) getLocationOfOwnItem(slot int, itemName string) (locName string, err error) {
 	stmt := ps.getLocationOfOwnItemStmt
-	stmt.BindString(1, itemName)
+	stmt.BindInt(1, slot)
+	stmt.BindString(2, itemName)
 	err = execOnce(stmt, func() {
 		locName = stmt.ReadString(0)
 	})
 	return
 }
 
-func (ps *savefile) getPlacedItem(locID int64) (item placedItem, err error) {
+func (ps *savefile) getPlacedItem(slot int, locID int64) (item placedItem, err error) {
 	stmt := ps.getPlacedItemStmt
-	stmt.BindInt64(1, locID)
+	stmt.BindInt(1, slot)
+	stmt.BindInt64(2, locID)
 	err = execOnce(stmt, func() {
 		item.name = stmt.ReadString(0)
 		item.ownerID = stmt.ReadInt32(1)
@@ -146,6 +182,81 @@ func (ps *savefile) getPlacedItem(locID int64) (item placedItem, err error) {
 	return
 }
 
+// getContributedItem returns the AP item behind one of the items that the
+// slot contributed to the MW room.
+func (ps *savefile) getContributedItem(slot int, itemName string) (item apItem, err error) {
+	stmt := ps.getContributedItemStmt
+	stmt.BindInt(1, slot)
+	stmt.BindString(2, itemName)
+	err = execOnce(stmt, func() {
+		item.ownerSlot = stmt.ReadInt32(0)
+		item.id = stmt.ReadInt64(1)
+		item.flags = stmt.ReadInt32(2)
+	})
+	return
+}
+
+// A syntheticGame is the made-up AP game that stands for the world of a MW
+// player that isn't one of ours.
+type syntheticGame struct {
+	name        string
+	datapackage *approto.DataPackage
+}
+
+// getSyntheticGames returns the made-up games for other players' worlds, by
+// MW player ID.
+func (ps *savefile) getSyntheticGames() (games map[int]syntheticGame, err error) {
+	stmt := ps.db.Prepare("SELECT player_id, game, checksum FROM ap_synthetic_games")
+	games = map[int]syntheticGame{}
+	err = exec(stmt, func() {
+		games[stmt.ReadInt32(0)] = syntheticGame{
+			name: stmt.ReadString(1),
+			datapackage: &approto.DataPackage{
+				ItemNameToID:     map[string]int64{},
+				LocationNameToID: map[string]int64{},
+				Checksum:         stmt.ReadString(2),
+			},
+		}
+	})
+	stmt.Close()
+	if err != nil {
+		return
+	}
+	for _, table := range []string{"ap_synthetic_items", "ap_synthetic_locations"} {
+		stmt = ps.db.Prepare(fmt.Sprintf("SELECT player_id, name, id FROM %s", table))
+		err = exec(stmt, func() {
+			g, ok := games[stmt.ReadInt32(0)]
+			if !ok {
+				return
+			}
+			ids := g.datapackage.ItemNameToID
+			if table == "ap_synthetic_locations" {
+				ids = g.datapackage.LocationNameToID
+			}
+			ids[stmt.ReadString(1)] = stmt.ReadInt64(2)
+		})
+		stmt.Close()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// getSpoilerPlacements returns every placement in the MW game, as read from
+// its spoiler logs.
+func (ps *savefile) getSpoilerPlacements() iter.Seq2[mwproto.SpoilerEntry, error] {
+	stmt := ps.db.Prepare("SELECT item_player_id, item_name, location_player_id, location_name FROM mw_spoiler_placements ORDER BY location_player_id, location_name")
+	return execIter(stmt, func() mwproto.SpoilerEntry {
+		return mwproto.SpoilerEntry{
+			ItemOwner:     stmt.ReadInt32(0),
+			Item:          stmt.ReadString(1),
+			LocationOwner: stmt.ReadInt32(2),
+			Location:      stmt.ReadString(3),
+		}
+	})
+}
+
 func execIter[T any](stmt *sqlite.Statement, f func() T) iter.Seq2[T, error] {
 	return func(yield func(T, error) bool) {
 		var zero T
@@ -170,80 +281,97 @@ func execIter[T any](stmt *sqlite.Statement, f func() T) iter.Seq2[T, error] {
 }
 
 type ownWorldPlacement struct {
+	apSlot       int
 	apLocationID int64
 	placedItem
 }
 
-func (ps *savefile) clearedLocations() (ids []int64, err error) {
+func (ps *savefile) clearedLocations(slot int) (ids []int64, err error) {
 	// We must never return a nil slice from this method, as it will be sent
 	// verbatim to AP clients.
 	ids = []int64{}
 	stmt := ps.selectClearedLocationsStmt
+	stmt.BindInt(1, slot)
 	err = exec(stmt, func() {
 		ids = append(ids, stmt.ReadInt64(0))
 	})
 	return
 }
 
-func (ps *savefile) isLocationCleared(id int64) (cleared bool, err error) {
+func (ps *savefile) isLocationCleared(slot int, id int64) (cleared bool, err error) {
 	stmt := ps.isLocationClearedStmt
-	stmt.BindInt64(1, id)
+	stmt.BindInt(1, slot)
+	stmt.BindInt64(2, id)
 	err = execOnce(stmt, func() {
 		cleared = stmt.ReadInt32(0) == 1
 	})
 	return
 }
 
-func (ps *savefile) clearLocations(ids ...int64) error {
-	if err := ps.db.Exec("BEGIN"); err != nil {
+// transaction runs f so that either all of its changes to the savefile are
+// committed together, or none are if it fails. Transactions may be nested,
+// in which case only the outermost one commits.
+func (ps *savefile) transaction(f func() error) error {
+	if err := ps.db.Exec("SAVEPOINT tx"); err != nil {
 		return err
 	}
-	stmt := ps.addClearedLocationStmt
-	for _, id := range ids {
-		stmt.BindInt64(1, id)
-		if err := stmt.Exec(); err != nil {
-			return err
-		}
-		if err := stmt.Reset(); err != nil {
-			return err
-		}
+	if err := f(); err != nil {
+		ps.db.Exec("ROLLBACK TO tx; RELEASE tx")
+		return err
 	}
-	return ps.db.Exec("COMMIT")
+	return ps.db.Exec("RELEASE tx")
 }
 
-func (ps *savefile) addSentItems(items ...approto.NetworkItem) (index int, err error) {
-	index = -1
-	err = ps.db.Exec("BEGIN")
-	if err != nil {
-		return
-	}
+func (ps *savefile) clearLocations(slot int, ids ...int64) error {
+	return ps.transaction(func() error {
+		stmt := ps.addClearedLocationStmt
+		for _, id := range ids {
+			stmt.BindInt(1, slot)
+			stmt.BindInt64(2, id)
+			if err := stmt.Exec(); err != nil {
+				stmt.Reset()
+				return err
+			}
+			if err := stmt.Reset(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
 
-	stmt := ps.addSentItemStmt
-	for _, item := range items {
-		stmt.BindInt64(1, item.Item)
-		stmt.BindInt64(2, item.Location)
-		stmt.BindInt(3, item.Player)
-		stmt.BindInt(4, item.Flags)
-		err = execOnce(stmt, func() {
-			if index == -1 {
-				// We rely on the database generating sequential IDs for rows in
-				// ap_sent_items. While this is not guaranteed in the general case,
-				// the algorithm described in https://www.sqlite.org/autoinc.html
-				// does work this way if no rows are ever deleted and no conflicts
-				// occur.
-				index = stmt.ReadInt32(0) - 1
+// addSentItems adds items to those sent to the slot's AP client, returning
+// the index of the first one.
+func (ps *savefile) addSentItems(slot int, items ...approto.NetworkItem) (index int, err error) {
+	index = -1
+	err = ps.transaction(func() error {
+		stmt := ps.addSentItemStmt
+		for _, item := range items {
+			stmt.BindInt(1, slot)
+			stmt.BindInt64(2, item.Item)
+			stmt.BindInt64(3, item.Location)
+			stmt.BindInt(4, item.Player)
+			stmt.BindInt(5, item.Flags)
+			err := execOnce(stmt, func() {
+				if index == -1 {
+					index = stmt.ReadInt32(0)
+				}
+			})
+			if err != nil {
+				return err
 			}
-		})
-		if err != nil {
-			return
 		}
-	}
-	err = ps.db.Exec("COMMIT")
+		return nil
+	})
 	return
 }
 
-func (ps *savefile) getSentItems() (items []approto.NetworkItem, err error) {
+// getSentItems returns the items sent to the slot's AP client, starting from
+// the given index.
+func (ps *savefile) getSentItems(slot, from int) (items []approto.NetworkItem, err error) {
 	stmt := ps.getSentItemsStmt
+	stmt.BindInt(1, slot)
+	stmt.BindInt(2, from)
 	// This will be sent verbatim to AP clients.
 	items = []approto.NetworkItem{}
 	err = exec(stmt, func() {
@@ -258,9 +386,10 @@ func (ps *savefile) getSentItems() (items []approto.NetworkItem, err error) {
 	return
 }
 
-func (ps *savefile) getUnconfirmedItems() (items []mwproto.DataSendMessage, err error) {
+func (ps *savefile) getUnconfirmedItems(slot int) (items []mwproto.DataSendMessage, err error) {
 	stmt := ps.getUnconfirmedItemsStmt
 	defer stmt.Reset()
+	stmt.BindInt(1, slot)
 	err = exec(stmt, func() {
 		item := mwproto.DataSendMessage{
 			Label:   stmt.ReadString(0),
@@ -273,30 +402,32 @@ func (ps *savefile) getUnconfirmedItems() (items []mwproto.DataSendMessage, err
 	return
 }
 
-func (ps *savefile) addUnconfirmedItems(items ...mwproto.DataSendMessage) error {
-	if err := ps.db.Exec("BEGIN"); err != nil {
-		return err
-	}
-	stmt := ps.addUnconfirmedItemStmt
-	for _, item := range items {
-		stmt.BindString(1, item.Label)
-		stmt.BindString(2, item.Content)
-		stmt.BindInt(3, int(item.To))
-		if err := stmt.Exec(); err != nil {
-			return err
-		}
-		if err := stmt.Reset(); err != nil {
-			return err
+func (ps *savefile) addUnconfirmedItems(slot int, items ...mwproto.DataSendMessage) error {
+	return ps.transaction(func() error {
+		stmt := ps.addUnconfirmedItemStmt
+		for _, item := range items {
+			stmt.BindInt(1, slot)
+			stmt.BindString(2, item.Label)
+			stmt.BindString(3, item.Content)
+			stmt.BindInt(4, int(item.To))
+			if err := stmt.Exec(); err != nil {
+				stmt.Reset()
+				return err
+			}
+			if err := stmt.Reset(); err != nil {
+				return err
+			}
 		}
-	}
-	return ps.db.Exec("COMMIT")
+		return nil
+	})
 }
 
-func (ps *savefile) confirmItem(item mwproto.DataSendConfirmMessage) (bool, error) {
+func (ps *savefile) confirmItem(slot int, item mwproto.DataSendConfirmMessage) (bool, error) {
 	stmt := ps.confirmItemStmt
-	stmt.BindString(1, item.Label)
-	stmt.BindString(2, item.Content)
-	stmt.BindInt(3, int(item.To))
+	stmt.BindInt(1, slot)
+	stmt.BindString(2, item.Label)
+	stmt.BindString(3, item.Content)
+	stmt.BindInt(4, int(item.To))
 	if err := stmt.Exec(); err != nil {
 		return false, err
 	}
@@ -306,21 +437,23 @@ func (ps *savefile) confirmItem(item mwproto.DataSendConfirmMessage) (bool, erro
 	return ps.db.NumChanges() > 0, nil
 }
 
-func (ps *savefile) addReceivedItem(label, content string) error {
+func (ps *savefile) addReceivedItem(slot int, label, content string) error {
 	stmt := ps.addReceivedItemStmt
 	defer stmt.Reset()
-	stmt.BindString(1, label)
-	stmt.BindString(2, content)
+	stmt.BindInt(1, slot)
+	stmt.BindString(2, label)
+	stmt.BindString(3, content)
 	if err := stmt.Exec(); err != nil {
 		return err
 	}
 	return stmt.Reset()
 }
 
-func (ps *savefile) hasReceivedItem(label, content string) (received bool, err error) {
+func (ps *savefile) hasReceivedItem(slot int, label, content string) (received bool, err error) {
 	stmt := ps.hasReceivedItemStmt
-	stmt.BindString(1, label)
-	stmt.BindString(2, content)
+	stmt.BindInt(1, slot)
+	stmt.BindString(2, label)
+	stmt.BindString(3, content)
 	err = execOnce(stmt, func() {
 		received = stmt.ReadInt32(0) == 1
 	})
@@ -364,69 +497,375 @@ func (ps *savefile) setStoredData(key string, data []byte) error {
 	return stmt.Reset()
 }
 
+// A quarantinedItem is an item that a slot's MW player received but that
+// couldn't be matched to an AP item.
+type quarantinedItem struct {
+	id           int
+	slot         int
+	label        string
+	content      string
+	fromPlayerID int
+	reason       string
+}
+
+// quarantineItem records an item that couldn't be delivered. Items already in
+// quarantine are left as they are.
+func (ps *savefile) quarantineItem(item quarantinedItem) error {
+	stmt := ps.quarantineItemStmt
+	stmt.BindInt(1, item.slot)
+	stmt.BindString(2, item.label)
+	stmt.BindString(3, item.content)
+	stmt.BindInt(4, item.fromPlayerID)
+	stmt.BindString(5, item.reason)
+	if err := stmt.Exec(); err != nil {
+		stmt.Reset()
+		return err
+	}
+	return stmt.Reset()
+}
+
+func (ps *savefile) getQuarantinedItems() (items []quarantinedItem, err error) {
+	stmt := ps.db.Prepare("SELECT id, ap_slot, label, content, from_player_id, reason FROM mw_quarantined_items ORDER BY id")
+	defer stmt.Close()
+	err = exec(stmt, func() {
+		items = append(items, quarantinedItem{
+			id:           stmt.ReadInt32(0),
+			slot:         stmt.ReadInt32(1),
+			label:        stmt.ReadString(2),
+			content:      stmt.ReadString(3),
+			fromPlayerID: stmt.ReadInt32(4),
+			reason:       stmt.ReadString(5),
+		})
+	})
+	return
+}
+
+// releaseQuarantinedItem takes an item out of quarantine and returns it.
+func (ps *savefile) releaseQuarantinedItem(id int) (item quarantinedItem, err error) {
+	stmt := ps.db.Prepare("DELETE FROM mw_quarantined_items WHERE id = ? RETURNING id, ap_slot, label, content, from_player_id, reason")
+	defer stmt.Close()
+	stmt.BindInt(1, id)
+	err = execOnce(stmt, func() {
+		item = quarantinedItem{
+			id:           stmt.ReadInt32(0),
+			slot:         stmt.ReadInt32(1),
+			label:        stmt.ReadString(2),
+			content:      stmt.ReadString(3),
+			fromPlayerID: stmt.ReadInt32(4),
+			reason:       stmt.ReadString(5),
+		}
+	})
+	return
+}
+
+// getBinding returns what the savefile was made for, or errZeroRows if it
+// doesn't record that.
+func (ps *savefile) getBinding() (b savefileBinding, err error) {
+	stmt := ps.db.Prepare("SELECT seed_name, apfile_hash, mw_known, mw_server, mw_room FROM savefile_binding")
+	err = execOnce(stmt, func() {
+		b = savefileBinding{
+			seedName:   stmt.ReadString(0),
+			apfileHash: stmt.ReadString(1),
+			mwKnown:    stmt.ReadInt32(2) == 1,
+			mwServer:   stmt.ReadString(3),
+			mwRoom:     stmt.ReadString(4),
+		}
+	})
+	stmt.Close()
+	if err != nil {
+		return
+	}
+	b.slotNames = map[int]string{}
+	stmt = ps.db.Prepare("SELECT ap_slot, name FROM ap_slot_names")
+	err = exec(stmt, func() {
+		b.slotNames[stmt.ReadInt32(0)] = stmt.ReadString(1)
+	})
+	stmt.Close()
+	if err != nil {
+		return
+	}
+	b.mwGames = map[int]mwGameID{}
+	stmt = ps.db.Prepare("SELECT ap_slot, rando_id, hash FROM mw_game_binding")
+	defer stmt.Close()
+	err = exec(stmt, func() {
+		b.mwGames[stmt.ReadInt32(0)] = mwGameID{randoID: stmt.ReadInt32(1), hash: stmt.ReadString(2)}
+	})
+	return
+}
+
+// getMWGames returns the MW game each slot takes part in.
+func (ps *savefile) getMWGames() (games map[int]mwGameID, err error) {
+	stmt := ps.db.Prepare("SELECT ap_slot, rando_id, hash FROM mw_global_data")
+	defer stmt.Close()
+	games = map[int]mwGameID{}
+	err = exec(stmt, func() {
+		games[stmt.ReadInt32(0)] = mwGameID{randoID: stmt.ReadInt32(1), hash: stmt.ReadString(2)}
+	})
+	return
+}
+
+func (ps *savefile) setBinding(b savefileBinding) error {
+	return ps.transaction(func() error {
+		return setBinding(ps.db, b)
+	})
+}
+
+func setBinding(db *sqlite.DB, b savefileBinding) error {
+	if err := db.Exec("DELETE FROM savefile_binding; DELETE FROM ap_slot_names; DELETE FROM mw_game_binding"); err != nil {
+		return err
+	}
+	stmt := db.Prepare("INSERT INTO savefile_binding (seed_name, apfile_hash, mw_known, mw_server, mw_room) VALUES (?, ?, ?, ?, ?)")
+	defer stmt.Close()
+	stmt.BindString(1, b.seedName)
+	stmt.BindString(2, b.apfileHash)
+	mwKnown := 0
+	if b.mwKnown {
+		mwKnown = 1
+	}
+	stmt.BindInt(3, mwKnown)
+	stmt.BindString(4, b.mwServer)
+	stmt.BindString(5, b.mwRoom)
+	if err := stmt.Exec(); err != nil {
+		return err
+	}
+	stmt = db.Prepare("INSERT INTO ap_slot_names (ap_slot, name) VALUES (?, ?)")
+	defer stmt.Close()
+	for slot, name := range b.slotNames {
+		stmt.BindInt(1, slot)
+		stmt.BindString(2, name)
+		if err := stmt.Exec(); err != nil {
+			return err
+		}
+		if err := stmt.Reset(); err != nil {
+			return err
+		}
+	}
+	stmt = db.Prepare("INSERT INTO mw_game_binding (ap_slot, rando_id, hash) VALUES (?, ?, ?)")
+	defer stmt.Close()
+	for slot, game := range b.mwGames {
+		stmt.BindInt(1, slot)
+		stmt.BindInt(2, game.randoID)
+		stmt.BindString(3, game.hash)
+		if err := stmt.Exec(); err != nil {
+			return err
+		}
+		if err := stmt.Reset(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getAPData returns the seed's data as stored in the savefile, or errZeroRows
+// if it isn't.
+func (ps *savefile) getAPData() (data apdata, err error) {
+	var encoded []byte
+	stmt := ps.db.Prepare("SELECT json_data FROM ap_seed_data")
+	defer stmt.Close()
+	err = execOnce(stmt, func() {
+		encoded = stmt.ReadBytes(0)
+	})
+	if err != nil {
+		return
+	}
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	// Keep numbers in slot data and datapackages exactly as they were.
+	dec.UseNumber()
+	if err = dec.Decode(&data); err != nil {
+		err = fmt.Errorf("decode stored .archipelago data: %w", err)
+	}
+	return
+}
+
+func (ps *savefile) setAPData(data apdata) error {
+	return ps.transaction(func() error {
+		return setAPData(ps.db, data)
+	})
+}
+
+func setAPData(db *sqlite.DB, data apdata) error {
+	encoded, err := json.Marshal(storedAPData(data))
+	if err != nil {
+		return fmt.Errorf("encode .archipelago data: %w", err)
+	}
+	if err := db.Exec("DELETE FROM ap_seed_data"); err != nil {
+		return err
+	}
+	stmt := db.Prepare("INSERT INTO ap_seed_data (json_data) VALUES (?)")
+	defer stmt.Close()
+	stmt.BindBytes(1, encoded)
+	return stmt.Exec()
+}
+
 func (ps *savefile) close() {
 	ps.db.Close()
 }
 
-func openSavefile(loc string) (*savefile, error) {
+// openSavefile opens an existing savefile, upgrading it to the current
+// schema version first if it's older. Savefiles from before Isthmus could
+// serve several slots have all of their state assigned to the slot returned
+// by legacySlot, which is only called for those.
+func openSavefile(loc string, legacySlot func() (int, error)) (*savefile, error) {
 	db, err := sqlite.Open(loc)
 	if err != nil {
 		return nil, fmt.Errorf("open savefile: %w", err)
 	}
+	if err := migrateSavefile(db, legacySlot); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("open savefile: %w", err)
+	}
 	return &savefile{
 		db:                         db,
-		selectClearedLocationsStmt: db.Prepare("SELECT location_id FROM locations_cleared ORDER BY location_id"),
-		addClearedLocationStmt:     db.Prepare("INSERT INTO locations_cleared (location_id) VALUES (?)"),
-		isLocationClearedStmt:      db.Prepare("SELECT EXISTS(SELECT 1 FROM locations_cleared WHERE location_id = ?)"),
-		addSentItemStmt:            db.Prepare("INSERT INTO ap_sent_items (item_id, location_id, player_id, flags) VALUES (?, ?, ?, ?) RETURNING item_index"),
-		getSentItemsStmt:           db.Prepare("SELECT item_id, location_id, player_id, flags FROM ap_sent_items ORDER BY item_index"),
-		getUnconfirmedItemsStmt:    db.Prepare("SELECT label, content, dest_player_id FROM mw_unconfirmed_sent_items"),
-		addUnconfirmedItemStmt:     db.Prepare("INSERT INTO mw_unconfirmed_sent_items (label, content, dest_player_id) VALUES (?, ?, ?)"),
-		confirmItemStmt:            db.Prepare("DELETE FROM mw_unconfirmed_sent_items WHERE label = ? AND content = ? AND dest_player_id = ?"),
-		addReceivedItemStmt:        db.Prepare("INSERT INTO mw_received_items (label, content) VALUES (?, ?)"),
-		hasReceivedItemStmt:        db.Prepare("SELECT EXISTS(SELECT 1 FROM mw_received_items WHERE label = ? AND content = ?)"),
+		selectClearedLocationsStmt: db.Prepare("SELECT location_id FROM locations_cleared WHERE ap_slot = ? ORDER BY location_id"),
+		addClearedLocationStmt:     db.Prepare("INSERT INTO locations_cleared (ap_slot, location_id) VALUES (?, ?)"),
+		isLocationClearedStmt:      db.Prepare("SELECT EXISTS(SELECT 1 FROM locations_cleared WHERE ap_slot = ? AND location_id = ?)"),
+		addSentItemStmt:            db.Prepare("INSERT INTO ap_sent_items (ap_slot, item_index, item_id, location_id, player_id, flags) VALUES (?1, (SELECT COUNT(*) FROM ap_sent_items WHERE ap_slot = ?1), ?2, ?3, ?4, ?5) RETURNING item_index"),
+		getSentItemsStmt:           db.Prepare("SELECT item_id, location_id, player_id, flags FROM ap_sent_items WHERE ap_slot = ? AND item_index >= ? ORDER BY item_index"),
+		getUnconfirmedItemsStmt:    db.Prepare("SELECT label, content, dest_player_id FROM mw_unconfirmed_sent_items WHERE ap_slot = ?"),
+		addUnconfirmedItemStmt:     db.Prepare("INSERT INTO mw_unconfirmed_sent_items (ap_slot, label, content, dest_player_id) VALUES (?, ?, ?, ?)"),
+		confirmItemStmt:            db.Prepare("DELETE FROM mw_unconfirmed_sent_items WHERE ap_slot = ? AND label = ? AND content = ? AND dest_player_id = ?"),
+		addReceivedItemStmt:        db.Prepare("INSERT INTO mw_received_items (ap_slot, label, content) VALUES (?, ?, ?)"),
+		hasReceivedItemStmt:        db.Prepare("SELECT EXISTS(SELECT 1 FROM mw_received_items WHERE ap_slot = ? AND label = ? AND content = ?)"),
 		getStoredDataStmt:          db.Prepare("SELECT json_value FROM ap_data_storage WHERE key = ?"),
 		setStoredDataStmt:          db.Prepare("INSERT INTO ap_data_storage (key, json_value) VALUES (?, ?) ON CONFLICT DO UPDATE SET json_value = excluded.json_value"),
-		getLocationOfOwnItemStmt:   db.Prepare("SELECT location_name FROM mw_own_item_placements WHERE item_name = ?"),
-		getPlacedItemStmt:          db.Prepare("SELECT item_name, dest_player_id FROM mw_own_world_placements WHERE ap_location_id = ?"),
+		getLocationOfOwnItemStmt:   db.Prepare("SELECT location_name FROM mw_own_item_placements WHERE ap_slot = ? AND item_name = ?"),
+		getPlacedItemStmt:          db.Prepare("SELECT item_name, dest_player_id FROM mw_own_world_placements WHERE ap_slot = ? AND ap_location_id = ?"),
+		getContributedItemStmt:     db.Prepare("SELECT owner_slot, item_id, flags FROM ap_contributed_items WHERE ap_slot = ? AND item_name = ?"),
+		quarantineItemStmt:         db.Prepare("INSERT INTO mw_quarantined_items (ap_slot, label, content, from_player_id, reason) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING"),
 	}, nil
 }
 
-func createSavefile(loc string, result mwproto.ResultMessage, precollectedItems []int64) error {
-	db, err := sqlite.Open(loc)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
+const playerMetadataSchema = `
+CREATE TABLE IF NOT EXISTS mw_player_metadata (
+	player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
+	position INTEGER NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+
+	PRIMARY KEY (player_id, position)
+);
+`
+
+const syntheticGamesSchema = `
+CREATE TABLE IF NOT EXISTS ap_synthetic_games (
+	player_id INTEGER NOT NULL PRIMARY KEY REFERENCES mw_players (player_id),
+	game TEXT NOT NULL,
+	checksum TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS ap_synthetic_items (
+	player_id INTEGER NOT NULL REFERENCES ap_synthetic_games (player_id),
+	name TEXT NOT NULL,
+	id INTEGER NOT NULL,
+
+	PRIMARY KEY (player_id, name)
+);
+
+CREATE TABLE IF NOT EXISTS ap_synthetic_locations (
+	player_id INTEGER NOT NULL REFERENCES ap_synthetic_games (player_id),
+	name TEXT NOT NULL,
+	id INTEGER NOT NULL,
+
+	PRIMARY KEY (player_id, name)
+);
+`
+
+const spoilerPlacementsSchema = `
+CREATE TABLE IF NOT EXISTS mw_spoiler_placements (
+	location_player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
+	location_name TEXT NOT NULL,
+	item_player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
+	item_name TEXT NOT NULL,
+
+	PRIMARY KEY (location_player_id, location_name)
+);
+`
 
-	const savefileSchema = `
-PRAGMA foreign_keys = ON;
+const quarantinedItemsSchema = `
+CREATE TABLE IF NOT EXISTS mw_quarantined_items (
+	id INTEGER NOT NULL PRIMARY KEY,
+	ap_slot INTEGER NOT NULL,
+	label TEXT NOT NULL,
+	content TEXT NOT NULL,
+	from_player_id INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+
+	UNIQUE (ap_slot, label, content)
+);
+`
+
+// bindingSchema records what a savefile was made for; savefile_binding has
+// at most one row.
+const bindingSchema = `
+CREATE TABLE savefile_binding (
+	seed_name TEXT NOT NULL,
+	apfile_hash TEXT NOT NULL,
+	mw_known INTEGER NOT NULL,
+	mw_server TEXT NOT NULL,
+	mw_room TEXT NOT NULL
+);
 
+CREATE TABLE ap_slot_names (
+	ap_slot INTEGER NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL
+);
+`
+
+// mwGameBindingSchema records the MW game that each slot in a savefile was
+// made for.
+const mwGameBindingSchema = `
+CREATE TABLE mw_game_binding (
+	ap_slot INTEGER NOT NULL PRIMARY KEY,
+	rando_id INTEGER NOT NULL,
+	hash TEXT NOT NULL
+);
+`
+
+// apDataSchema holds what Isthmus needs of the .archipelago file, as JSON, in
+// its only row.
+const apDataSchema = `
+CREATE TABLE ap_seed_data (
+	json_data TEXT NOT NULL
+);
+`
+
+const savefileSchema = playerMetadataSchema + syntheticGamesSchema + spoilerPlacementsSchema + quarantinedItemsSchema + bindingSchema + mwGameBindingSchema + apDataSchema + perSlotSchema
+
+// perSlotSchema holds the tables that upgradeSingleSlotSavefile recreates.
+const perSlotSchema = `
 CREATE TABLE locations_cleared (
-	location_id INTEGER NOT NULL PRIMARY KEY
+	ap_slot INTEGER NOT NULL,
+	location_id INTEGER NOT NULL,
+
+	PRIMARY KEY (ap_slot, location_id)
 );
 
 CREATE TABLE mw_unconfirmed_sent_items (
+	ap_slot INTEGER NOT NULL,
 	label TEXT NOT NULL,
 	content TEXT NOT NULL,
 	dest_player_id INTEGER NOT NULL,
 
-	PRIMARY KEY (label, content, dest_player_id)
+	PRIMARY KEY (ap_slot, label, content, dest_player_id)
 );
 
 CREATE TABLE mw_received_items (
+	ap_slot INTEGER NOT NULL,
 	label TEXT NOT NULL,
 	content TEXT NOT NULL,
 
-	PRIMARY KEY (label, content)
+	PRIMARY KEY (ap_slot, label, content)
 );
 
 CREATE TABLE ap_sent_items (
-	item_index INTEGER NOT NULL PRIMARY KEY,
+	ap_slot INTEGER NOT NULL,
+	item_index INTEGER NOT NULL,
 	item_id INTEGER NOT NULL,
 	location_id INTEGER NOT NULL,
 	player_id INTEGER NOT NULL,
-	flags INTEGER NOT NULL
+	flags INTEGER NOT NULL,
+
+	PRIMARY KEY (ap_slot, item_index)
 );
 
 CREATE TABLE ap_data_storage (
@@ -443,6 +882,7 @@ CREATE TABLE mw_players (
 );
 
 CREATE TABLE mw_global_data (
+	ap_slot INTEGER NOT NULL PRIMARY KEY,
 	player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
 	rando_id INTEGER NOT NULL,
 	full_spoiler_log TEXT NOT NULL,
@@ -450,28 +890,376 @@ CREATE TABLE mw_global_data (
 );
 
 CREATE TABLE mw_own_world_placements (
-	ap_location_id INTEGER NOT NULL PRIMARY KEY,
+	ap_slot INTEGER NOT NULL,
+	ap_location_id INTEGER NOT NULL,
 	dest_player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
-	item_name TEXT NOT NULL
+	item_name TEXT NOT NULL,
+
+	PRIMARY KEY (ap_slot, ap_location_id)
 );
 
 CREATE TABLE mw_own_item_placements (
-	item_name TEXT NOT NULL PRIMARY KEY,
+	ap_slot INTEGER NOT NULL,
+	item_name TEXT NOT NULL,
 	source_player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
-	location_name TEXT NOT NULL
+	location_name TEXT NOT NULL,
+
+	PRIMARY KEY (ap_slot, item_name)
 );
 
-BEGIN;
+CREATE TABLE ap_contributed_items (
+	ap_slot INTEGER NOT NULL,
+	item_name TEXT NOT NULL,
+	owner_slot INTEGER NOT NULL,
+	item_id INTEGER NOT NULL,
+	flags INTEGER NOT NULL,
+
+	PRIMARY KEY (ap_slot, item_name)
+);
 `
-	if err := db.Exec(savefileSchema); err != nil {
+
+// savefileMigrations upgrade a savefile from each schema version to the
+// next; savefileVersion is the version that they bring it up to, and the one
+// that new savefiles are created at. Each one runs in a transaction together
+// with the change to the version, which is kept in PRAGMA user_version.
+//
+// Savefiles from before versions were recorded are at version 0, but may
+// have had any of the first migrations applied already, so those work out
+// for themselves whether they're needed. New migrations should be added at
+// the end, and can assume that all of the previous ones have run.
+var savefileMigrations = []func(db *sqlite.DB, legacySlot func() (int, error)) error{
+	upgradeSingleSlotSavefile,
+	func(db *sqlite.DB, _ func() (int, error)) error { return db.Exec(playerMetadataSchema) },
+	func(db *sqlite.DB, _ func() (int, error)) error { return upgradeSyntheticGames(db) },
+	func(db *sqlite.DB, _ func() (int, error)) error { return upgradeSpoilerPlacements(db) },
+	func(db *sqlite.DB, _ func() (int, error)) error { return db.Exec(quarantinedItemsSchema) },
+	// Savefiles from before this are bound to whatever they're next opened
+	// with.
+	func(db *sqlite.DB, _ func() (int, error)) error { return db.Exec(bindingSchema) },
+	// Likewise, savefiles from before this store the seed's data the next
+	// time they're played.
+	func(db *sqlite.DB, _ func() (int, error)) error { return db.Exec(apDataSchema) },
+	// Savefiles from before this have their slots' MW games bound the next
+	// time they're played.
+	func(db *sqlite.DB, _ func() (int, error)) error { return db.Exec(mwGameBindingSchema) },
+}
+
+var savefileVersion = len(savefileMigrations)
+
+func migrateSavefile(db *sqlite.DB, legacySlot func() (int, error)) error {
+	version, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > savefileVersion {
+		return fmt.Errorf("savefile was made by a newer version of Isthmus (schema version %d, but this one only supports up to %d)", version, savefileVersion)
+	}
+	for ; version < savefileVersion; version++ {
+		if err := db.Exec("BEGIN"); err != nil {
+			return err
+		}
+		if err := savefileMigrations[version](db, legacySlot); err != nil {
+			db.Exec("ROLLBACK")
+			return fmt.Errorf("upgrade to schema version %d: %w", version+1, err)
+		}
+		if err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d;\nCOMMIT", version+1)); err != nil {
+			db.Exec("ROLLBACK")
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaVersion(db *sqlite.DB) (version int, err error) {
+	stmt := db.Prepare("PRAGMA user_version")
+	defer stmt.Close()
+	err = execOnce(stmt, func() {
+		version = stmt.ReadInt32(0)
+	})
+	return
+}
+
+// upgradeSingleSlotSavefile converts a savefile without per-slot state, if
+// that's what db is, into the per-slot layout.
+func upgradeSingleSlotSavefile(db *sqlite.DB, legacySlot func() (int, error)) error {
+	stmt := db.Prepare("SELECT COUNT(*) FROM pragma_table_info('mw_global_data') WHERE name = 'ap_slot'")
+	var upgraded bool
+	err := execOnce(stmt, func() {
+		upgraded = stmt.ReadInt32(0) == 1
+	})
+	stmt.Close()
+	if err != nil || upgraded {
+		return err
+	}
+	slot, err := legacySlot()
+	if err != nil {
+		return err
+	}
+	for _, table := range singleSlotTables {
+		if err := db.Exec(fmt.Sprintf("ALTER TABLE %[1]s RENAME TO old_%[1]s", table)); err != nil {
+			return err
+		}
+	}
+	// ap_sent_items used to rely on rowids starting at 1 for its indices.
+	migration := perSlotSchema + fmt.Sprintf(`
+INSERT INTO ap_data_storage SELECT key, json_value FROM old_ap_data_storage;
+INSERT INTO mw_players SELECT player_id, nickname, spoiler_log FROM old_mw_players;
+INSERT INTO locations_cleared SELECT %[1]d, location_id FROM old_locations_cleared;
+INSERT INTO mw_unconfirmed_sent_items SELECT %[1]d, label, content, dest_player_id FROM old_mw_unconfirmed_sent_items;
+INSERT INTO mw_received_items SELECT %[1]d, label, content FROM old_mw_received_items;
+INSERT INTO ap_sent_items SELECT %[1]d, item_index - 1, item_id, location_id, player_id, flags FROM old_ap_sent_items;
+INSERT INTO mw_global_data SELECT %[1]d, player_id, rando_id, full_spoiler_log, hash FROM old_mw_global_data;
+INSERT INTO mw_own_world_placements SELECT %[1]d, ap_location_id, dest_player_id, item_name FROM old_mw_own_world_placements;
+INSERT INTO mw_own_item_placements SELECT %[1]d, item_name, source_player_id, location_name FROM old_mw_own_item_placements;
+`, slot)
+	for _, table := range singleSlotTables {
+		migration += fmt.Sprintf("DROP TABLE old_%s;\n", table)
+	}
+	return db.Exec(migration)
+}
+
+func tableExists(db *sqlite.DB, name string) (exists bool, err error) {
+	stmt := db.Prepare("SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)")
+	defer stmt.Close()
+	stmt.BindString(1, name)
+	err = execOnce(stmt, func() {
+		exists = stmt.ReadInt32(0) == 1
+	})
+	return
+}
+
+// upgradeSyntheticGames stores the made-up games of a savefile from before
+// they were kept in it, numbered the same way they were then, so that the
+// IDs that clients have already seen don't change.
+func upgradeSyntheticGames(db *sqlite.DB) error {
+	exists, err := tableExists(db, "ap_synthetic_games")
+	if err != nil || exists {
+		return err
+	}
+	if err := db.Exec(syntheticGamesSchema); err != nil {
+		return err
+	}
+	return addSyntheticGames(db, true)
+}
+
+// upgradeSpoilerPlacements fills in the placements of a savefile from before
+// its spoiler logs were parsed.
+func upgradeSpoilerPlacements(db *sqlite.DB) error {
+	exists, err := tableExists(db, "mw_spoiler_placements")
+	if err != nil || exists {
+		return err
+	}
+	if err := db.Exec(spoilerPlacementsSchema); err != nil {
+		return err
+	}
+	return addSpoilerPlacements(db)
+}
+
+// addSpoilerPlacements parses the spoiler logs stored in the savefile into
+// placements. The full log should cover every world, but the individual ones
+// are read too, in case it doesn't.
+func addSpoilerPlacements(db *sqlite.DB) error {
+	nicknames, err := (&savefile{db: db}).getNicknames()
+	if err != nil {
+		return err
+	}
+	var logs []string
+	stmt := db.Prepare("SELECT DISTINCT full_spoiler_log FROM mw_global_data UNION ALL SELECT spoiler_log FROM mw_players")
+	err = exec(stmt, func() {
+		logs = append(logs, stmt.ReadString(0))
+	})
+	stmt.Close()
+	if err != nil {
+		return err
+	}
+
+	stmt = db.Prepare("INSERT INTO mw_spoiler_placements (location_player_id, location_name, item_player_id, item_name) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING")
+	defer stmt.Close()
+	unparsedLines := 0
+	for _, spoiler := range logs {
+		entries, unparsed := mwproto.ParseSpoilerLog(spoiler, nicknames)
+		unparsedLines += len(unparsed)
+		for _, e := range entries {
+			stmt.BindInt(1, e.LocationOwner)
+			stmt.BindString(2, e.Location)
+			stmt.BindInt(3, e.ItemOwner)
+			stmt.BindString(4, e.Item)
+			if err := stmt.Exec(); err != nil {
+				return err
+			}
+			if err := stmt.Reset(); err != nil {
+				return err
+			}
+		}
+	}
+	if unparsedLines > 0 {
+		log.Printf("could not read %d lines of the MW spoiler logs", unparsedLines)
+	}
+	return nil
+}
+
+// addSyntheticGames makes up an AP game for the world of each MW player that
+// isn't one of ours, with IDs for every item and location we know of in it.
+// Each world's items and locations are numbered from 1, and include those
+// from the spoiler logs, unless sharedIDs is set, in which case only those
+// involving our own worlds are included, numbered across all worlds as in
+// older versions.
+func addSyntheticGames(db *sqlite.DB, sharedIDs bool) error {
+	ps := &savefile{db: db}
+	nicknames, err := ps.getNicknames()
+	if err != nil {
 		return err
 	}
+	slots, err := ps.getSlots()
+	if err != nil {
+		return err
+	}
+	local := map[int]bool{}
+	for _, params := range slots {
+		local[params.playerID] = true
+	}
+	packages := map[int]*approto.DataPackage{}
+	for i := range nicknames {
+		if !local[i] {
+			packages[i] = &approto.DataPackage{
+				ItemNameToID:     map[string]int64{},
+				LocationNameToID: map[string]int64{},
+			}
+		}
+	}
+
+	nextItemIDs := map[int]int64{}
+	nextLocationIDs := map[int]int64{}
+	nextID := func(next map[int]int64, playerID int) int64 {
+		if sharedIDs {
+			playerID = -1
+		}
+		next[playerID]++
+		return next[playerID]
+	}
+	for p, err := range ps.getOwnWorldPlacements() {
+		if err != nil {
+			return err
+		}
+		dp, ok := packages[p.ownerID]
+		if !ok {
+			continue
+		}
+		name := prettifyName(p.name)
+		if _, ok := dp.ItemNameToID[name]; !ok {
+			dp.ItemNameToID[name] = nextID(nextItemIDs, p.ownerID)
+		}
+	}
+	for loc, err := range ps.getOwnItemLocations() {
+		if err != nil {
+			return err
+		}
+		dp, ok := packages[loc.playerID]
+		if !ok {
+			continue
+		}
+		if _, ok := dp.LocationNameToID[loc.name]; !ok {
+			dp.LocationNameToID[loc.name] = nextID(nextLocationIDs, loc.playerID)
+		}
+	}
+	if !sharedIDs {
+		for e, err := range ps.getSpoilerPlacements() {
+			if err != nil {
+				return err
+			}
+			if dp, ok := packages[e.LocationOwner]; ok {
+				if _, ok := dp.LocationNameToID[e.Location]; !ok {
+					dp.LocationNameToID[e.Location] = nextID(nextLocationIDs, e.LocationOwner)
+				}
+			}
+			if dp, ok := packages[e.ItemOwner]; ok {
+				name := prettifyName(e.Item)
+				if _, ok := dp.ItemNameToID[name]; !ok {
+					dp.ItemNameToID[name] = nextID(nextItemIDs, e.ItemOwner)
+				}
+			}
+		}
+	}
 
+	gameStmt := db.Prepare("INSERT INTO ap_synthetic_games (player_id, game, checksum) VALUES (?, ?, ?)")
+	defer gameStmt.Close()
+	itemStmt := db.Prepare("INSERT INTO ap_synthetic_items (player_id, name, id) VALUES (?, ?, ?)")
+	defer itemStmt.Close()
+	locationStmt := db.Prepare("INSERT INTO ap_synthetic_locations (player_id, name, id) VALUES (?, ?, ?)")
+	defer locationStmt.Close()
+	insert := func(stmt *sqlite.Statement, playerID int, name string, id int64) error {
+		stmt.BindInt(1, playerID)
+		stmt.BindString(2, name)
+		stmt.BindInt64(3, id)
+		if err := stmt.Exec(); err != nil {
+			return err
+		}
+		return stmt.Reset()
+	}
+	for pid, dp := range packages {
+		dp.SetChecksum()
+		gameStmt.BindInt(1, pid)
+		gameStmt.BindString(2, fmt.Sprintf("%s's World", nicknames[pid]))
+		gameStmt.BindString(3, dp.Checksum)
+		if err := gameStmt.Exec(); err != nil {
+			return err
+		}
+		if err := gameStmt.Reset(); err != nil {
+			return err
+		}
+		for name, id := range dp.ItemNameToID {
+			if err := insert(itemStmt, pid, name, id); err != nil {
+				return err
+			}
+		}
+		for name, id := range dp.LocationNameToID {
+			if err := insert(locationStmt, pid, name, id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var singleSlotTables = []string{
+	"locations_cleared",
+	"mw_unconfirmed_sent_items",
+	"mw_received_items",
+	"ap_sent_items",
+	"ap_data_storage",
+	"mw_players",
+	"mw_global_data",
+	"mw_own_world_placements",
+	"mw_own_item_placements",
+}
+
+// createSavefile creates a savefile for the given MW results, one for each
+// AP slot in data, bound to b.
+func createSavefile(loc string, results mwResults, data apdata, b savefileBinding) error {
+	db, err := sqlite.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Exec(fmt.Sprintf("PRAGMA foreign_keys = ON;\nPRAGMA user_version = %d;\n%sBEGIN;", savefileVersion, savefileSchema)); err != nil {
+		return err
+	}
+
+	var nicknames []string
+	var spoilers mwproto.SpoilerLogs
+	var metadata [][]mwproto.KeyValuePair
+	for _, res := range results {
+		nicknames = res.Nicknames
+		spoilers = res.ItemsSpoiler
+		metadata = res.ReadyMetadata
+		break
+	}
 	stmt := db.Prepare("INSERT INTO mw_players (player_id, nickname, spoiler_log) VALUES (?, ?, ?)")
-	for i, name := range result.Nicknames {
+	for i, name := range nicknames {
 		stmt.BindInt(1, i)
 		stmt.BindString(2, name)
-		stmt.BindString(3, result.ItemsSpoiler.IndividualWorldSpoilers[name])
+		stmt.BindString(3, spoilers.IndividualWorldSpoilers[name])
 		if err := stmt.Exec(); err != nil {
 			return err
 		}
@@ -481,11 +1269,58 @@ BEGIN;
 	}
 	stmt.Close()
 
-	stmt = db.Prepare("INSERT INTO mw_global_data (player_id, rando_id, full_spoiler_log, hash) VALUES (?, ?, ?, ?)")
-	stmt.BindInt(1, int(result.PlayerID))
-	stmt.BindInt(2, int(result.RandoID))
-	stmt.BindString(3, result.ItemsSpoiler.FullOrderedItemsLog)
-	stmt.BindString(4, result.GeneratedHash)
+	stmt = db.Prepare("INSERT INTO mw_player_metadata (player_id, position, key, value) VALUES (?, ?, ?, ?)")
+	for i, kvs := range metadata {
+		if i >= len(nicknames) {
+			break
+		}
+		for j, kv := range kvs {
+			stmt.BindInt(1, i)
+			stmt.BindInt(2, j)
+			stmt.BindString(3, kv.Key)
+			stmt.BindString(4, kv.Value)
+			if err := stmt.Exec(); err != nil {
+				return err
+			}
+			if err := stmt.Reset(); err != nil {
+				return err
+			}
+		}
+	}
+	stmt.Close()
+
+	for slot, result := range results {
+		if err := insertSlotResult(db, slot, result, data); err != nil {
+			return fmt.Errorf("slot %d: %w", slot, err)
+		}
+	}
+	if err := addSpoilerPlacements(db); err != nil {
+		return err
+	}
+	if err := addSyntheticGames(db, false); err != nil {
+		return err
+	}
+	b.mwGames = map[int]mwGameID{}
+	for slot, res := range results {
+		b.mwGames[slot] = mwGameID{randoID: int(res.RandoID), hash: res.GeneratedHash}
+	}
+	if err := setBinding(db, b); err != nil {
+		return err
+	}
+	if err := setAPData(db, data); err != nil {
+		return err
+	}
+
+	return db.Exec("COMMIT")
+}
+
+func insertSlotResult(db *sqlite.DB, slot int, result mwproto.ResultMessage, data apdata) error {
+	stmt := db.Prepare("INSERT INTO mw_global_data (ap_slot, player_id, rando_id, full_spoiler_log, hash) VALUES (?, ?, ?, ?, ?)")
+	stmt.BindInt(1, slot)
+	stmt.BindInt(2, int(result.PlayerID))
+	stmt.BindInt(3, int(result.RandoID))
+	stmt.BindString(4, result.ItemsSpoiler.FullOrderedItemsLog)
+	stmt.BindString(5, result.GeneratedHash)
 	if err := stmt.Exec(); err != nil {
 		return err
 	}
@@ -494,8 +1329,12 @@ BEGIN;
 	}
 	stmt.Close()
 
-	stmt = db.Prepare("INSERT INTO mw_own_world_placements (ap_location_id, dest_player_id, item_name) VALUES (?, ?, ?)")
-	for _, p := range result.Placements[singularItemGroup] {
+	stmt = db.Prepare("INSERT INTO mw_own_world_placements (ap_slot, ap_location_id, dest_player_id, item_name) VALUES (?, ?, ?, ?)")
+	var placements []mwproto.ResultPlacement
+	for _, group := range slices.Sorted(maps.Keys(result.Placements)) {
+		placements = append(placements, result.Placements[group]...)
+	}
+	for _, p := range placements {
 		locID, ok := mwproto.ParseDiscriminator(p.Location)
 		if !ok {
 			return fmt.Errorf("location without discriminator: %s", p.Location)
@@ -504,9 +1343,10 @@ BEGIN;
 		if !ok {
 			return fmt.Errorf("item without qualifier: %s", p.Item)
 		}
-		stmt.BindInt64(1, locID)
-		stmt.BindInt(2, pid)
-		stmt.BindString(3, item)
+		stmt.BindInt(1, slot)
+		stmt.BindInt64(2, locID)
+		stmt.BindInt(3, pid)
+		stmt.BindString(4, item)
 		if err := stmt.Exec(); err != nil {
 			return err
 		}
@@ -516,15 +1356,16 @@ BEGIN;
 	}
 	stmt.Close()
 
-	stmt = db.Prepare("INSERT INTO mw_own_item_placements (item_name, location_name, source_player_id) VALUES (?, ?, ?)")
+	stmt = db.Prepare("INSERT INTO mw_own_item_placements (ap_slot, item_name, location_name, source_player_id) VALUES (?, ?, ?, ?)")
 	for item, loc := range result.PlayerItemsPlacements {
 		pid, locName, ok := mwproto.ParseQualifiedName(loc)
 		if !ok {
 			return fmt.Errorf("location without qualifier: %s", loc)
 		}
-		stmt.BindString(1, item)
-		stmt.BindString(2, locName)
-		stmt.BindInt(3, pid)
+		stmt.BindInt(1, slot)
+		stmt.BindString(2, item)
+		stmt.BindString(3, locName)
+		stmt.BindInt(4, pid)
 		if err := stmt.Exec(); err != nil {
 			return err
 		}
@@ -534,12 +1375,52 @@ BEGIN;
 	}
 	stmt.Close()
 
-	stmt = db.Prepare("INSERT INTO ap_sent_items (item_id, location_id, player_id, flags) VALUES (?, ?, ?, ?)")
-	for _, item := range precollectedItems {
-		stmt.BindInt64(1, item)
-		stmt.BindInt64(2, approto.ServerLocation)
-		stmt.BindInt(3, approto.ServerSlot)
-		stmt.BindInt(4, 0)
+	if len(result.Placements) > 0 {
+		// Neither the group each item was sent in nor whether its name was
+		// tagged with its game affects its discriminator, by which the items
+		// we sent are matched up with their names as they were sent.
+		_, contributed, _, err := apToMWPlacements(data, slot, nil, false)
+		if err != nil {
+			return err
+		}
+		byDiscriminator := map[int64]apItem{}
+		for name, item := range contributed {
+			d, _ := mwproto.ParseDiscriminator(name)
+			byDiscriminator[d] = item
+		}
+		stmt = db.Prepare("INSERT INTO ap_contributed_items (ap_slot, item_name, owner_slot, item_id, flags) VALUES (?, ?, ?, ?, ?)")
+		for name := range result.PlayerItemsPlacements {
+			d, ok := mwproto.ParseDiscriminator(name)
+			if !ok {
+				return fmt.Errorf("item without discriminator: %s", name)
+			}
+			item, ok := byDiscriminator[d]
+			if !ok {
+				return fmt.Errorf("item not placed by AP: %s", name)
+			}
+			stmt.BindInt(1, slot)
+			stmt.BindString(2, name)
+			stmt.BindInt(3, item.ownerSlot)
+			stmt.BindInt64(4, item.id)
+			stmt.BindInt(5, item.flags)
+			if err := stmt.Exec(); err != nil {
+				return err
+			}
+			if err := stmt.Reset(); err != nil {
+				return err
+			}
+		}
+		stmt.Close()
+	}
+
+	stmt = db.Prepare("INSERT INTO ap_sent_items (ap_slot, item_index, item_id, location_id, player_id, flags) VALUES (?, ?, ?, ?, ?, ?)")
+	for i, item := range data.PrecollectedItems[slot] {
+		stmt.BindInt(1, slot)
+		stmt.BindInt(2, i)
+		stmt.BindInt64(3, item)
+		stmt.BindInt64(4, approto.ServerLocation)
+		stmt.BindInt(5, approto.ServerSlot)
+		stmt.BindInt(6, 0)
 		if err := stmt.Exec(); err != nil {
 			return err
 		}
@@ -547,6 +1428,6 @@ BEGIN;
 			return err
 		}
 	}
-
-	return db.Exec("COMMIT")
+	stmt.Close()
+	return nil
 }
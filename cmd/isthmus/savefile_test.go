@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/mwproto"
+	"github.com/dpinela/mmm/internal/sqlite"
+)
+
+// legacySavefile is a savefile as made by Isthmus before schema versions
+// were recorded, when it served a single slot, with our player (Bob) having
+// checked one location, sent two items to AP, and one item to Alice that
+// hasn't been confirmed yet.
+const legacySavefile = `
+CREATE TABLE locations_cleared (
+	location_id INTEGER NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE mw_unconfirmed_sent_items (
+	label TEXT NOT NULL,
+	content TEXT NOT NULL,
+	dest_player_id INTEGER NOT NULL,
+
+	PRIMARY KEY (label, content, dest_player_id)
+);
+
+CREATE TABLE mw_received_items (
+	label TEXT NOT NULL,
+	content TEXT NOT NULL,
+
+	PRIMARY KEY (label, content)
+);
+
+CREATE TABLE ap_sent_items (
+	item_index INTEGER NOT NULL PRIMARY KEY,
+	item_id INTEGER NOT NULL,
+	location_id INTEGER NOT NULL,
+	player_id INTEGER NOT NULL,
+	flags INTEGER NOT NULL
+);
+
+CREATE TABLE ap_data_storage (
+	key TEXT NOT NULL,
+	json_value TEXT NOT NULL,
+
+	PRIMARY KEY (key)
+);
+
+CREATE TABLE mw_players (
+	player_id INTEGER NOT NULL PRIMARY KEY,
+	nickname TEXT NOT NULL,
+	spoiler_log TEXT NOT NULL
+);
+
+CREATE TABLE mw_global_data (
+	player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
+	rando_id INTEGER NOT NULL,
+	full_spoiler_log TEXT NOT NULL,
+	hash TEXT NOT NULL
+);
+
+CREATE TABLE mw_own_world_placements (
+	ap_location_id INTEGER NOT NULL PRIMARY KEY,
+	dest_player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
+	item_name TEXT NOT NULL
+);
+
+CREATE TABLE mw_own_item_placements (
+	item_name TEXT NOT NULL PRIMARY KEY,
+	source_player_id INTEGER NOT NULL REFERENCES mw_players (player_id),
+	location_name TEXT NOT NULL
+);
+
+INSERT INTO mw_players VALUES (0, 'Alice', ''), (1, 'Bob', '');
+INSERT INTO mw_global_data VALUES (1, 42, 'Alice''s Lantern at Bob''s Crossroads_(3)
+Bob''s Grub at Alice''s Well
+', 'hash');
+INSERT INTO mw_own_world_placements VALUES (100, 0, 'Lantern_(3)'), (101, 1, 'Grub_(4)');
+INSERT INTO mw_own_item_placements VALUES ('Grub_(4)', 0, 'Well_(9)');
+INSERT INTO locations_cleared VALUES (100);
+INSERT INTO ap_sent_items VALUES (1, 7, 101, 1, 0), (2, 8, -2, 0, 0);
+INSERT INTO mw_unconfirmed_sent_items VALUES ('MultiWorld-Item', 'Lantern_(3)', 0);
+INSERT INTO mw_received_items VALUES ('MultiWorld-Item', 'Grub_(4)');
+INSERT INTO ap_data_storage VALUES ('key', '"value"');
+`
+
+const legacySlot = 3
+
+func createLegacySavefile(t *testing.T) string {
+	name := filepath.Join(t.TempDir(), "legacy.isthmus")
+	db, err := sqlite.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := db.Exec(legacySavefile); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func openTestSavefile(t *testing.T, name string, legacySlot func() (int, error)) *savefile {
+	ps, err := openSavefile(name, legacySlot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ps.close)
+	return ps
+}
+
+func TestMigrateLegacySavefile(t *testing.T) {
+	ps := openTestSavefile(t, createLegacySavefile(t), func() (int, error) { return legacySlot, nil })
+	checkMigratedLegacySavefile(t, ps)
+}
+
+// Savefiles at version 0 may already have the per-slot layout and the other
+// early migrations, which must then be left as they are.
+func TestMigrateUnversionedSavefile(t *testing.T) {
+	name := createLegacySavefile(t)
+	ps, err := openSavefile(name, func() (int, error) { return legacySlot, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ps.db.Exec("DROP TABLE savefile_binding; DROP TABLE ap_slot_names; DROP TABLE mw_game_binding; DROP TABLE ap_seed_data; PRAGMA user_version = 0")
+	ps.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps = openTestSavefile(t, name, func() (int, error) {
+		return 0, errors.New("legacySlot called for a savefile that is already per-slot")
+	})
+	checkMigratedLegacySavefile(t, ps)
+}
+
+func checkMigratedLegacySavefile(t *testing.T, ps *savefile) {
+	t.Helper()
+	if version, err := schemaVersion(ps.db); err != nil || version != savefileVersion {
+		t.Fatalf("savefile is at version %d (%v), want %d", version, err, savefileVersion)
+	}
+
+	slots, err := ps.getSlots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int]slotParams{legacySlot: {playerID: 1, randoID: 42}}; !reflect.DeepEqual(slots, want) {
+		t.Errorf("slots are %v, want %v", slots, want)
+	}
+	if cleared, err := ps.clearedLocations(legacySlot); err != nil || !slices.Equal(cleared, []int64{100}) {
+		t.Errorf("cleared locations are %v (%v), want [100]", cleared, err)
+	}
+	sent, err := ps.getSentItems(legacySlot, 0)
+	wantSent := []approto.NetworkItem{{Item: 7, Location: 101, Player: 1}, {Item: 8, Location: -2, Player: 0}}
+	if err != nil || !reflect.DeepEqual(sent, wantSent) {
+		t.Errorf("sent items are %v (%v), want %v", sent, err, wantSent)
+	}
+	unconfirmed, err := ps.getUnconfirmedItems(legacySlot)
+	wantUnconfirmed := []mwproto.DataSendMessage{{Label: "MultiWorld-Item", Content: "Lantern_(3)", To: 0, TTL: sentItemTTL}}
+	if err != nil || !reflect.DeepEqual(unconfirmed, wantUnconfirmed) {
+		t.Errorf("unconfirmed items are %v (%v), want %v", unconfirmed, err, wantUnconfirmed)
+	}
+	if received, err := ps.hasReceivedItem(legacySlot, "MultiWorld-Item", "Grub_(4)"); err != nil || !received {
+		t.Errorf("received item was lost (%v)", err)
+	}
+	if data, found, err := ps.getStoredData("key"); err != nil || !found || string(data) != `"value"` {
+		t.Errorf("stored data is %s, %v (%v)", data, found, err)
+	}
+
+	var placements []mwproto.SpoilerEntry
+	for e, err := range ps.getSpoilerPlacements() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		placements = append(placements, e)
+	}
+	wantPlacements := []mwproto.SpoilerEntry{
+		{ItemOwner: 1, Item: "Grub", LocationOwner: 0, Location: "Well"},
+		{ItemOwner: 0, Item: "Lantern", LocationOwner: 1, Location: "Crossroads_(3)"},
+	}
+	if !reflect.DeepEqual(placements, wantPlacements) {
+		t.Errorf("spoiler placements are %v, want %v", placements, wantPlacements)
+	}
+
+	games, err := ps.getSyntheticGames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, ok := games[0]
+	if len(games) != 1 || !ok {
+		t.Fatalf("synthetic games are %v, want one for Alice", games)
+	}
+	if alice.name != "Alice's World" || len(alice.datapackage.ItemNameToID) != 1 || len(alice.datapackage.LocationNameToID) != 1 {
+		t.Errorf("Alice's synthetic game is %s, with items %v and locations %v", alice.name, alice.datapackage.ItemNameToID, alice.datapackage.LocationNameToID)
+	}
+
+	// Savefiles from before bindings and stored seed data get them the next
+	// time they're played.
+	if b, err := ps.getBinding(); err != errZeroRows {
+		t.Errorf("savefile is bound to %+v (%v)", b, err)
+	}
+	if _, err := ps.getAPData(); err != errZeroRows {
+		t.Errorf("savefile has seed data (%v)", err)
+	}
+}
+
+func TestOpenNewerSavefile(t *testing.T) {
+	name := createLegacySavefile(t)
+	db, err := sqlite.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Exec(fmt.Sprintf("PRAGMA user_version = %d", savefileVersion+1))
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ps, err := openSavefile(name, func() (int, error) { return legacySlot, nil }); err == nil {
+		ps.close()
+		t.Fatal("savefile from a newer version was opened")
+	}
+}
@@ -1,112 +1,275 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"maps"
+	"math"
+	"slices"
+	"time"
 
 	"github.com/dpinela/mmm/internal/mwproto"
 )
 
+// setupMW joins the room with one MW player for each AP slot in data, and
+// creates the savefile once the MW server has shuffled all of their worlds.
+// Each slot's result is added to the result file as soon as it arrives, so
+// that it isn't lost if another slot's setup fails.
 func setupMW(opts options, data apdata) error {
-	if len(data.SlotInfo) != 1 {
-		return fmt.Errorf(".archipelago contains %d slots, expected only one", len(data.SlotInfo))
+	slots := playerSlots(data)
+	if opts.mwnick != "" && len(slots) != 1 {
+		return fmt.Errorf("-mwnick can't be used with .archipelago files containing %d slots", len(slots))
+	}
+	if !(opts.mwseed >= math.MinInt32 && opts.mwseed <= math.MaxInt32) {
+		return fmt.Errorf("MW seed out of range: %d", opts.mwseed)
+	}
+	players := make([]mwSetupPlayer, len(slots))
+	for i, slotID := range slots {
+		nickname := opts.mwnick
+		if nickname == "" {
+			nickname = data.SlotInfo[slotID].Name
+		}
+		mwPlacements, _, report, err := apToMWPlacements(data, slotID, opts.mwgroups, opts.mwgamenames)
+		if err != nil {
+			return fmt.Errorf("convert AP to MW for slot %d: %w", slotID, err)
+		}
+		if s := report.String(); s != "" {
+			log.Printf("slot %d (%s): %s", slotID, data.SlotInfo[slotID].Name, s)
+		}
+		metadata, err := peerMetadata(data, slotID, mwPlacements)
+		if err != nil {
+			return err
+		}
+		players[i] = mwSetupPlayer{
+			slot: slotID,
+			ready: mwproto.ReadyMessage{
+				Room:          opts.mwroom,
+				Nickname:      nickname,
+				ReadyMetadata: slices.Concat(opts.mwmetadata, metadata),
+			},
+			rando: mwproto.RandoGeneratedMessage{
+				Items: mwPlacements,
+				Seed:  int32(opts.mwseed),
+			},
+		}
 	}
-	slotID := singularKey(data.SlotInfo)
-	slot := data.SlotInfo[slotID]
-	nickname := slot.Name
 
-	mwPlacements, err := apToMWPlacements(data)
+	b, err := newSavefileBinding(opts.apfile, data)
 	if err != nil {
-		return fmt.Errorf("convert AP to MW: %w", err)
+		return err
+	}
+	saved := savedMWResults{
+		SeedName: data.SeedName,
+		MWServer: opts.mwserver,
+		MWRoom:   opts.mwroom,
+		Frames:   map[int][]byte{},
+	}
+	save := func(slot int, frame []byte) error {
+		saved.Frames[slot] = frame
+		return writeMWResults(opts.mwResultFile(), saved)
+	}
+	for attempt := 0; ; attempt++ {
+		err := runMWSetup(opts, players, save)
+		if err == nil {
+			results, err := saved.results()
+			if err != nil {
+				return err
+			}
+			return createSavefile(opts.savefile, results, data, b.withMW(opts))
+		}
+		if len(saved.Frames) > 0 {
+			// The shuffle those results came from can't be joined again,
+			// so the other slots can't take part in it any more.
+			return fmt.Errorf("%w; results for slots %v were saved to %s, and the savefile will be created from them the next time Isthmus is started", err, slices.Sorted(maps.Keys(saved.Frames)), opts.mwResultFile())
+		}
+		if !(isRetryableSetupError(err) && attempt < opts.mwretries) {
+			return err
+		}
+		log.Printf("%v; retrying in %v (%d/%d)", err, setupRetryDelay, attempt+1, opts.mwretries)
+		time.Sleep(setupRetryDelay)
 	}
+}
 
-	conn, err := mwproto.Dial(opts.mwserver)
-	if err != nil {
-		return fmt.Errorf("connect to MW: %w", err)
+// slotsWithoutResults returns the player slots in data that res has no result
+// for, in order.
+func slotsWithoutResults(data apdata, res mwResults) []int {
+	var missing []int
+	for _, slot := range playerSlots(data) {
+		if _, ok := res[slot]; !ok {
+			missing = append(missing, slot)
+		}
 	}
-	defer conn.Close()
-	inbox := conn.Inbox()
+	return missing
+}
 
-	conn.Send(mwproto.ConnectMessage{})
+// An mwSetupPlayer is what is needed to take part in the MW shuffle on behalf
+// of an AP slot.
+type mwSetupPlayer struct {
+	slot  int
+	ready mwproto.ReadyMessage
+	rando mwproto.RandoGeneratedMessage
+}
 
-	for {
-		msg, ok := <-inbox
-		if !ok {
-			return errConnectionLost
+// runMWSetup joins the room once for each player, then waits for all of them
+// to be shuffled, passing each player's result to save, as the frame it was
+// received in, as soon as it arrives. If any of them fails, the whole setup
+// does, but the results already saved are kept.
+func runMWSetup(opts options, players []mwSetupPlayer, save func(slot int, frame []byte) error) error {
+	var (
+		sessions = make([]*mwproto.Session, len(players))
+		frames   = make([][]byte, len(players))
+		conns    = make([]*mwproto.Client, 0, len(players))
+		starter  *autoStarter
+		names    []string
+	)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
 		}
-		if c, ok := msg.(mwproto.ConnectMessage); ok {
-			log.Println("connected to", c.ServerName)
-			break
+	}()
+	for i, p := range players {
+		conn, err := dialMWTapped(opts, func(outgoing bool, frame []byte, msg mwproto.Message) {
+			if _, ok := msg.(mwproto.ResultMessage); ok && !outgoing {
+				frames[i] = slices.Clone(frame)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("connect to MW: %w", err)
+		}
+		conns = append(conns, conn)
+		session := mwproto.NewSession(conn)
+		session.Timeout = mwTimeout
+		// Only one of our players needs to start the game.
+		if i == 0 {
+			starter = &autoStarter{conn: conn, threshold: opts.mwautostart}
+			session.OnEvent = starter.handleEvent
+		} else {
+			session.OnEvent = logSessionEvent
 		}
-		log.Printf("unexpected message before connect: %#v", msg)
-	}
-
-	conn.Send(mwproto.ReadyMessage{
-		Room:          opts.mwroom,
-		Nickname:      nickname,
-		ReadyMetadata: []mwproto.KeyValuePair{},
-	})
 
-waitingToEnterRoom:
-	for {
-		msg, ok := <-inbox
-		if !ok {
-			return errConnectionLost
+		serverName, err := session.Connect()
+		if err != nil {
+			return err
 		}
-		switch msg := msg.(type) {
-		case mwproto.ReadyConfirmMessage:
-			log.Printf("joined room %s with players %v", opts.mwroom, msg.Names)
-			break waitingToEnterRoom
-		case mwproto.ReadyDenyMessage:
-			log.Printf("denied entry to room %s: %s", opts.mwroom, msg.Description)
-		case mwproto.DisconnectMessage:
-			return errConnectionLost
-		case mwproto.RequestRandoMessage:
-		default:
-			log.Printf("unexpected message while joining room: %#v", msg)
+		log.Println("connected to", serverName)
+
+		names, err = session.JoinRoom(p.ready)
+		if err != nil {
+			return err
 		}
+		log.Printf("joined room %s as %s with players %v", p.ready.Room, p.ready.Nickname, names)
+		sessions[i] = session
 	}
+	// Only count the players once all of ours are in the room, so that
+	// the game doesn't start without some of them.
+	starter.update(names)
 
-waitingForStartMW:
-	for {
-		msg, ok := <-inbox
-		if !ok {
-			return errConnectionLost
+	type outcome struct {
+		slot  int
+		frame []byte
+		err   error
+	}
+	outcomes := make(chan outcome, len(players))
+	for i, p := range players {
+		go func() {
+			var o outcome
+			o.slot = p.slot
+			o.err = sessions[i].AwaitRandoRequest()
+			if o.err == nil {
+				_, o.err = sessions[i].SendRando(p.rando)
+				o.frame = frames[i]
+			}
+			outcomes <- o
+		}()
+	}
+	var firstErr error
+	for range players {
+		o := <-outcomes
+		if o.err == nil {
+			o.err = save(o.slot, o.frame)
 		}
-		switch msg := msg.(type) {
-		case mwproto.DisconnectMessage:
-			return errConnectionLost
-		case mwproto.ReadyConfirmMessage:
-			log.Printf("players in room: %v", msg.Names)
-		case mwproto.RequestRandoMessage:
-			conn.Send(mwproto.RandoGeneratedMessage{
-				Items: map[string][]mwproto.Placement{
-					singularItemGroup: mwPlacements,
-				},
-				Seed: 666_666_666,
-			})
-			break waitingForStartMW
-		default:
-			log.Printf("unexpected message while in room: %#v", msg)
+		if o.err != nil {
+			if firstErr == nil {
+				firstErr = o.err
+				// Don't leave the other players waiting for a shuffle that
+				// we'll have to redo anyway.
+				for _, conn := range conns {
+					conn.Disconnect()
+				}
+			}
 		}
 	}
+	return firstErr
+}
 
-	var mwResult mwproto.ResultMessage
+// An autoStarter initiates the game once there are enough players in the
+// room. It does nothing if threshold is zero.
+type autoStarter struct {
+	conn      *mwproto.Client
+	threshold int
+	started   bool
+}
 
-waitingForResult:
-	for {
-		msg, ok := <-inbox
-		if !ok {
-			return errConnectionLost
-		}
-		switch msg := msg.(type) {
-		case mwproto.DisconnectMessage:
-			return errConnectionLost
-		case mwproto.ResultMessage:
-			mwResult = msg
-			break waitingForResult
-		}
+func (a *autoStarter) update(names []string) {
+	if a.threshold > 0 && !a.started && len(names) >= a.threshold {
+		log.Printf("%d players in room; starting game", len(names))
+		var initiate mwproto.InitiateGameMessage
+		// Left unset, the algorithm would be sent as null, which isn't one
+		// of the values the protocol allows.
+		initiate.Options.RandomizationAlgorithm = "Default"
+		a.conn.Send(initiate)
+		a.started = true
+	}
+}
+
+func (a *autoStarter) handleEvent(e mwproto.Event) {
+	logSessionEvent(e)
+	if e, ok := e.(mwproto.PlayersChangedEvent); ok {
+		a.update(e.Names)
+	}
+}
+
+func isRetryableSetupError(err error) bool {
+	var denied *mwproto.DeniedError
+	return errors.As(err, &denied) || errors.Is(err, mwproto.ErrDisconnected) || errors.Is(err, mwproto.ErrTimeout)
+}
+
+func logSessionEvent(e mwproto.Event) {
+	switch e := e.(type) {
+	case mwproto.PlayersChangedEvent:
+		log.Printf("players in room: %v", e.Names)
+	case mwproto.UnexpectedMessageEvent:
+		log.Printf("unexpected message (%s): %#v", e.Step, e.Message)
 	}
+}
+
+const (
+	mwTimeout       = 30 * time.Second
+	setupRetryDelay = 5 * time.Second
+)
 
-	return createSavefile(opts.savefile, mwResult, data.PrecollectedItems[slotID])
+// createSoloSavefile creates a savefile for playing the seed without MW, as
+// if each slot were a player in a MW room of its own and every location held
+// the AP item placed there.
+func createSoloSavefile(savefile, apfile string, data apdata) error {
+	slots := playerSlots(data)
+	nicknames := make([]string, len(slots))
+	for i, slotID := range slots {
+		nicknames[i] = data.SlotInfo[slotID].Name
+	}
+	results := mwResults{}
+	for i, slotID := range slots {
+		results[slotID] = mwproto.ResultMessage{
+			PlayerID:  int32(i),
+			Nicknames: nicknames,
+		}
+	}
+	b, err := newSavefileBinding(apfile, data)
+	if err != nil {
+		return err
+	}
+	// Solo savefiles are bound to no MW room at all.
+	b.mwKnown = true
+	return createSavefile(savefile, results, data, b)
 }
@@ -0,0 +1,333 @@
+package approto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// A Client is a connection to an Archipelago server.
+//
+// Besides Send, which can send any client message, Client has methods for
+// the most common ones. Replies, like all other server messages, arrive on
+// the inbox.
+type Client struct {
+	conn      *websocket.Conn
+	inbox     chan ServerMessage
+	outbox    chan ClientMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+	lost      chan struct{}
+}
+
+// Dial connects to the AP server at addr, which may be either a websocket URL
+// or a bare host:port, in which case a secure connection is tried first.
+// A zero timeout means waiting forever.
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var (
+		conn *websocket.Conn
+		err  error
+	)
+	if strings.Contains(addr, "://") {
+		conn, _, err = websocket.Dial(ctx, addr, nil)
+	} else if conn, _, err = websocket.Dial(ctx, "wss://"+addr, nil); err != nil {
+		conn, _, err = websocket.Dial(ctx, "ws://"+addr, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Data packages and slot data can easily exceed the default limit.
+	conn.SetReadLimit(-1)
+	c := &Client{
+		conn:   conn,
+		inbox:  make(chan ServerMessage, chanBufferSize),
+		outbox: make(chan ClientMessage, chanBufferSize),
+		closed: make(chan struct{}),
+		lost:   make(chan struct{}),
+	}
+	go c.recvMessages()
+	go c.sendMessages()
+	return c, nil
+}
+
+var (
+	ErrDisconnected = errors.New("disconnected from AP server")
+	ErrTimeout      = errors.New("timed out waiting for AP server")
+)
+
+// RefusedError is returned by Handshake when the server sends a
+// ConnectionRefused.
+type RefusedError struct {
+	Name   string
+	Errors []string
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("AP refused connection as %s: %s", e.Name, strings.Join(e.Errors, ", "))
+}
+
+// Inbox is closed when the connection is lost.
+func (c *Client) Inbox() <-chan ServerMessage { return c.inbox }
+
+// Send queues msg to be sent. Messages sent after Close, or once the
+// connection is lost, are dropped.
+func (c *Client) Send(msg ClientMessage) {
+	select {
+	case c.outbox <- msg:
+	case <-c.closed:
+	case <-c.lost:
+	}
+}
+
+// Close sends any queued messages and closes the connection. Nothing more is
+// put in the inbox afterwards, even if it isn't being read.
+func (c *Client) Close() { c.closeOnce.Do(func() { close(c.closed) }) }
+
+// Handshake waits for the server's RoomInfo, then sends msg and waits for the
+// server to accept it. Messages other than the ones involved in the handshake
+// are discarded until then. A zero timeout means waiting forever.
+func (c *Client) Handshake(msg Connect, timeout time.Duration) (RoomInfo, Connected, error) {
+	var room RoomInfo
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	for {
+		select {
+		case m, ok := <-c.inbox:
+			if !ok {
+				return room, Connected{}, ErrDisconnected
+			}
+			switch m := m.(type) {
+			case RoomInfo:
+				room = m
+				c.Send(msg)
+			case ConnectionRefused:
+				return room, Connected{}, &RefusedError{Name: msg.Name, Errors: m.Errors}
+			case Connected:
+				return room, m, nil
+			}
+		case <-deadline:
+			return room, Connected{}, fmt.Errorf("connect as %s: %w", msg.Name, ErrTimeout)
+		}
+	}
+}
+
+// GetDataPackage asks for the data packages of the given games, or of every
+// game in the room if none are given.
+func (c *Client) GetDataPackage(games ...string) {
+	c.Send(GetDataPackage{Games: games})
+}
+
+func (c *Client) LocationChecks(locations ...int64) {
+	c.Send(LocationChecksMessage{Locations: locations})
+}
+
+// LocationScouts asks for the items at the given locations, which the server
+// sends back in a LocationInfoMessage.
+func (c *Client) LocationScouts(locations ...int64) {
+	c.Send(LocationScoutsMessage{Locations: locations})
+}
+
+// Sync asks the server to send all received items again.
+func (c *Client) Sync() { c.Send(SyncMessage{}) }
+
+// Get asks for the values of the given data storage keys, which the server
+// sends back in a RetrievedMessage.
+func (c *Client) Get(keys ...string) {
+	c.Send(GetMessage{Keys: keys})
+}
+
+// Set applies ops to the value of key in data storage, starting from def if
+// the key has no value yet.
+func (c *Client) Set(key string, def any, wantReply bool, ops ...DataStorageOperation) {
+	c.Send(SetMessage{Key: key, Default: def, WantReply: wantReply, Operations: ops})
+}
+
+// SetNotify asks to be sent a SetReplyMessage whenever any of the given keys
+// change.
+func (c *Client) SetNotify(keys ...string) {
+	c.Send(SetNotifyMessage{Keys: keys})
+}
+
+func (c *Client) Say(text string) { c.Send(SayMessage{Text: text}) }
+
+// Will terminate when the client is closed or the connection is lost.
+func (c *Client) sendMessages() {
+	ctx := context.Background()
+	send := func(msg ClientMessage) {
+		data, err := encodeClientMessage(msg)
+		if err != nil {
+			log.Println("error encoding AP message:", err)
+			return
+		}
+		if err := c.conn.Write(ctx, websocket.MessageText, data); err != nil {
+			log.Println("error writing AP message:", err)
+		}
+	}
+	for {
+		select {
+		case msg := <-c.outbox:
+			send(msg)
+		case <-c.lost:
+			c.conn.CloseNow()
+			return
+		case <-c.closed:
+			for {
+				select {
+				case msg := <-c.outbox:
+					send(msg)
+				default:
+					c.conn.Close(websocket.StatusNormalClosure, "")
+					return
+				}
+			}
+		}
+	}
+}
+
+// Will terminate when the connection is closed from either side, or the
+// client is closed.
+func (c *Client) recvMessages() {
+	defer close(c.inbox)
+	defer close(c.lost)
+	ctx := context.Background()
+	var (
+		buf            packet
+		unknownMessage struct{ Cmd string }
+	)
+	for {
+		_, data, err := c.conn.Read(ctx)
+		if err != nil {
+			var cerr websocket.CloseError
+			if !errors.As(err, &cerr) {
+				log.Println("error reading AP packet:", err)
+			}
+			return
+		}
+		if err := json.Unmarshal(data, &buf); err != nil {
+			log.Println("error reading AP packet:", err)
+			continue
+		}
+		for _, msg := range buf {
+			if err := json.Unmarshal(msg, &unknownMessage); err != nil {
+				log.Println("error parsing AP command:", err)
+				continue
+			}
+			var (
+				smsg ServerMessage
+				err  error
+			)
+			switch unknownMessage.Cmd {
+			case "RoomInfo":
+				smsg, err = tryParseServer[RoomInfo](msg)
+			case "ConnectionRefused":
+				smsg, err = tryParseServer[ConnectionRefused](msg)
+			case "Connected":
+				smsg, err = tryParseServer[Connected](msg)
+			case "ReceivedItems":
+				smsg, err = tryParseServer[ReceivedItems](msg)
+			case "LocationInfo":
+				smsg, err = tryParseServer[LocationInfoMessage](msg)
+			case "DataPackage":
+				smsg, err = tryParseServer[DataPackageMessage](msg)
+			case "SetReply":
+				smsg, err = tryParseServer[SetReplyMessage](msg)
+			case "Retrieved":
+				smsg, err = tryParseServer[RetrievedMessage](msg)
+			case "PrintJSON":
+				smsg, err = tryParseServer[PrintJSONMessage](msg)
+			case "RoomUpdate":
+				smsg, err = tryParseServer[RoomUpdateMessage](msg)
+			case "Bounced":
+				smsg, err = tryParseServer[BouncedMessage](msg)
+			case "InvalidPacket":
+				smsg, err = tryParseServer[InvalidPacketMessage](msg)
+			default:
+				log.Println("unknown server message:", unknownMessage.Cmd)
+				continue
+			}
+			if err != nil {
+				log.Printf("error parsing %s: %v", unknownMessage.Cmd, err)
+				continue
+			}
+			select {
+			case c.inbox <- smsg:
+			case <-c.closed:
+				return
+			}
+		}
+	}
+}
+
+func tryParseServer[T ServerMessage](msg json.RawMessage) (ServerMessage, error) {
+	var parsedMsg T
+	if err := json.Unmarshal(msg, &parsedMsg); err != nil {
+		return nil, fmt.Errorf("error parsing %T: %v", parsedMsg, err)
+	}
+	return parsedMsg, nil
+}
+
+// encodeClientMessage encodes msg as a single-message packet, adding the cmd
+// field, which client message types don't carry themselves.
+func encodeClientMessage(msg ClientMessage) ([]byte, error) {
+	var (
+		cmd    string
+		fields any = msg
+	)
+	switch msg := msg.(type) {
+	case Connect:
+		cmd = "Connect"
+	case GetDataPackage:
+		cmd = "GetDataPackage"
+	case SetMessage:
+		cmd = "Set"
+	case GetMessage:
+		cmd = "Get"
+		rest := make(map[string]any, len(msg.Rest)+1)
+		for k, v := range msg.Rest {
+			rest[k] = v
+		}
+		rest["keys"] = msg.Keys
+		fields = rest
+	case SetNotifyMessage:
+		cmd = "SetNotify"
+	case LocationScoutsMessage:
+		cmd = "LocationScouts"
+	case LocationChecksMessage:
+		cmd = "LocationChecks"
+	case SyncMessage:
+		cmd = "Sync"
+	case SayMessage:
+		cmd = "Say"
+	default:
+		return nil, fmt.Errorf("unknown client message type %T", msg)
+	}
+	obj, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(obj, &m); err != nil {
+		return nil, err
+	}
+	m["cmd"], _ = json.Marshal(cmd)
+	return json.Marshal([]map[string]json.RawMessage{m})
+}
+
+const chanBufferSize = 100
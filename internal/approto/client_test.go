@@ -0,0 +1,379 @@
+package approto
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// serveOne runs script against the first client to connect to an AP server
+// on localhost, and returns the server's address.
+func serveOne(t *testing.T, script func(c *ClientConn)) string {
+	t.Helper()
+	port := freePort(t)
+	srv := ServeWith(ServeOptions{Port: port})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c := srv.Accept()
+		script(c)
+		c.Close()
+	}()
+	t.Cleanup(func() {
+		srv.Close()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("server script didn't finish")
+		}
+	})
+	return net.JoinHostPort("localhost", strconv.Itoa(port))
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// dialClient connects to addr, waiting for the server to start listening.
+func dialClient(t *testing.T, addr string) *Client {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := Dial(addr, time.Second)
+		if err == nil {
+			t.Cleanup(c.Close)
+			return c
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// expect reads the next message the client sent, reporting an error if it's
+// not a T.
+func expect[T ClientMessage](t *testing.T, c *ClientConn) (msg T, ok bool) {
+	select {
+	case m := <-c.Inbox():
+		if m == nil {
+			t.Errorf("client disconnected while waiting for %T", msg)
+			return msg, false
+		}
+		msg, ok = m.(T)
+		if !ok {
+			t.Errorf("got %#v, want %T", m, msg)
+		}
+		return msg, ok
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for %T", msg)
+		return msg, false
+	}
+}
+
+// next reads the next message the server sent.
+func next(t *testing.T, c *Client) ServerMessage {
+	t.Helper()
+	select {
+	case m, ok := <-c.Inbox():
+		if !ok {
+			t.Fatal("server disconnected")
+		}
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a server message")
+		return nil
+	}
+}
+
+// awaitClosed waits for the client's inbox to be closed, discarding anything
+// left in it.
+func awaitClosed(t *testing.T, c *Client) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.Inbox():
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("inbox wasn't closed")
+		}
+	}
+}
+
+func TestDialPlainWebsocket(t *testing.T) {
+	addr := serveOne(t, func(c *ClientConn) {
+		expect[SayMessage](t, c)
+	})
+	// A bare host:port tries wss:// first, which this server doesn't speak.
+	c := dialClient(t, addr)
+	c.Say("hello")
+}
+
+func TestDialTimeout(t *testing.T) {
+	// Accepts connections, but never completes the websocket handshake.
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	start := time.Now()
+	if c, err := Dial(l.Addr().String(), 100*time.Millisecond); err == nil {
+		c.Close()
+		t.Fatal("Dial succeeded against a server that never answers")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Dial took %v with a 100ms timeout", elapsed)
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	if c, err := Dial(net.JoinHostPort("localhost", strconv.Itoa(freePort(t))), time.Second); err == nil {
+		c.Close()
+		t.Fatal("Dial succeeded with no server listening")
+	}
+}
+
+var testConnect = Connect{Game: "Hollow Knight", Name: "Bob", UUID: "test", Tags: []string{}}
+
+func TestHandshake(t *testing.T) {
+	addr := serveOne(t, func(c *ClientConn) {
+		c.Send(RoomInfo{Cmd: "RoomInfo", SeedName: "SEED", Games: []string{"Hollow Knight"}})
+		connect, ok := expect[Connect](t, c)
+		if !ok {
+			return
+		}
+		if connect.Name != "Bob" || connect.Game != "Hollow Knight" {
+			t.Errorf("got %#v", connect)
+		}
+		// Discarded until the handshake is done.
+		c.Send(PrintJSONMessage{Cmd: "PrintJSON", Data: []JSONMessagePart{{Text: "Bob joined"}}})
+		c.Send(Connected{Cmd: "Connected", Team: 0, Slot: 2, Players: []NetworkPlayer{{Slot: 2, Name: "Bob"}}})
+		expect[SyncMessage](t, c)
+	})
+	c := dialClient(t, addr)
+	room, connected, err := c.Handshake(testConnect, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.SeedName != "SEED" {
+		t.Errorf("seed name = %q, want SEED", room.SeedName)
+	}
+	if connected.Slot != 2 || len(connected.Players) != 1 || connected.Players[0].Name != "Bob" {
+		t.Errorf("got %#v", connected)
+	}
+	c.Sync()
+}
+
+func TestHandshakeRefused(t *testing.T) {
+	addr := serveOne(t, func(c *ClientConn) {
+		c.Send(RoomInfo{Cmd: "RoomInfo"})
+		if _, ok := expect[Connect](t, c); !ok {
+			return
+		}
+		c.Send(ConnectionRefused{Cmd: "ConnectionRefused", Errors: []string{"InvalidSlot"}})
+	})
+	c := dialClient(t, addr)
+	_, _, err := c.Handshake(testConnect, 5*time.Second)
+	var refused *RefusedError
+	if !errors.As(err, &refused) {
+		t.Fatalf("Handshake returned %v, want a *RefusedError", err)
+	}
+	if refused.Name != "Bob" || !reflect.DeepEqual(refused.Errors, []string{"InvalidSlot"}) {
+		t.Errorf("got %#v", refused)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	addr := serveOne(t, func(c *ClientConn) {
+		c.Send(RoomInfo{Cmd: "RoomInfo"})
+		expect[Connect](t, c)
+		<-release
+	})
+	defer close(release)
+	c := dialClient(t, addr)
+	if _, _, err := c.Handshake(testConnect, 50*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Handshake returned %v, want ErrTimeout", err)
+	}
+}
+
+func TestHandshakeDisconnected(t *testing.T) {
+	addr := serveOne(t, func(c *ClientConn) {})
+	c := dialClient(t, addr)
+	if _, _, err := c.Handshake(testConnect, 5*time.Second); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("Handshake returned %v, want ErrDisconnected", err)
+	}
+}
+
+type unknownClientMessage struct{}
+
+func (unknownClientMessage) isClientMessage() {}
+
+func TestEncodeClientMessage(t *testing.T) {
+	tests := []struct {
+		msg  ClientMessage
+		want string
+	}{
+		{SyncMessage{}, `[{"cmd":"Sync"}]`},
+		{SayMessage{Text: "hi"}, `[{"cmd":"Say","text":"hi"}]`},
+		{LocationChecksMessage{Locations: []int64{1, 2}}, `[{"cmd":"LocationChecks","locations":[1,2]}]`},
+		{GetDataPackage{}, `[{"cmd":"GetDataPackage"}]`},
+		{
+			GetMessage{Keys: []string{"a", "b"}, Rest: map[string]any{"id": 7, "note": "x"}},
+			`[{"cmd":"Get","keys":["a","b"],"id":7,"note":"x"}]`,
+		},
+		// The keys asked for win over any in Rest.
+		{
+			GetMessage{Keys: []string{"a"}, Rest: map[string]any{"keys": []string{"b"}}},
+			`[{"cmd":"Get","keys":["a"]}]`,
+		},
+	}
+	for _, test := range tests {
+		data, err := encodeClientMessage(test.msg)
+		if err != nil {
+			t.Errorf("%#v: %v", test.msg, err)
+			continue
+		}
+		var got, want any
+		if err := json.Unmarshal(data, &got); err != nil {
+			t.Errorf("%#v encoded as invalid JSON %s", test.msg, data)
+			continue
+		}
+		if err := json.Unmarshal([]byte(test.want), &want); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%#v encoded as %s, want %s", test.msg, data, test.want)
+		}
+	}
+	if data, err := encodeClientMessage(unknownClientMessage{}); err == nil {
+		t.Errorf("unknown message encoded as %s", data)
+	}
+}
+
+func TestClientMessagesReachServer(t *testing.T) {
+	want := []ClientMessage{
+		LocationChecksMessage{Locations: []int64{100, 101}},
+		LocationScoutsMessage{Locations: []int64{102}},
+		GetMessage{Keys: []string{"key"}, Rest: map[string]any{"id": "abc"}},
+		SetNotifyMessage{Keys: []string{"key"}},
+		SayMessage{Text: "hello"},
+	}
+	addr := serveOne(t, func(c *ClientConn) {
+		for _, w := range want {
+			select {
+			case got := <-c.Inbox():
+				if !reflect.DeepEqual(got, w) {
+					t.Errorf("server got %#v, want %#v", got, w)
+				}
+			case <-time.After(5 * time.Second):
+				t.Errorf("timed out waiting for %#v", w)
+				return
+			}
+		}
+	})
+	c := dialClient(t, addr)
+	c.LocationChecks(100, 101)
+	c.LocationScouts(102)
+	c.Send(GetMessage{Keys: []string{"key"}, Rest: map[string]any{"id": "abc"}})
+	c.SetNotify("key")
+	c.Say("hello")
+}
+
+func TestServerMessagesDecoded(t *testing.T) {
+	hintPoints := 3
+	sent := []ServerMessage{
+		ReceivedItems{Cmd: "ReceivedItems", Index: 1, Items: []NetworkItem{{Item: 1 << 40, Location: -2, Player: 0, Flags: 1}}},
+		LocationInfoMessage{Cmd: "LocationInfo", Locations: []NetworkItem{{Item: 5, Location: 6, Player: 1}}},
+		RoomUpdateMessage{Cmd: "RoomUpdate", CheckedLocations: []int64{6}, HintPoints: &hintPoints},
+		RetrievedMessage{"cmd": "Retrieved", "keys": map[string]any{"key": "value"}},
+		SetReplyMessage{Cmd: "SetReply", Key: "key", Value: "new", OriginalValue: "old", Slot: 1},
+		BouncedMessage{Cmd: "Bounced", Tags: []string{"DeathLink"}, Data: map[string]any{"source": "Bob"}},
+		InvalidPacketMessage{Cmd: "InvalidPacket", Type: "cmd", OriginalCmd: "Nope", Text: "unknown"},
+	}
+	addr := serveOne(t, func(c *ClientConn) {
+		for _, msg := range sent {
+			c.Send(msg)
+		}
+		expect[SyncMessage](t, c)
+	})
+	c := dialClient(t, addr)
+	for _, want := range sent {
+		if got := next(t, c); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %#v, want %#v", got, want)
+		}
+	}
+	c.Sync()
+}
+
+func TestSendAfterClose(t *testing.T) {
+	addr := serveOne(t, func(c *ClientConn) {
+		expect[SayMessage](t, c)
+	})
+	c := dialClient(t, addr)
+	c.Say("queued before closing")
+	c.Close()
+	c.Close()
+	for range 2 * chanBufferSize {
+		c.LocationChecks(1)
+		c.Sync()
+	}
+	awaitClosed(t, c)
+}
+
+func TestSendAfterServerDisconnects(t *testing.T) {
+	addr := serveOne(t, func(c *ClientConn) {})
+	c := dialClient(t, addr)
+	awaitClosed(t, c)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for range 2 * chanBufferSize {
+			c.LocationChecks(1)
+		}
+	}()
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked after the server disconnected")
+	}
+}
+
+// Closing a client whose inbox isn't being read must not leave it stuck
+// trying to put more messages in it.
+func TestCloseWithUnreadInbox(t *testing.T) {
+	addr := serveOne(t, func(c *ClientConn) {
+		for range 2 * chanBufferSize {
+			c.Send(RoomUpdateMessage{Cmd: "RoomUpdate", CheckedLocations: []int64{1}})
+		}
+	})
+	c := dialClient(t, addr)
+	time.Sleep(100 * time.Millisecond)
+	if len(c.Inbox()) != chanBufferSize {
+		t.Fatalf("inbox has %d messages, want it full", len(c.Inbox()))
+	}
+	c.Close()
+	awaitClosed(t, c)
+}
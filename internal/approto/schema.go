@@ -4,6 +4,7 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"strings"
 )
 
 type Version struct {
@@ -87,7 +88,7 @@ func (dp *DataPackage) SetChecksum() {
 }
 
 type GetDataPackage struct {
-	Games []string
+	Games []string `json:"games,omitempty"`
 }
 
 func (GetDataPackage) isClientMessage() {}
@@ -113,18 +114,25 @@ func MakeDataPackageMessage() DataPackageMessage {
 }
 
 type Connect struct {
-	Password      string
-	Game          string
-	Name          string
-	UUID          any // This is usually a string, but the text client sends a number instead, contrary to what the AP protocol documentation states.
-	Version       Version
+	Password      string            `json:"password"`
+	Game          string            `json:"game"`
+	Name          string            `json:"name"`
+	UUID          any               `json:"uuid"` // This is usually a string, but the text client sends a number instead, contrary to what the AP protocol documentation states.
+	Version       Version           `json:"version"`
 	ItemsHandling *ItemHandlingMode `json:"items_handling"`
-	Tags          []string
-	SlotData      bool `json:"slot_data"`
+	Tags          []string          `json:"tags"`
+	SlotData      bool              `json:"slot_data"`
 }
 
 func (Connect) isClientMessage() {}
 
+type ConnectionRefused struct {
+	Cmd    string   `json:"cmd"`
+	Errors []string `json:"errors"`
+}
+
+func (ConnectionRefused) isServerMessage() {}
+
 type ItemHandlingMode int
 
 const (
@@ -191,10 +199,10 @@ const (
 )
 
 type SetMessage struct {
-	Key        string
-	Default    any
-	WantReply  bool `json:"want_reply"`
-	Operations []DataStorageOperation
+	Key        string                 `json:"key"`
+	Default    any                    `json:"default"`
+	WantReply  bool                   `json:"want_reply"`
+	Operations []DataStorageOperation `json:"operations"`
 }
 
 const ReadOnlyKeyPrefix = "_read_"
@@ -202,14 +210,14 @@ const ReadOnlyKeyPrefix = "_read_"
 func (SetMessage) isClientMessage() {}
 
 type SetNotifyMessage struct {
-	Keys []string
+	Keys []string `json:"keys"`
 }
 
 func (SetNotifyMessage) isClientMessage() {}
 
 type DataStorageOperation struct {
-	Operation string
-	Value     any
+	Operation string `json:"operation"`
+	Value     any    `json:"value"`
 }
 
 type SetReplyMessage struct {
@@ -252,8 +260,8 @@ const (
 )
 
 type LocationScoutsMessage struct {
-	Locations    []int64
-	CreateAsHint int `json:"create_as_hint"`
+	Locations    []int64 `json:"locations"`
+	CreateAsHint int     `json:"create_as_hint"`
 }
 
 func (LocationScoutsMessage) isClientMessage() {}
@@ -266,7 +274,7 @@ type LocationInfoMessage struct {
 func (LocationInfoMessage) isServerMessage() {}
 
 type LocationChecksMessage struct {
-	Locations []int64
+	Locations []int64 `json:"locations"`
 }
 
 func (LocationChecksMessage) isClientMessage() {}
@@ -276,7 +284,72 @@ type SyncMessage struct{}
 func (SyncMessage) isClientMessage() {}
 
 type SayMessage struct {
-	Text string
+	Text string `json:"text"`
 }
 
 func (SayMessage) isClientMessage() {}
+
+// Keys returns the values of the keys that were asked for.
+func (m RetrievedMessage) Keys() map[string]any {
+	keys, _ := m["keys"].(map[string]any)
+	return keys
+}
+
+type PrintJSONMessage struct {
+	Cmd     string            `json:"cmd"`
+	Data    []JSONMessagePart `json:"data"`
+	Type    string            `json:"type,omitempty"`
+	Slot    int               `json:"slot,omitempty"`
+	Item    *NetworkItem      `json:"item,omitempty"`
+	Message string            `json:"message,omitempty"`
+}
+
+func (PrintJSONMessage) isServerMessage() {}
+
+// Text returns the message as plain text, without resolving player, item and
+// location IDs into names.
+func (m PrintJSONMessage) Text() string {
+	var sb strings.Builder
+	for _, part := range m.Data {
+		sb.WriteString(part.Text)
+	}
+	return sb.String()
+}
+
+type JSONMessagePart struct {
+	Type   string `json:"type,omitempty"`
+	Text   string `json:"text"`
+	Color  string `json:"color,omitempty"`
+	Flags  int    `json:"flags,omitempty"`
+	Player int    `json:"player,omitempty"`
+}
+
+// RoomUpdateMessage carries any of the fields of RoomInfo and Connected that
+// have changed; only the ones clients usually care about are decoded.
+type RoomUpdateMessage struct {
+	Cmd              string          `json:"cmd"`
+	Players          []NetworkPlayer `json:"players,omitempty"`
+	CheckedLocations []int64         `json:"checked_locations,omitempty"`
+	HintPoints       *int            `json:"hint_points,omitempty"`
+}
+
+func (RoomUpdateMessage) isServerMessage() {}
+
+type BouncedMessage struct {
+	Cmd   string         `json:"cmd"`
+	Games []string       `json:"games,omitempty"`
+	Slots []int          `json:"slots,omitempty"`
+	Tags  []string       `json:"tags,omitempty"`
+	Data  map[string]any `json:"data"`
+}
+
+func (BouncedMessage) isServerMessage() {}
+
+type InvalidPacketMessage struct {
+	Cmd         string `json:"cmd"`
+	Type        string `json:"type"`
+	OriginalCmd string `json:"original_cmd"`
+	Text        string `json:"text"`
+}
+
+func (InvalidPacketMessage) isServerMessage() {}
@@ -9,7 +9,6 @@ import (
 	"sync/atomic"
 
 	"github.com/coder/websocket"
-	"github.com/coder/websocket/wsjson"
 )
 
 type ServerMessage interface {
@@ -22,15 +21,43 @@ type ClientMessage interface {
 
 type Server struct {
 	numConnections atomic.Int32
+	maxConnections int32
 	connections    chan *ClientConn
 	httpServer     http.Server
+	newTap         func() Tap
 }
 
+// A Tap observes every websocket packet sent (outgoing) or received on a
+// connection.
+type Tap func(outgoing bool, packet []byte)
+
 func Serve(port int) *Server {
+	return ServeTapped(port, nil)
+}
+
+// ServeTapped is like Serve, but calls newTap for each client connection and
+// passes every packet on that connection to the resulting Tap.
+func ServeTapped(port int, newTap func() Tap) *Server {
+	return ServeWith(ServeOptions{Port: port, NewTap: newTap})
+}
+
+type ServeOptions struct {
+	Port int
+	// NewTap, if set, is called for each client connection, and every packet
+	// on that connection is passed to the resulting Tap.
+	NewTap func() Tap
+	// MaxConnections is how many clients may be connected at once; zero
+	// means one.
+	MaxConnections int
+}
+
+func ServeWith(opts ServeOptions) *Server {
 	listener := &Server{
-		connections: make(chan *ClientConn, 1),
+		maxConnections: int32(max(opts.MaxConnections, 1)),
+		connections:    make(chan *ClientConn, 1),
+		newTap:         opts.NewTap,
 	}
-	listener.httpServer.Addr = fmt.Sprintf("localhost:%d", port)
+	listener.httpServer.Addr = fmt.Sprintf("localhost:%d", opts.Port)
 	listener.httpServer.Handler = http.HandlerFunc(listener.handleConnection)
 
 	go func() {
@@ -60,8 +87,8 @@ func (ls *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
 	}
 	defer apconn.CloseNow()
 	n := ls.numConnections.Load()
-	if !(n == 0 && ls.numConnections.CompareAndSwap(n, n+1)) {
-		log.Println("AP client rejected; only one allowed at a time")
+	if !(n < ls.maxConnections && ls.numConnections.CompareAndSwap(n, n+1)) {
+		log.Println("AP client rejected; only", ls.maxConnections, "allowed at a time")
 		return
 	}
 	defer ls.numConnections.Add(-1)
@@ -74,6 +101,10 @@ func (ls *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
 	defer func() { cconn.inbox <- nil }()
 	ls.connections <- cconn
 	ctx := r.Context()
+	var tap Tap
+	if ls.newTap != nil {
+		tap = ls.newTap()
+	}
 
 	go func() {
 		for {
@@ -83,10 +114,21 @@ func (ls *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
 					apconn.CloseNow()
 					return
 				}
-				if err := wsjson.Write(ctx, apconn, []ServerMessage{msg}); err != nil {
+				data, err := json.Marshal([]ServerMessage{msg})
+				if err != nil {
+					log.Println("error encoding AP message:", err)
+					continue
+				}
+				if tap != nil {
+					tap(true, data)
+				}
+				if err := apconn.Write(ctx, websocket.MessageText, data); err != nil {
 					log.Println("error writing AP message:", err)
 				}
 			case <-ctx.Done():
+				// Keep Send from blocking until the conn is closed on our side.
+				for range cconn.outbox {
+				}
 				return
 			}
 		}
@@ -97,7 +139,8 @@ func (ls *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
 		unknownMessage struct{ Cmd string }
 	)
 	for {
-		if err := wsjson.Read(ctx, apconn, &buf); err != nil {
+		_, data, err := apconn.Read(ctx)
+		if err != nil {
 			var cerr websocket.CloseError
 			if errors.As(err, &cerr) {
 				log.Println("AP client disconnected, code:", cerr.Code, "reason:", cerr.Reason)
@@ -106,6 +149,13 @@ func (ls *Server) handleConnection(w http.ResponseWriter, r *http.Request) {
 			log.Println("error reading AP packet:", err)
 			return
 		}
+		if tap != nil {
+			tap(false, data)
+		}
+		if err := json.Unmarshal(data, &buf); err != nil {
+			log.Println("error reading AP packet:", err)
+			return
+		}
 		for _, msg := range buf {
 			if err := json.Unmarshal(msg, &unknownMessage); err != nil {
 				log.Println("error parsing AP command:", err)
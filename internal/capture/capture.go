@@ -0,0 +1,159 @@
+// Package capture records the traffic on MW and AP connections to a file, as
+// one JSON object per line, and reads such files back.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"iter"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dpinela/mmm/internal/approto"
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+const (
+	ProtocolMW = "mw"
+	ProtocolAP = "ap"
+
+	// Directions are given from the point of view of the process doing the
+	// capture.
+	DirectionSent     = "sent"
+	DirectionReceived = "received"
+)
+
+type Record struct {
+	Time      time.Time `json:"time"`
+	Protocol  string    `json:"protocol"`
+	Conn      int       `json:"conn"`
+	Direction string    `json:"direction"`
+	// Type is the Go type of the decoded MW message; empty for AP packets.
+	Type string `json:"type,omitempty"`
+	// Decoded holds the decoded MW message, or the AP packet itself.
+	Decoded json.RawMessage `json:"decoded,omitempty"`
+	// Frame holds the MW frame exactly as it was sent or received, or the AP
+	// packet if it wasn't valid JSON.
+	Frame []byte `json:"frame,omitempty"`
+}
+
+// APPacket returns the AP packet held in r, whether or not it was valid JSON.
+func (r Record) APPacket() []byte {
+	if r.Decoded == nil {
+		return r.Frame
+	}
+	return r.Decoded
+}
+
+type Writer struct {
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	enc      *json.Encoder
+	nextConn int
+}
+
+func Create(name string) (*Writer, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &Writer{f: f, w: w, enc: json.NewEncoder(w)}, nil
+}
+
+// MWTap returns a tap for a new MW connection.
+func (w *Writer) MWTap() mwproto.Tap {
+	conn := w.newConn()
+	return func(outgoing bool, frame []byte, msg mwproto.Message) {
+		rec := Record{
+			Protocol:  ProtocolMW,
+			Conn:      conn,
+			Direction: direction(outgoing),
+			Frame:     slices.Clone(frame),
+		}
+		if msg != nil {
+			rec.Type = fmt.Sprintf("%T", msg)
+			rec.Decoded, _ = json.Marshal(msg)
+		}
+		w.write(rec)
+	}
+}
+
+// APTap returns a tap for a new AP connection.
+func (w *Writer) APTap() approto.Tap {
+	conn := w.newConn()
+	return func(outgoing bool, packet []byte) {
+		rec := Record{
+			Protocol:  ProtocolAP,
+			Conn:      conn,
+			Direction: direction(outgoing),
+		}
+		if json.Valid(packet) {
+			rec.Decoded = slices.Clone(packet)
+		} else {
+			rec.Frame = slices.Clone(packet)
+		}
+		w.write(rec)
+	}
+}
+
+func (w *Writer) newConn() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.nextConn++
+	return w.nextConn
+}
+
+func (w *Writer) write(rec Record) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rec.Time = time.Now()
+	// Capturing is a debugging aid; failing to write the capture shouldn't
+	// stop the game.
+	_ = w.enc.Encode(rec)
+	_ = w.w.Flush()
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+func direction(outgoing bool) string {
+	if outgoing {
+		return DirectionSent
+	}
+	return DirectionReceived
+}
+
+// Read returns the records in the named capture file, in order.
+func Read(name string) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		f, err := os.Open(name)
+		if err != nil {
+			yield(Record{}, err)
+			return
+		}
+		defer f.Close()
+		dec := json.NewDecoder(bufio.NewReader(f))
+		for dec.More() {
+			var rec Record
+			if err := dec.Decode(&rec); err != nil {
+				yield(Record{}, fmt.Errorf("read capture %s: %w", name, err))
+				return
+			}
+			if !yield(rec, nil) {
+				return
+			}
+		}
+	}
+}
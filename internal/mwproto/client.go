@@ -1,30 +1,48 @@
 package mwproto
 
 import (
+	"bufio"
 	"errors"
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 type Client struct {
 	conn      net.Conn
+	tap       Tap
 	realInbox chan Message
 	inbox     chan Message
 	outbox    chan Message
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
+// A Tap observes every frame sent (outgoing) or received on a connection,
+// along with its decoded message, which is nil if the frame could not be
+// decoded. The frame is only valid for the duration of the call.
+type Tap func(outgoing bool, frame []byte, msg Message)
+
 func Dial(serverAddr string) (*Client, error) {
+	return DialTapped(serverAddr, nil)
+}
+
+// DialTapped is like Dial, but passes every frame on the connection,
+// including pings, to tap.
+func DialTapped(serverAddr string, tap Tap) (*Client, error) {
 	conn, err := net.Dial("tcp", serverAddr)
 	if err != nil {
 		return nil, err
 	}
 	c := &Client{
 		conn:      conn,
+		tap:       tap,
 		realInbox: make(chan Message, chanBufferSize),
 		inbox:     make(chan Message, chanBufferSize),
 		outbox:    make(chan Message, chanBufferSize),
+		closed:    make(chan struct{}),
 	}
 	go c.recvMessages()
 	go c.sendMessages()
@@ -34,27 +52,63 @@ func Dial(serverAddr string) (*Client, error) {
 
 func (c *Client) Inbox() <-chan Message { return c.inbox }
 
-func (c *Client) Send(m Message) { c.outbox <- m }
+// Send queues m to be sent. Messages sent after Close are dropped.
+func (c *Client) Send(m Message) {
+	select {
+	case c.outbox <- m:
+	case <-c.closed:
+	}
+}
+
+// Close sends any queued messages, says goodbye to the server and closes the
+// connection.
+func (c *Client) Close() { c.closeOnce.Do(func() { close(c.closed) }) }
 
-func (c *Client) Close() { close(c.outbox) }
+// Disconnect drops the connection immediately, without saying goodbye to the
+// server, so that anything waiting on the inbox sees it close. Close must
+// still be called afterwards.
+func (c *Client) Disconnect() { c.conn.Close() }
 
-// Will terminate when outbox is closed.
+// Will terminate when the client is closed.
+// Messages are buffered and only flushed once the outbox is empty, so that
+// bursts of messages go out in as few writes as possible.
 func (c *Client) sendMessages() {
-	for m := range c.outbox {
-		err := Write(c.conn, m)
-		if err != nil {
+	w := bufio.NewWriter(c.conn)
+	send := func(m Message) {
+		err := writeEnvelope(w, Envelope{Message: m}, c.tap)
+		if err == nil && len(c.outbox) == 0 {
+			err = w.Flush()
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
 			log.Println("error sending MW message:", err)
 		}
 	}
-	_ = Write(c.conn, DisconnectMessage{})
-	c.conn.Close()
+	for {
+		select {
+		case m := <-c.outbox:
+			send(m)
+		case <-c.closed:
+			for {
+				select {
+				case m := <-c.outbox:
+					send(m)
+				default:
+					_ = writeEnvelope(w, Envelope{Message: DisconnectMessage{}}, c.tap)
+					_ = w.Flush()
+					c.conn.Close()
+					return
+				}
+			}
+		}
+	}
 }
 
 // Will terminate when the network connection is closed from either side.
 func (c *Client) recvMessages() {
 	defer close(c.realInbox)
 	for {
-		msg, err := Read(c.conn)
+		env, err := readEnvelope(c.conn, c.tap)
+		msg := env.Message
 		if errors.Is(err, net.ErrClosed) {
 			return
 		}
@@ -62,6 +116,13 @@ func (c *Client) recvMessages() {
 			log.Println("MW connection closed from server side")
 			return
 		}
+		var ferr *FramingError
+		if errors.As(err, &ferr) {
+			// There's no way of finding where the next message starts.
+			log.Println("dropping MW connection:", err)
+			c.conn.Close()
+			return
+		}
 		if err != nil {
 			log.Println("error reading MW message:", err)
 			continue
@@ -84,7 +145,10 @@ func (c *Client) ping() {
 			if unansweredPings == reconnectThreshold {
 				return
 			}
-			c.outbox <- PingMessage{}
+			select {
+			case c.outbox <- PingMessage{}:
+			case <-c.closed:
+			}
 		case msg, ok := <-c.realInbox:
 			if !ok {
 				return
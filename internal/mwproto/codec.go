@@ -0,0 +1,337 @@
+package mwproto
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Per-message payload encoders and decoders. Fields must be written and read
+// in the order in which they are declared in the corresponding C# class.
+
+func (m ConnectMessage) appendPayload(b []byte) []byte {
+	return appendString(b, m.ServerName)
+}
+
+func (m *ConnectMessage) decode(d *decoder) {
+	m.ServerName = d.readString()
+}
+
+func (m PingMessage) appendPayload(b []byte) []byte {
+	return byteOrder.AppendUint32(b, m.ReplyValue)
+}
+
+func (m *PingMessage) decode(d *decoder) {
+	m.ReplyValue = d.readUint32()
+}
+
+func (DisconnectMessage) appendPayload(b []byte) []byte { return b }
+func (*DisconnectMessage) decode(*decoder)              {}
+
+func (m JoinMessage) appendPayload(b []byte) []byte {
+	b = appendString(b, m.DisplayName)
+	b = appendInt32(b, m.RandoID)
+	b = appendInt32(b, m.PlayerID)
+	return append(b, m.Mode)
+}
+
+func (m *JoinMessage) decode(d *decoder) {
+	m.DisplayName = d.readString()
+	m.RandoID = d.readInt32()
+	m.PlayerID = d.readInt32()
+	m.Mode = d.readByte()
+}
+
+func (JoinConfirmMessage) appendPayload(b []byte) []byte { return b }
+
+func (m ReadyMessage) appendPayload(b []byte) []byte {
+	b = appendString(b, m.Room)
+	b = appendString(b, m.Nickname)
+	b = append(b, m.Mode)
+	return appendJSON(b, m.ReadyMetadata)
+}
+
+func (m *ReadyMessage) decode(d *decoder) {
+	m.Room = d.readString()
+	m.Nickname = d.readString()
+	m.Mode = d.readByte()
+	d.readJSON(&m.ReadyMetadata)
+}
+
+func (m ReadyConfirmMessage) appendPayload(b []byte) []byte {
+	b = appendInt32(b, m.Ready)
+	return appendJSON(b, m.Names)
+}
+
+func (m *ReadyConfirmMessage) decode(d *decoder) {
+	m.Ready = d.readInt32()
+	d.readJSON(&m.Names)
+}
+
+func (m ReadyDenyMessage) appendPayload(b []byte) []byte {
+	return appendString(b, m.Description)
+}
+
+func (m *ReadyDenyMessage) decode(d *decoder) {
+	m.Description = d.readString()
+}
+
+func (UnreadyMessage) appendPayload(b []byte) []byte { return b }
+
+func (m InitiateGameMessage) appendPayload(b []byte) []byte {
+	return appendJSON(b, m.Options)
+}
+
+func (m *InitiateGameMessage) decode(d *decoder) {
+	d.readJSON(&m.Options)
+}
+
+func (RequestRandoMessage) appendPayload(b []byte) []byte { return b }
+
+func (m RandoGeneratedMessage) appendPayload(b []byte) []byte {
+	b = appendJSON(b, m.Items)
+	return appendInt32(b, m.Seed)
+}
+
+func (m *RandoGeneratedMessage) decode(d *decoder) {
+	d.readJSON(&m.Items)
+	m.Seed = d.readInt32()
+}
+
+func (m ResultMessage) appendPayload(b []byte) []byte {
+	b = appendInt32(b, m.PlayerID)
+	b = appendInt32(b, m.RandoID)
+	b = appendJSONWith(b, m.Nicknames, appendJSONStrings)
+	b = appendJSONWith(b, m.ReadyMetadata, appendJSONMetadata)
+	b = appendJSONWith(b, m.ItemsSpoiler, appendJSONSpoilerLogs)
+	b = appendJSONWith(b, m.Placements, appendJSONPlacements)
+	b = appendJSONWith(b, m.PlayerItemsPlacements, appendJSONStringMap)
+	return appendString(b, m.GeneratedHash)
+}
+
+func (m *ResultMessage) decode(d *decoder) {
+	m.PlayerID = d.readInt32()
+	m.RandoID = d.readInt32()
+	readJSONWith(d, &m.Nicknames, readJSONStrings)
+	readJSONWith(d, &m.ReadyMetadata, readJSONMetadata)
+	readJSONWith(d, &m.ItemsSpoiler, readJSONSpoilerLogs)
+	readJSONWith(d, &m.Placements, readJSONPlacements)
+	readJSONWith(d, &m.PlayerItemsPlacements, readJSONStringMap)
+	m.GeneratedHash = d.readString()
+}
+
+func (m DataReceiveMessage) appendPayload(b []byte) []byte {
+	b = appendString(b, m.Label)
+	b = appendString(b, m.Content)
+	b = appendString(b, m.From)
+	return appendInt32(b, m.FromID)
+}
+
+func (m *DataReceiveMessage) decode(d *decoder) {
+	m.Label = d.readString()
+	m.Content = d.readString()
+	m.From = d.readString()
+	m.FromID = d.readInt32()
+}
+
+func (m DatasReceiveMessage) appendPayload(b []byte) []byte {
+	b = appendJSONWith(b, m.Items, appendJSONReceivedItems)
+	return appendString(b, m.From)
+}
+
+func (m *DatasReceiveMessage) decode(d *decoder) {
+	readJSONWith(d, &m.Items, readJSONReceivedItems)
+	m.From = d.readString()
+}
+
+func (m DataReceiveConfirmMessage) appendPayload(b []byte) []byte {
+	b = appendString(b, m.Label)
+	b = appendString(b, m.Data)
+	return appendString(b, m.From)
+}
+
+func (m *DataReceiveConfirmMessage) decode(d *decoder) {
+	m.Label = d.readString()
+	m.Data = d.readString()
+	m.From = d.readString()
+}
+
+func (m DatasReceiveConfirmMessage) appendPayload(b []byte) []byte {
+	b = appendInt32(b, m.Count)
+	return appendString(b, m.From)
+}
+
+func (m *DatasReceiveConfirmMessage) decode(d *decoder) {
+	m.Count = d.readInt32()
+	m.From = d.readString()
+}
+
+func (SaveMessage) appendPayload(b []byte) []byte { return b }
+
+func (m DataSendMessage) appendPayload(b []byte) []byte {
+	b = appendString(b, m.Label)
+	b = appendString(b, m.Content)
+	b = appendInt32(b, m.To)
+	return appendInt32(b, m.TTL)
+}
+
+func (m *DataSendMessage) decode(d *decoder) {
+	m.Label = d.readString()
+	m.Content = d.readString()
+	m.To = d.readInt32()
+	m.TTL = d.readInt32()
+}
+
+func (m DataSendConfirmMessage) appendPayload(b []byte) []byte {
+	b = appendString(b, m.Label)
+	b = appendString(b, m.Content)
+	return appendInt32(b, m.To)
+}
+
+func (m *DataSendConfirmMessage) decode(d *decoder) {
+	m.Label = d.readString()
+	m.Content = d.readString()
+	m.To = d.readInt32()
+}
+
+func (RequestCharmNotchCostsMessage) appendPayload(b []byte) []byte { return b }
+
+func (m AnnounceCharmNotchCostsMessage) appendPayload(b []byte) []byte {
+	b = appendInt32(b, m.PlayerID)
+	return appendJSON(b, m.NotchCosts)
+}
+
+func (m *AnnounceCharmNotchCostsMessage) decode(d *decoder) {
+	m.PlayerID = d.readInt32()
+	d.readJSON(&m.NotchCosts)
+}
+
+func (m ConfirmCharmNotchCostsReceived) appendPayload(b []byte) []byte {
+	return appendInt32(b, m.PlayerID)
+}
+
+func (m *ConfirmCharmNotchCostsReceived) decode(d *decoder) {
+	m.PlayerID = d.readInt32()
+}
+
+func (m DatasSendMessage) appendPayload(b []byte) []byte {
+	return appendJSON(b, m.Datas)
+}
+
+func (m *DatasSendMessage) decode(d *decoder) {
+	d.readJSON(&m.Datas)
+}
+
+func (m DatasSendConfirmMessage) appendPayload(b []byte) []byte {
+	return appendInt32(b, m.Count)
+}
+
+func (m *DatasSendConfirmMessage) decode(d *decoder) {
+	m.Count = d.readInt32()
+}
+
+func (m ISReadyMessage) appendPayload(b []byte) []byte {
+	b = appendString(b, m.Room)
+	b = appendString(b, m.Nickname)
+	b = appendString(b, m.Hash)
+	return appendJSON(b, m.ReadyMetadata)
+}
+
+func (m *ISReadyMessage) decode(d *decoder) {
+	m.Room = d.readString()
+	m.Nickname = d.readString()
+	m.Hash = d.readString()
+	d.readJSON(&m.ReadyMetadata)
+}
+
+func (m InitiateSyncGameMessage) appendPayload(b []byte) []byte {
+	return appendString(b, m.Settings)
+}
+
+func (m *InitiateSyncGameMessage) decode(d *decoder) {
+	m.Settings = d.readString()
+}
+
+func (m ApplySettingsMessage) appendPayload(b []byte) []byte {
+	return appendString(b, m.Settings)
+}
+
+func (m *ApplySettingsMessage) decode(d *decoder) {
+	m.Settings = d.readString()
+}
+
+func (RequestSettingsMessage) appendPayload(b []byte) []byte { return b }
+
+func (m ConnectedPlayersChangedMessage) appendPayload(b []byte) []byte {
+	return appendJSON(b, m.Players)
+}
+
+func (m *ConnectedPlayersChangedMessage) decode(d *decoder) {
+	d.readJSON(&m.Players)
+}
+
+func (m RawMessage) appendPayload(b []byte) []byte {
+	return append(b, m.Payload...)
+}
+
+// A decoder reads fields from a message payload in sequence.
+// Once a read fails, all subsequent reads return zero values, and err
+// holds the first error.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 1 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) readUint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.buf) < 4 {
+		d.err = io.ErrUnexpectedEOF
+		return 0
+	}
+	n := byteOrder.Uint32(d.buf[:4])
+	d.buf = d.buf[4:]
+	return n
+}
+
+func (d *decoder) readInt32() int32 {
+	return int32(d.readUint32())
+}
+
+func (d *decoder) readBytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	b, rest, err := unmarshalBytes(d.buf)
+	if err != nil {
+		d.err = err
+		return nil
+	}
+	d.buf = rest
+	return b
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBytes())
+}
+
+func (d *decoder) readJSON(dest any) {
+	raw := d.readBytes()
+	if d.err != nil {
+		return
+	}
+	d.err = json.Unmarshal(raw, dest)
+}
@@ -0,0 +1,358 @@
+package mwproto
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// sampleMessages holds a message of every known type, with every field set.
+var sampleMessages = []Message{
+	ConnectMessage{ServerName: "Test Server"},
+	PingMessage{ReplyValue: 17},
+	DisconnectMessage{},
+	JoinMessage{DisplayName: "Me", RandoID: 42, PlayerID: 1, Mode: 1},
+	JoinConfirmMessage{},
+	ReadyMessage{Room: "room", Nickname: "Me", Mode: 1, ReadyMetadata: []KeyValuePair{{Key: "k", Value: "v"}}},
+	ReadyConfirmMessage{Ready: 2, Names: []string{"Me", "Other"}},
+	ReadyDenyMessage{Description: "no"},
+	UnreadyMessage{},
+	InitiateGameMessage{Options: struct{ RandomizationAlgorithm any }{RandomizationAlgorithm: "Default"}},
+	RequestRandoMessage{},
+	RandoGeneratedMessage{Items: map[string][]Placement{"Main Item Group": {{Item: "Lantern", Location: "Somewhere"}}}, Seed: 666},
+	largeResult(10),
+	DataReceiveMessage{Label: LabelMultiworldItem, Content: "Lantern", From: "Other", FromID: 1},
+	DatasReceiveMessage{Items: []DataReceiveItem{{Label: LabelMultiworldItem, Content: "Lantern"}}, From: "Other"},
+	DataReceiveConfirmMessage{Label: LabelMultiworldItem, Data: "Lantern", From: "Other"},
+	DatasReceiveConfirmMessage{Count: 1, From: "Other"},
+	SaveMessage{},
+	DataSendMessage{Label: LabelMultiworldItem, Content: "Lantern", To: 1, TTL: 5},
+	DataSendConfirmMessage{Label: LabelMultiworldItem, Content: "Lantern", To: 1},
+	RequestCharmNotchCostsMessage{},
+	AnnounceCharmNotchCostsMessage{PlayerID: 1, NotchCosts: map[int]int{1: 2}},
+	ConfirmCharmNotchCostsReceived{PlayerID: 1},
+	DatasSendMessage{Datas: []DataSendItem{{Label: LabelMultiworldItem, Content: "Lantern", To: 1}}},
+	DatasSendConfirmMessage{Count: 1},
+	ISReadyMessage{Room: "room", Nickname: "Me", Hash: "abc", ReadyMetadata: []KeyValuePair{{Key: "k", Value: "v"}}},
+	InitiateSyncGameMessage{Settings: "{}"},
+	ApplySettingsMessage{Settings: "{}"},
+	RequestSettingsMessage{},
+	ConnectedPlayersChangedMessage{Players: map[string]string{"1": "Me"}},
+	RawMessage{Type: 1000, Payload: []byte{1, 2, 3}},
+}
+
+func largeResult(n int) ResultMessage {
+	res := ResultMessage{
+		PlayerID:              1,
+		RandoID:               42,
+		Nicknames:             []string{"Other", "Me"},
+		ReadyMetadata:         [][]KeyValuePair{{}, {{Key: "k", Value: "v"}}},
+		Placements:            map[string][]ResultPlacement{},
+		PlayerItemsPlacements: map[string]string{},
+		GeneratedHash:         "hash",
+	}
+	res.ItemsSpoiler.IndividualWorldSpoilers = map[string]string{}
+	for i := range n {
+		item := fmt.Sprintf("MW(0)_Item_(%d)", i)
+		location := fmt.Sprintf("Location_(%d)", i)
+		res.Placements["Main Item Group"] = append(res.Placements["Main Item Group"], ResultPlacement{Item: item, Location: location})
+		res.PlayerItemsPlacements[item] = location
+		res.ItemsSpoiler.FullOrderedItemsLog += item + " at " + location + "\n"
+	}
+	res.ItemsSpoiler.IndividualWorldSpoilers["Me"] = res.ItemsSpoiler.FullOrderedItemsLog
+	return res
+}
+
+func largeDatasReceive(n int) DatasReceiveMessage {
+	msg := DatasReceiveMessage{From: "Other"}
+	for i := range n {
+		msg.Items = append(msg.Items, DataReceiveItem{Label: LabelMultiworldItem, Content: fmt.Sprintf("Item_(%d)", i)})
+	}
+	return msg
+}
+
+func TestCodecMatchesReflection(t *testing.T) {
+	for _, msg := range sampleMessages {
+		t.Run(fmt.Sprintf("%T", msg), func(t *testing.T) {
+			env := Envelope{SenderUID: 3, MessageID: 4, Message: msg}
+			var buf bytes.Buffer
+			if err := WriteEnvelope(&buf, env); err != nil {
+				t.Fatal(err)
+			}
+			frame := buf.Bytes()
+			want := reflectEncodeFrame(env)
+			if !bytes.Equal(frame, want) {
+				t.Fatalf("encoded as\n% 02x\nbut reflection encodes it as\n% 02x", frame, want)
+			}
+			got, err := ReadEnvelope(bytes.NewReader(frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, env) {
+				t.Errorf("decoded as %#v, want %#v", got, env)
+			}
+			fromReflect, err := reflectReadEnvelope(bytes.NewReader(frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, fromReflect) {
+				t.Errorf("decoded as %#v, but reflection decodes it as %#v", got, fromReflect)
+			}
+		})
+	}
+}
+
+func TestJSONEncodingMatchesReflection(t *testing.T) {
+	for _, s := range []string{"", "<a & b>", "quote \" and \\", "\b\f\n\r\t\x00\x1f\x7f", "héllo 世界 🦋", "\xff\xfe bad", "\u2028\u2029"} {
+		msg := DatasReceiveMessage{Items: []DataReceiveItem{{Label: s, Content: s}}, From: s}
+		frame := frameOf(t, msg)
+		if want := reflectEncodeFrame(Envelope{Message: msg}); !bytes.Equal(frame, want) {
+			t.Errorf("%q encoded as\n% 02x\nbut reflection encodes it as\n% 02x", s, frame, want)
+		}
+	}
+}
+
+func TestJSONDecodingMatchesReflection(t *testing.T) {
+	for _, items := range []string{
+		`null`,
+		`[]`,
+		` [ { "Label" : "a" , "Content" : "b" } ] `,
+		`[{"Content":"b","Label":"a"}]`,
+		`[{"label":"a","CONTENT":"b"}]`,
+		`[{"Label":"a","Extra":[1,{"x":null}],"Content":"b"}]`,
+		`[{"Label":null}]`,
+		`[{}]`,
+		`[{"Label":"\u00e9\n\/\"\\","Content":"\ud83e\udd8b"}]`,
+		`[{"Label":"\ud800","Content":"\udc00x"}]`,
+		`[{"Label":"<\u2028>"}]`,
+	} {
+		payload := appendString(nil, items)
+		payload = appendString(payload, "Other")
+		var buf bytes.Buffer
+		if err := Write(&buf, RawMessage{Type: uint32(typeDatasReceive), Payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadEnvelope(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Errorf("%s: %v", items, err)
+			continue
+		}
+		want, err := reflectReadEnvelope(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s decoded as %#v, but reflection decodes it as %#v", items, got, want)
+		}
+	}
+}
+
+func TestFrameBuffersFitFrames(t *testing.T) {
+	for _, n := range []int{0, 1, minFrameBuffer, minFrameBuffer + 1, 100 << 10, 1 << 24} {
+		bufp := getFrameBuffer(n)
+		if len(*bufp) != 0 || cap(*bufp) < n {
+			t.Errorf("getFrameBuffer(%d) returned a buffer of length %d and capacity %d", n, len(*bufp), cap(*bufp))
+		}
+		putFrameBuffer(bufp)
+	}
+}
+
+// Small frames mustn't be encoded into buffers left over from large ones.
+func TestLargeFrameBuffersAreKeptApart(t *testing.T) {
+	frame := frameOf(t, largeResult(5000))
+	if _, err := Read(bytes.NewReader(frame)); err != nil {
+		t.Fatal(err)
+	}
+	for range 10 {
+		b := make([]byte, 0, len(frame))
+		putFrameBuffer(&b)
+	}
+	for range 10 {
+		bufp := getFrameBuffer(0)
+		if cap(*bufp) >= frameBufferClassSize(1) {
+			t.Fatalf("got a %d-byte buffer for a small frame", cap(*bufp))
+		}
+	}
+}
+
+var benchmarkMessages = []struct {
+	name string
+	msg  Message
+}{
+	{"DataSend", DataSendMessage{Label: LabelMultiworldItem, Content: "Lantern_(12)", To: 1, TTL: 5}},
+	{"DatasReceive", largeDatasReceive(500)},
+	{"Result", largeResult(500)},
+}
+
+func BenchmarkWrite(b *testing.B) {
+	for _, bm := range benchmarkMessages {
+		b.Run(bm.name+"/Codec", func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				if err := Write(io.Discard, bm.msg); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(bm.name+"/Reflect", func(b *testing.B) {
+			b.ReportAllocs()
+			for range b.N {
+				if _, err := io.Discard.Write(reflectEncodeFrame(Envelope{Message: bm.msg})); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, bm := range benchmarkMessages {
+		var buf bytes.Buffer
+		if err := Write(&buf, bm.msg); err != nil {
+			b.Fatal(err)
+		}
+		frame := buf.Bytes()
+		b.Run(bm.name+"/Codec", func(b *testing.B) {
+			b.ReportAllocs()
+			r := bytes.NewReader(frame)
+			for range b.N {
+				r.Reset(frame)
+				if _, err := ReadEnvelope(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(bm.name+"/Reflect", func(b *testing.B) {
+			b.ReportAllocs()
+			r := bytes.NewReader(frame)
+			for range b.N {
+				r.Reset(frame)
+				if _, err := reflectReadEnvelope(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// What follows is the reflection-based codec that the per-message encoders
+// and decoders replaced, kept for comparison.
+
+func reflectEncodeFrame(env Envelope) []byte {
+	encoded := make([]byte, headerSize)
+	encoded = reflectAppendMessage(encoded, env.Message)
+	byteOrder.PutUint32(encoded[:4], toUint32(len(encoded)))
+	byteOrder.PutUint32(encoded[4:8], uint32(env.Message.msgType()))
+	byteOrder.PutUint64(encoded[8:16], env.SenderUID)
+	byteOrder.PutUint64(encoded[16:24], env.MessageID)
+	return encoded
+}
+
+func reflectAppendMessage(b []byte, m Message) []byte {
+	if raw, ok := m.(RawMessage); ok {
+		return append(b, raw.Payload...)
+	}
+	v := reflect.ValueOf(m)
+	for i := range v.NumField() {
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Uint8:
+			b = append(b, byte(field.Uint()))
+		case reflect.Int32:
+			b = byteOrder.AppendUint32(b, uint32(field.Int()))
+		case reflect.Uint32:
+			b = byteOrder.AppendUint32(b, uint32(field.Uint()))
+		case reflect.String:
+			b = appendString(b, field.String())
+		default:
+			b = appendJSON(b, field.Interface())
+		}
+	}
+	return b
+}
+
+// reflectMessageTypes maps message types to the types that reflectReadEnvelope
+// decodes them into.
+var reflectMessageTypes = map[messageType]reflect.Type{}
+
+func init() {
+	for _, msg := range sampleMessages {
+		if _, ok := msg.(RawMessage); !ok {
+			reflectMessageTypes[msg.msgType()] = reflect.TypeOf(msg)
+		}
+	}
+}
+
+func reflectReadEnvelope(r io.Reader) (Envelope, error) {
+	lengthBuf := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBuf); err != nil {
+		return Envelope{}, err
+	}
+	msgBuf := make([]byte, byteOrder.Uint32(lengthBuf)-4)
+	if _, err := io.ReadFull(r, msgBuf); err != nil {
+		return Envelope{}, err
+	}
+	env := Envelope{
+		SenderUID: byteOrder.Uint64(msgBuf[4:12]),
+		MessageID: byteOrder.Uint64(msgBuf[12:20]),
+	}
+	msgType := messageType(byteOrder.Uint32(msgBuf[:4]))
+	payload := msgBuf[headerSize-4:]
+	t, ok := reflectMessageTypes[msgType]
+	if !ok {
+		env.Message = RawMessage{Type: uint32(msgType), Payload: payload}
+		return env, nil
+	}
+	v := reflect.New(t).Elem()
+	if err := reflectUnmarshalInto(payload, v); err != nil {
+		return env, err
+	}
+	env.Message = v.Interface().(Message)
+	return env, nil
+}
+
+func reflectUnmarshalInto(payload []byte, v reflect.Value) error {
+	for i := range v.NumField() {
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Uint8:
+			if len(payload) == 0 {
+				return io.ErrUnexpectedEOF
+			}
+			field.SetUint(uint64(payload[0]))
+			payload = payload[1:]
+		case reflect.Int32:
+			if len(payload) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			field.SetInt(int64(int32(byteOrder.Uint32(payload[:4]))))
+			payload = payload[4:]
+		case reflect.Uint32:
+			if len(payload) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			field.SetUint(uint64(byteOrder.Uint32(payload[:4])))
+			payload = payload[4:]
+		case reflect.String:
+			s, rest, err := unmarshalBytes(payload)
+			if err != nil {
+				return err
+			}
+			payload = rest
+			field.SetString(string(s))
+		default:
+			raw, rest, err := unmarshalBytes(payload)
+			if err != nil {
+				return err
+			}
+			payload = rest
+			if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -5,6 +5,12 @@ import (
 	"strings"
 )
 
+// QualifyName prefixes name with the ID of the player it belongs to, as the
+// server does in Result messages.
+func QualifyName(pid int, name string) string {
+	return "MW(" + strconv.Itoa(pid) + ")_" + name
+}
+
 func ParseQualifiedName(name string) (pid int, item string, ok bool) {
 	const prefix = "MW("
 
@@ -23,27 +29,107 @@ func ParseQualifiedName(name string) (pid int, item string, ok bool) {
 	return int(n), item, ok
 }
 
-func ParseDiscriminator(name string) (discriminator int64, ok bool) {
-	name, ok = strings.CutSuffix(name, ")")
-	if !ok {
-		return
+// A Name is an item or location name together with the extra information
+// that is encoded into it when it is sent to MW.
+//
+// Encoded names have the form
+//
+//	name_[game]_(n)
+//
+// where both suffixes are optional: game is the game the item or location
+// comes from, and n is a discriminator that makes the name unique. In name
+// and game, "%", control characters, and any "(" or "[" that follows an "_"
+// are percent-encoded, so that the suffixes can always be told apart from
+// the rest and every Name decodes back to exactly what was encoded.
+type Name struct {
+	Name             string
+	Game             string
+	Discriminator    int64
+	HasDiscriminator bool
+}
+
+// Encode returns n in the form described above.
+func (n Name) Encode() string {
+	var b strings.Builder
+	escapeName(&b, n.Name)
+	if n.Game != "" {
+		b.WriteString("_[")
+		escapeName(&b, n.Game)
+		b.WriteString("]")
 	}
-	i := strings.LastIndex(name, "_(")
-	if i == -1 {
-		return
+	if n.HasDiscriminator {
+		b.WriteString("_(")
+		b.WriteString(strconv.FormatInt(n.Discriminator, 10))
+		b.WriteString(")")
 	}
-	n, err := strconv.ParseInt(name[i+2:], 10, 64)
-	if err != nil {
-		return
+	return b.String()
+}
+
+func escapeName(b *strings.Builder, s string) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' || c < 0x20 || c == 0x7f || (c == '(' || c == '[') && i > 0 && s[i-1] == '_' {
+			const hex = "0123456789ABCDEF"
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&0xf])
+		} else {
+			b.WriteByte(c)
+		}
 	}
-	return n, true
 }
 
-func StripDiscriminator(name string) string {
-	name, _ = strings.CutSuffix(name, ")")
-	i := strings.LastIndex(name, "_(")
-	if i == -1 {
-		return name
+// DecodeName splits an encoded name into its parts. Names that weren't made
+// by Encode are accepted too; they simply have no game, and no discriminator
+// unless they happen to end in one.
+func DecodeName(s string) Name {
+	var n Name
+	if rest, ok := strings.CutSuffix(s, ")"); ok {
+		if i := strings.LastIndex(rest, "_("); i != -1 {
+			if d, err := strconv.ParseInt(rest[i+2:], 10, 64); err == nil {
+				n.Discriminator = d
+				n.HasDiscriminator = true
+				s = rest[:i]
+			}
+		}
+	}
+	if rest, ok := strings.CutSuffix(s, "]"); ok {
+		if i := strings.LastIndex(rest, "_["); i != -1 {
+			n.Game = unescapeName(rest[i+2:])
+			s = rest[:i]
+		}
+	}
+	n.Name = unescapeName(s)
+	return n
+}
+
+func unescapeName(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
 	}
-	return name[:i]
+	return b.String()
+}
+
+// ParseDiscriminator returns the discriminator of an encoded name, if it has
+// one.
+func ParseDiscriminator(name string) (discriminator int64, ok bool) {
+	n := DecodeName(name)
+	return n.Discriminator, n.HasDiscriminator
+}
+
+// StripDiscriminator returns the decoded name of an item or location, without
+// its game or discriminator.
+func StripDiscriminator(name string) string {
+	return DecodeName(name).Name
 }
@@ -0,0 +1,79 @@
+package mwproto
+
+import "testing"
+
+var awkwardNames = []Name{
+	{Name: "Geo_Rock-Crossroads_Above_Lever"},
+	{Name: "Geo_Rock-Crossroads_Above_Lever", Discriminator: 3, HasDiscriminator: true},
+	{Name: "Grub", Game: "Hollow Knight", Discriminator: -1, HasDiscriminator: true},
+	{Name: "100% Completion", Game: "50%_Off"},
+	{Name: "Key_(Old)", Game: "Game_[Remastered]"},
+	{Name: "Key_(7)"},
+	{Name: "Key_[Game]"},
+	{Name: "Key_[Game]_(7)"},
+	{Name: "Trailing_", Game: "_", Discriminator: 1, HasDiscriminator: true},
+	{Name: "_", Discriminator: 0, HasDiscriminator: true},
+	{Name: "(Parenthesised)", Game: "[Bracketed]"},
+	{Name: "Unbalanced)", Game: "]"},
+	{Name: "Percent %41 escape", Game: "%"},
+	{Name: "Line\nbreak", Game: "Tab\tbed"},
+	{Name: "", Game: "Empty Name"},
+	{},
+}
+
+func TestNameRoundTrip(t *testing.T) {
+	for _, n := range awkwardNames {
+		encoded := n.Encode()
+		if got := DecodeName(encoded); got != n {
+			t.Errorf("%#v encodes as %q, which decodes as %#v", n, encoded, got)
+		}
+	}
+}
+
+func TestDecodeForeignName(t *testing.T) {
+	tests := []struct {
+		encoded string
+		want    Name
+	}{
+		{"Mask_Shard-Seer", Name{Name: "Mask_Shard-Seer"}},
+		{"Geo_Rock-Crossroads_Above_Lever_(12)", Name{Name: "Geo_Rock-Crossroads_Above_Lever", Discriminator: 12, HasDiscriminator: true}},
+		{"Charm_(Unbreakable)", Name{Name: "Charm_(Unbreakable)"}},
+		{"Shade_Cloak_()", Name{Name: "Shade_Cloak_()"}},
+		{"Odd_[Game]_(x)", Name{Name: "Odd_[Game]_(x)"}},
+		{"Lone %", Name{Name: "Lone %"}},
+	}
+	for _, test := range tests {
+		if got := DecodeName(test.encoded); got != test.want {
+			t.Errorf("DecodeName(%q) = %#v, want %#v", test.encoded, got, test.want)
+		}
+	}
+}
+
+func TestParseDiscriminator(t *testing.T) {
+	for _, n := range awkwardNames {
+		encoded := n.Encode()
+		d, ok := ParseDiscriminator(encoded)
+		if d != n.Discriminator || ok != n.HasDiscriminator {
+			t.Errorf("ParseDiscriminator(%q) = %d, %v; want %d, %v", encoded, d, ok, n.Discriminator, n.HasDiscriminator)
+		}
+		if got := StripDiscriminator(encoded); got != n.Name {
+			t.Errorf("StripDiscriminator(%q) = %q, want %q", encoded, got, n.Name)
+		}
+	}
+}
+
+func FuzzNameRoundTrip(f *testing.F) {
+	for _, n := range awkwardNames {
+		f.Add(n.Name, n.Game, n.Discriminator, n.HasDiscriminator)
+	}
+	f.Fuzz(func(t *testing.T, name, game string, d int64, hasDiscriminator bool) {
+		if !hasDiscriminator {
+			d = 0
+		}
+		n := Name{Name: name, Game: game, Discriminator: d, HasDiscriminator: hasDiscriminator}
+		encoded := n.Encode()
+		if got := DecodeName(encoded); got != n {
+			t.Fatalf("%#v encodes as %q, which decodes as %#v", n, encoded, got)
+		}
+	})
+}
@@ -0,0 +1,499 @@
+package mwproto
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"unicode/utf8"
+)
+
+// The largest messages (results and batches of received items) are mostly
+// JSON, which encoding/json spends most of its time reflecting over. The
+// functions here encode and decode the concrete types those messages carry
+// directly instead.
+//
+// Encoding produces exactly what encoding/json would. Decoding only
+// understands the JSON that encoding produces, give or take whitespace and
+// escapes; anything else, such as differently capitalised field names, is
+// handed to encoding/json, so that the result is always the same as with
+// encoding/json alone.
+
+// appendJSONWith appends v as a length-prefixed JSON string, like appendJSON,
+// encoding it with encode.
+func appendJSONWith[T any](out []byte, v T, encode func([]byte, T) []byte) []byte {
+	// Leave room for the longest length prefix, and move the JSON back once
+	// its length is known.
+	const maxPrefix = 5
+	start := len(out)
+	out = encode(append(out, make([]byte, maxPrefix)...), v)
+	n := len(out) - start - maxPrefix
+	var prefix [maxPrefix]byte
+	p := appendVarint32(prefix[:0], n)
+	copy(out[start+len(p):], out[start+maxPrefix:])
+	copy(out[start:], p)
+	return out[:len(out)-(maxPrefix-len(p))]
+}
+
+// readJSONWith reads a length-prefixed JSON string into dest, like
+// decoder.readJSON, decoding it with parse if possible.
+func readJSONWith[T any](d *decoder, dest *T, parse func(*jsonReader) T) {
+	raw := d.readBytes()
+	if d.err != nil {
+		return
+	}
+	r := jsonReader{buf: raw, ok: true}
+	v := parse(&r)
+	r.end()
+	if r.ok {
+		*dest = v
+		return
+	}
+	d.err = json.Unmarshal(raw, dest)
+}
+
+// appendJSONString appends s quoted as encoding/json quotes it: with HTML
+// characters, U+2028 and U+2029 escaped, and invalid UTF-8 replaced.
+func appendJSONString(out []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	out = append(out, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			out = append(out, s[start:i]...)
+			switch b {
+			case '\\', '"':
+				out = append(out, '\\', b)
+			case '\b':
+				out = append(out, '\\', 'b')
+			case '\f':
+				out = append(out, '\\', 'f')
+			case '\n':
+				out = append(out, '\\', 'n')
+			case '\r':
+				out = append(out, '\\', 'r')
+			case '\t':
+				out = append(out, '\\', 't')
+			default:
+				out = append(out, '\\', 'u', '0', '0', hex[b>>4], hex[b&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case c == utf8.RuneError && size == 1:
+			out = append(out, s[start:i]...)
+			out = utf8.AppendRune(out, utf8.RuneError)
+		case c == '\u2028' || c == '\u2029':
+			out = append(out, s[start:i]...)
+			out = append(out, '\\', 'u', '2', '0', '2', hex[c&0xF])
+		default:
+			i += size
+			continue
+		}
+		i += size
+		start = i
+	}
+	out = append(out, s[start:]...)
+	return append(out, '"')
+}
+
+func appendJSONArray[T any](out []byte, items []T, encode func([]byte, T) []byte) []byte {
+	if items == nil {
+		return append(out, "null"...)
+	}
+	out = append(out, '[')
+	for i, item := range items {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		out = encode(out, item)
+	}
+	return append(out, ']')
+}
+
+// appendJSONObject appends m as a JSON object, with its keys sorted as
+// encoding/json does.
+func appendJSONObject[V any](out []byte, m map[string]V, encode func([]byte, V) []byte) []byte {
+	if m == nil {
+		return append(out, "null"...)
+	}
+	out = append(out, '{')
+	for i, k := range slices.Sorted(maps.Keys(m)) {
+		if i > 0 {
+			out = append(out, ',')
+		}
+		out = appendJSONString(out, k)
+		out = append(out, ':')
+		out = encode(out, m[k])
+	}
+	return append(out, '}')
+}
+
+// appendJSONTuple appends a C# tuple of two strings; see [ResultPlacement].
+func appendJSONTuple(out []byte, item1, item2 string) []byte {
+	out = append(out, `{"Item1":`...)
+	out = appendJSONString(out, item1)
+	out = append(out, `,"Item2":`...)
+	out = appendJSONString(out, item2)
+	return append(out, '}')
+}
+
+func appendJSONStrings(out []byte, ss []string) []byte {
+	return appendJSONArray(out, ss, appendJSONString)
+}
+
+func appendJSONStringMap(out []byte, m map[string]string) []byte {
+	return appendJSONObject(out, m, appendJSONString)
+}
+
+func appendJSONKeyValuePair(out []byte, kv KeyValuePair) []byte {
+	return appendJSONTuple(out, kv.Key, kv.Value)
+}
+
+func appendJSONMetadata(out []byte, metadata [][]KeyValuePair) []byte {
+	return appendJSONArray(out, metadata, func(out []byte, kvs []KeyValuePair) []byte {
+		return appendJSONArray(out, kvs, appendJSONKeyValuePair)
+	})
+}
+
+func appendJSONSpoilerLogs(out []byte, s SpoilerLogs) []byte {
+	out = append(out, `{"FullOrderedItemsLog":`...)
+	out = appendJSONString(out, s.FullOrderedItemsLog)
+	out = append(out, `,"IndividualWorldSpoilers":`...)
+	out = appendJSONStringMap(out, s.IndividualWorldSpoilers)
+	return append(out, '}')
+}
+
+func appendJSONPlacements(out []byte, placements map[string][]ResultPlacement) []byte {
+	return appendJSONObject(out, placements, func(out []byte, ps []ResultPlacement) []byte {
+		return appendJSONArray(out, ps, func(out []byte, p ResultPlacement) []byte {
+			return appendJSONTuple(out, p.Item, p.Location)
+		})
+	})
+}
+
+func appendJSONReceivedItems(out []byte, items []DataReceiveItem) []byte {
+	return appendJSONArray(out, items, func(out []byte, item DataReceiveItem) []byte {
+		return appendJSONTuple(out, item.Label, item.Content)
+	})
+}
+
+// A jsonReader decodes JSON of a known shape. Once it meets anything it
+// doesn't expect, ok is cleared and everything read from it is meaningless.
+type jsonReader struct {
+	buf []byte
+	pos int
+	ok  bool
+	// scratch holds the last string read that had escapes in it.
+	scratch []byte
+	// interned holds recently read short strings, which are often repeated,
+	// such as the labels of received items.
+	interned [64]string
+}
+
+func (r *jsonReader) fail() {
+	r.ok = false
+	r.pos = len(r.buf)
+}
+
+func (r *jsonReader) skipSpace() {
+	for r.pos < len(r.buf) {
+		switch r.buf[r.pos] {
+		case ' ', '\t', '\n', '\r':
+			r.pos++
+		default:
+			return
+		}
+	}
+}
+
+// peek returns the next byte that isn't whitespace, or 0 at the end.
+func (r *jsonReader) peek() byte {
+	r.skipSpace()
+	if r.pos == len(r.buf) {
+		return 0
+	}
+	return r.buf[r.pos]
+}
+
+func (r *jsonReader) expect(c byte) {
+	if r.peek() != c {
+		r.fail()
+		return
+	}
+	r.pos++
+}
+
+// null consumes a null, if that's what comes next.
+func (r *jsonReader) null() bool {
+	if r.peek() == 'n' && len(r.buf)-r.pos >= 4 && string(r.buf[r.pos:r.pos+4]) == "null" {
+		r.pos += 4
+		return true
+	}
+	return false
+}
+
+func (r *jsonReader) end() {
+	if r.peek() != 0 {
+		r.fail()
+	}
+}
+
+func (r *jsonReader) string() string {
+	b := r.stringBytes()
+	if len(b) == 0 || len(b) > 16 {
+		return string(b)
+	}
+	h := &r.interned[(len(b)+int(b[0])+int(b[len(b)-1]))%len(r.interned)]
+	if *h != string(b) {
+		*h = string(b)
+	}
+	return *h
+}
+
+// stringBytes reads a string. The result is only valid until the next read.
+func (r *jsonReader) stringBytes() []byte {
+	r.expect('"')
+	if !r.ok {
+		return nil
+	}
+	start := r.pos
+	ascii := true
+	for i := start; i < len(r.buf); i++ {
+		switch c := r.buf[i]; {
+		case c == '"':
+			s := r.buf[start:i]
+			if !ascii && !utf8.Valid(s) {
+				// encoding/json replaces invalid UTF-8; let it.
+				r.fail()
+				return nil
+			}
+			r.pos = i + 1
+			return s
+		case c == '\\':
+			return r.escapedString(start, i)
+		case c < 0x20:
+			r.fail()
+			return nil
+		case c >= utf8.RuneSelf:
+			ascii = false
+		}
+	}
+	r.fail()
+	return nil
+}
+
+// escapedString reads the rest of a string that starts at start and has its
+// first escape at i.
+func (r *jsonReader) escapedString(start, i int) []byte {
+	s := append(r.scratch[:0], r.buf[start:i]...)
+	defer func() { r.scratch = s[:0] }()
+	for i < len(r.buf) {
+		c := r.buf[i]
+		switch {
+		case c == '"':
+			if !utf8.Valid(s) {
+				r.fail()
+				return nil
+			}
+			r.pos = i + 1
+			return s
+		case c < 0x20:
+			r.fail()
+			return nil
+		case c != '\\':
+			s = append(s, c)
+			i++
+			continue
+		}
+		if i+1 == len(r.buf) {
+			break
+		}
+		switch e := r.buf[i+1]; e {
+		case '"', '\\', '/':
+			s = append(s, e)
+		case 'b':
+			s = append(s, '\b')
+		case 'f':
+			s = append(s, '\f')
+		case 'n':
+			s = append(s, '\n')
+		case 'r':
+			s = append(s, '\r')
+		case 't':
+			s = append(s, '\t')
+		case 'u':
+			c, ok := r.hex4(i + 2)
+			if !ok || utf8.RuneLen(c) < 0 {
+				// Including surrogates, which encoding/json pairs up or
+				// replaces.
+				r.fail()
+				return nil
+			}
+			s = utf8.AppendRune(s, c)
+			i += 4
+		default:
+			r.fail()
+			return nil
+		}
+		i += 2
+	}
+	r.fail()
+	return nil
+}
+
+func (r *jsonReader) hex4(i int) (rune, bool) {
+	if len(r.buf)-i < 4 {
+		return 0, false
+	}
+	var c rune
+	for _, h := range r.buf[i : i+4] {
+		switch {
+		case '0' <= h && h <= '9':
+			h -= '0'
+		case 'a' <= h && h <= 'f':
+			h -= 'a' - 10
+		case 'A' <= h && h <= 'F':
+			h -= 'A' - 10
+		default:
+			return 0, false
+		}
+		c = c<<4 | rune(h)
+	}
+	return c, true
+}
+
+// readJSONArray reads an array, or null as a nil slice.
+func readJSONArray[T any](r *jsonReader, read func(*jsonReader) T) []T {
+	if r.null() {
+		return nil
+	}
+	r.expect('[')
+	items := []T{}
+	if r.peek() == ']' {
+		r.pos++
+		return items
+	}
+	for r.ok {
+		items = append(items, read(r))
+		if r.peek() == ',' {
+			r.pos++
+			continue
+		}
+		r.expect(']')
+		break
+	}
+	return items
+}
+
+// readJSONFields reads an object, calling read for each of its fields.
+func readJSONFields(r *jsonReader, read func(r *jsonReader, key []byte)) {
+	r.expect('{')
+	if r.peek() == '}' {
+		r.pos++
+		return
+	}
+	for r.ok {
+		key := r.stringBytes()
+		r.expect(':')
+		if !r.ok {
+			return
+		}
+		read(r, key)
+		if r.peek() == ',' {
+			r.pos++
+			continue
+		}
+		r.expect('}')
+		break
+	}
+}
+
+// readJSONObject reads an object as a map, or null as a nil map.
+func readJSONObject[V any](r *jsonReader, read func(*jsonReader) V) map[string]V {
+	if r.null() {
+		return nil
+	}
+	m := map[string]V{}
+	readJSONFields(r, func(r *jsonReader, key []byte) {
+		k := string(key)
+		m[k] = read(r)
+	})
+	return m
+}
+
+// readJSONTuple reads a C# tuple of two strings; see [ResultPlacement].
+func readJSONTuple(r *jsonReader) (item1, item2 string) {
+	if r.null() {
+		return
+	}
+	readJSONFields(r, func(r *jsonReader, key []byte) {
+		switch string(key) {
+		case "Item1":
+			item1 = r.string()
+		case "Item2":
+			item2 = r.string()
+		default:
+			r.fail()
+		}
+	})
+	return
+}
+
+func readJSONStrings(r *jsonReader) []string {
+	return readJSONArray(r, (*jsonReader).string)
+}
+
+func readJSONStringMap(r *jsonReader) map[string]string {
+	return readJSONObject(r, (*jsonReader).string)
+}
+
+func readJSONKeyValuePair(r *jsonReader) KeyValuePair {
+	k, v := readJSONTuple(r)
+	return KeyValuePair{Key: k, Value: v}
+}
+
+func readJSONMetadata(r *jsonReader) [][]KeyValuePair {
+	return readJSONArray(r, func(r *jsonReader) []KeyValuePair {
+		return readJSONArray(r, readJSONKeyValuePair)
+	})
+}
+
+func readJSONSpoilerLogs(r *jsonReader) (s SpoilerLogs) {
+	if r.null() {
+		return
+	}
+	readJSONFields(r, func(r *jsonReader, key []byte) {
+		switch string(key) {
+		case "FullOrderedItemsLog":
+			s.FullOrderedItemsLog = r.string()
+		case "IndividualWorldSpoilers":
+			s.IndividualWorldSpoilers = readJSONStringMap(r)
+		default:
+			r.fail()
+		}
+	})
+	return
+}
+
+func readJSONPlacements(r *jsonReader) map[string][]ResultPlacement {
+	return readJSONObject(r, func(r *jsonReader) []ResultPlacement {
+		return readJSONArray(r, func(r *jsonReader) ResultPlacement {
+			item, location := readJSONTuple(r)
+			return ResultPlacement{Item: item, Location: location}
+		})
+	})
+}
+
+func readJSONReceivedItems(r *jsonReader) []DataReceiveItem {
+	return readJSONArray(r, func(r *jsonReader) DataReceiveItem {
+		label, content := readJSONTuple(r)
+		return DataReceiveItem{Label: label, Content: content}
+	})
+}
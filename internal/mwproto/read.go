@@ -1,37 +1,121 @@
 package mwproto
 
 import (
-	"encoding/json"
 	"fmt"
 	"io"
-	"reflect"
+	"slices"
 )
 
 const headerSize = 24
 
+// Read reads a single message, discarding its header.
 func Read(r io.Reader) (Message, error) {
+	env, err := ReadEnvelope(r)
+	return env.Message, err
+}
+
+// ReadEnvelope reads a single message along with its header.
+// Messages of unknown types are returned as a [RawMessage].
+//
+// If the stream can't be split into messages, the error is a *FramingError
+// and the stream must not be read from any further. If a message was read
+// whole but its payload is malformed, the error is a *PayloadError, and the
+// next message can still be read. A stream that ends cleanly between messages
+// yields an error wrapping [io.EOF].
+func ReadEnvelope(r io.Reader) (Envelope, error) {
+	return readEnvelope(r, nil)
+}
+
+func readEnvelope(r io.Reader, tap Tap) (Envelope, error) {
 	const lengthFieldSize = 4
 	const minMessageSize = headerSize
 	const maxMessageSize = 1 << 24
 
-	lengthBuf := make([]byte, lengthFieldSize)
+	bufp := getFrameBuffer(0)
+	defer func() { putFrameBuffer(bufp) }()
+
+	lengthBuf := (*bufp)[:lengthFieldSize]
 	if _, err := io.ReadFull(r, lengthBuf); err != nil {
-		return nil, fmt.Errorf("read message: %w", err)
+		if err == io.EOF {
+			return Envelope{}, fmt.Errorf("read message: %w", err)
+		}
+		return Envelope{}, &FramingError{Err: err}
 	}
 	length := byteOrder.Uint32(lengthBuf)
 	if length < minMessageSize || length > maxMessageSize {
-		// Skip any remaining bytes in the message.
-		_, _ = io.CopyN(io.Discard, r, int64(length)-int64(len(lengthBuf)))
-		return nil, fmt.Errorf("read message: length out of bounds: got %d, want at least %d and at most %d", length, minMessageSize, maxMessageSize)
+		return Envelope{}, &FramingError{Err: fmt.Errorf("length out of bounds: got %d, want at least %d and at most %d", length, minMessageSize, maxMessageSize)}
+	}
+
+	// The buffer is reused for later messages, so nothing decoded from it
+	// may keep referencing it.
+	if int(length) > cap(*bufp) {
+		small := bufp
+		bufp = getFrameBuffer(int(length))
+		*bufp = append((*bufp)[:0], lengthBuf...)
+		putFrameBuffer(small)
+	}
+	// lengthBuf is the start of the buffer's backing array, or was copied
+	// to the start of the bigger one, so reslicing the empty buffer up to
+	// the frame's length leaves the length field in place at its start.
+	frame := (*bufp)[:length]
+	if _, err := io.ReadFull(r, frame[lengthFieldSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Envelope{}, &FramingError{Err: err}
+	}
+	env, err := DecodeFrame(frame)
+	if tap != nil {
+		tap(false, frame, env.Message)
 	}
+	return env, err
+}
 
-	msgBuf := make([]byte, length-lengthFieldSize)
-	if _, err := io.ReadFull(r, msgBuf); err != nil {
-		return nil, fmt.Errorf("read message: %w", err)
+// DecodeFrame decodes a whole message, including its length prefix, as
+// previously read from the wire.
+func DecodeFrame(frame []byte) (Envelope, error) {
+	if len(frame) < headerSize || int(byteOrder.Uint32(frame[:4])) != len(frame) {
+		return Envelope{}, &FramingError{Err: fmt.Errorf("frame length doesn't match length field")}
+	}
+	env := Envelope{
+		SenderUID: byteOrder.Uint64(frame[8:16]),
+		MessageID: byteOrder.Uint64(frame[16:24]),
+	}
+	msgType := messageType(byteOrder.Uint32(frame[4:8]))
+	msg, err := decodePayload(msgType, frame[headerSize:])
+	if err != nil {
+		return env, &PayloadError{Type: uint32(msgType), Err: err}
 	}
-	msgType := messageType(byteOrder.Uint32(msgBuf[:4]))
-	payload := msgBuf[headerSize-lengthFieldSize:]
-	// SenderUID and MessageID can be ignored.
+	env.Message = msg
+	return env, nil
+}
+
+// A FramingError indicates that a message's length prefix was invalid, or
+// that the stream ended in the middle of a message.
+type FramingError struct {
+	Err error
+}
+
+func (e *FramingError) Error() string {
+	return "read message: bad framing: " + e.Err.Error()
+}
+
+func (e *FramingError) Unwrap() error { return e.Err }
+
+// A PayloadError indicates that a message of the given type was received
+// whole, but its fields could not be decoded.
+type PayloadError struct {
+	Type uint32
+	Err  error
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("read message: bad payload for message type %d: %v", e.Type, e.Err)
+}
+
+func (e *PayloadError) Unwrap() error { return e.Err }
+
+func decodePayload(msgType messageType, payload []byte) (Message, error) {
 	switch msgType {
 	case typeConnect:
 		return unmarshal[ConnectMessage](payload)
@@ -43,110 +127,113 @@ func Read(r io.Reader) (Message, error) {
 		return unmarshal[ReadyMessage](payload)
 	case typeReadyConfirm:
 		return unmarshal[ReadyConfirmMessage](payload)
+	case typeReadyDeny:
+		return unmarshal[ReadyDenyMessage](payload)
 	case typeJoin:
 		return unmarshal[JoinMessage](payload)
 	case typeJoinConfirm:
-		return JoinConfirmMessage{}, nil
+		return empty[JoinConfirmMessage](payload)
 	case typeUnready:
-		return UnreadyMessage{}, nil
+		return empty[UnreadyMessage](payload)
 	case typeInitiateGame:
 		return unmarshal[InitiateGameMessage](payload)
 	case typeRequestRando:
-		return RequestRandoMessage{}, nil
+		return empty[RequestRandoMessage](payload)
 	case typeRandoGenerated:
 		return unmarshal[RandoGeneratedMessage](payload)
 	case typeResult:
 		return unmarshal[ResultMessage](payload)
+	case typeSave:
+		return empty[SaveMessage](payload)
+	case typeDataSend:
+		return unmarshal[DataSendMessage](payload)
+	case typeDataSendConfirm:
+		return unmarshal[DataSendConfirmMessage](payload)
 	case typeDataReceive:
 		return unmarshal[DataReceiveMessage](payload)
+	case typeDataReceiveConfirm:
+		return unmarshal[DataReceiveConfirmMessage](payload)
+	case typeDatasSend:
+		return unmarshal[DatasSendMessage](payload)
+	case typeDatasSendConfirm:
+		return unmarshal[DatasSendConfirmMessage](payload)
 	case typeDatasReceive:
 		return unmarshal[DatasReceiveMessage](payload)
-	case typeDataSendConfirm:
-		return unmarshal[DataSendConfirmMessage](payload)
+	case typeDatasReceiveConfirm:
+		return unmarshal[DatasReceiveConfirmMessage](payload)
 	case typeAnnounceCharmNotchCosts:
 		return unmarshal[AnnounceCharmNotchCostsMessage](payload)
 	case typeRequestCharmNotchCosts:
-		return RequestCharmNotchCostsMessage{}, nil
+		return empty[RequestCharmNotchCostsMessage](payload)
 	case typeConfirmCharmNotchCostsReceived:
-		return ConfirmCharmNotchCostsReceived{}, nil
+		return unmarshal[ConfirmCharmNotchCostsReceived](payload)
+	case typeInitiateSyncGame:
+		return unmarshal[InitiateSyncGameMessage](payload)
+	case typeApplySettings:
+		return unmarshal[ApplySettingsMessage](payload)
+	case typeRequestSettings:
+		return empty[RequestSettingsMessage](payload)
+	case typeISReady:
+		return unmarshal[ISReadyMessage](payload)
+	case typeConnectedPlayersChanged:
+		return unmarshal[ConnectedPlayersChangedMessage](payload)
 	default:
-		return nil, fmt.Errorf("read message: unknown message type: %d", msgType)
+		return RawMessage{Type: uint32(msgType), Payload: slices.Clone(payload)}, nil
 	}
 }
 
-func unmarshal[T Message](payload []byte) (T, error) {
+func unmarshal[T Message, P interface {
+	*T
+	decode(*decoder)
+}](payload []byte) (Message, error) {
 	var msg T
-	err := unmarshalInto(payload, reflect.ValueOf(&msg).Elem())
-	return msg, err
+	d := decoder{buf: payload}
+	P(&msg).decode(&d)
+	if d.err == nil && len(d.buf) != 0 {
+		d.err = fmt.Errorf("%d trailing bytes after last field", len(d.buf))
+	}
+	return msg, d.err
 }
 
-func unmarshalInto(payload []byte, v reflect.Value) error {
-	for i := range v.NumField() {
-		field := v.Field(i)
-		switch field.Kind() {
-		case reflect.Uint8:
-			if len(payload) == 0 {
-				return io.ErrUnexpectedEOF
-			}
-			field.SetUint(uint64(payload[0]))
-			payload = payload[1:]
-		case reflect.Int32:
-			if len(payload) < 4 {
-				return io.ErrUnexpectedEOF
-			}
-			field.SetInt(int64(int32(byteOrder.Uint32(payload[:4]))))
-			payload = payload[4:]
-		case reflect.Uint32:
-			if len(payload) < 4 {
-				return io.ErrUnexpectedEOF
-			}
-			field.SetUint(uint64(byteOrder.Uint32(payload[:4])))
-			payload = payload[4:]
-		case reflect.String:
-			s, rest, err := unmarshalString(payload)
-			if err != nil {
-				return err
-			}
-			payload = rest
-			field.SetString(s)
-		default:
-			rest, err := unmarshalJSON(payload, field.Addr().Interface())
-			if err != nil {
-				return err
-			}
-			payload = rest
-		}
+// empty decodes a message that has no fields.
+func empty[T Message](payload []byte) (Message, error) {
+	var msg T
+	if len(payload) != 0 {
+		return msg, fmt.Errorf("%d trailing bytes after last field", len(payload))
 	}
-	return nil
+	return msg, nil
 }
 
-func unmarshalString(payload []byte) (str string, remainder []byte, err error) {
-	b, r, err := unmarshalBytes(payload)
-	return string(b), r, err
+func unmarshalBytes(payload []byte) (str []byte, remainder []byte, err error) {
+	length, n, err := readVarint32(payload)
+	if err != nil {
+		return nil, payload, err
+	}
+	if length < 0 {
+		return nil, payload, fmt.Errorf("negative string value length: %d", length)
+	}
+	start := n
+	if int64(length) > int64(len(payload)-start) {
+		return nil, payload, fmt.Errorf("string value length exceeds message payload; got %d, remaining payload is %d bytes long", length, len(payload)-start)
+	}
+	end := start + int(length)
+	return payload[start:end], payload[end:], nil
 }
 
-func unmarshalBytes(payload []byte) (str []byte, remainder []byte, err error) {
-	length := 0
+// readVarint32 is the inverse of appendVarint32. Like .NET's
+// Read7BitEncodedInt, it accepts at most 5 bytes, the last of which may only
+// contribute the 4 bits remaining in a 32-bit value.
+func readVarint32(payload []byte) (x int32, n int, err error) {
+	const maxBytes = 5
+	var u uint32
 	for i, b := range payload {
-		length |= int(b&0x7f) << (i * 7)
-		if b&0x80 != 0 {
-			continue
+		if i == maxBytes-1 && b > 0x0f {
+			return 0, 0, fmt.Errorf("string value length overflows 32 bits: % 02x", payload[:i+1])
 		}
-		start := i + 1
-		end := start + length
-		if end > len(payload) {
-			return nil, payload, fmt.Errorf("string value length exceeds message payload; got %d, remaining payload is %d bytes long", length, len(payload))
+		u |= uint32(b&0x7f) << (i * 7)
+		if b&0x80 == 0 {
+			return int32(u), i + 1, nil
 		}
-		return payload[start:end], payload[end:], nil
-	}
-	return nil, payload, fmt.Errorf("unterminated string value length: % 02x", payload)
-}
-
-func unmarshalJSON(payload []byte, dest any) (remainder []byte, err error) {
-	raw, remainder, err := unmarshalBytes(payload)
-	if err != nil {
-		return
 	}
-	err = json.Unmarshal(raw, dest)
-	return
+	return 0, 0, fmt.Errorf("unterminated string value length: % 02x", payload)
 }
@@ -0,0 +1,129 @@
+package mwproto
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func frameOf(t testing.TB, msg Message) []byte {
+	var buf bytes.Buffer
+	if err := Write(&buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withPayload returns frame with extra appended to its payload.
+func withPayload(frame []byte, extra ...byte) []byte {
+	frame = append(bytes.Clone(frame), extra...)
+	byteOrder.PutUint32(frame[:4], uint32(len(frame)))
+	return frame
+}
+
+func TestReadRejectsTrailingBytes(t *testing.T) {
+	for _, msg := range sampleMessages {
+		if _, ok := msg.(RawMessage); ok {
+			continue
+		}
+		frame := withPayload(frameOf(t, msg), 0)
+		_, err := Read(bytes.NewReader(frame))
+		var perr *PayloadError
+		if !errors.As(err, &perr) {
+			t.Errorf("%T with a trailing byte: got error %v, want a *PayloadError", msg, err)
+		}
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	connect := frameOf(t, ConnectMessage{ServerName: "Test Server"})
+	truncatedString := bytes.Clone(connect)
+	truncatedString[headerSize] = 100
+	overflowingLength := withPayload(frameOf(t, ConnectMessage{})[:headerSize], 0xff, 0xff, 0xff, 0xff, 0x7f)
+	tooLong := bytes.Clone(connect)
+	byteOrder.PutUint32(tooLong[:4], 1<<25)
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		framing bool
+	}{
+		{"truncated frame", connect[:len(connect)-1], true},
+		{"truncated length", connect[:2], true},
+		{"length too large", tooLong, true},
+		{"length too small", []byte{4, 0, 0, 0}, true},
+		{"string longer than payload", truncatedString, false},
+		{"string length overflows", overflowingLength, false},
+	}
+	for _, test := range tests {
+		_, err := Read(bytes.NewReader(test.stream))
+		var (
+			ferr *FramingError
+			perr *PayloadError
+		)
+		switch {
+		case test.framing && !errors.As(err, &ferr):
+			t.Errorf("%s: got error %v, want a *FramingError", test.name, err)
+		case !test.framing && !errors.As(err, &perr):
+			t.Errorf("%s: got error %v, want a *PayloadError", test.name, err)
+		}
+	}
+
+	if _, err := Read(bytes.NewReader(nil)); !errors.Is(err, io.EOF) {
+		t.Errorf("empty stream: got error %v, want io.EOF", err)
+	}
+}
+
+// A payload error doesn't stop the messages after it from being read.
+func TestReadAfterPayloadError(t *testing.T) {
+	var stream []byte
+	stream = append(stream, withPayload(frameOf(t, SaveMessage{}), 1, 2, 3)...)
+	stream = append(stream, frameOf(t, JoinConfirmMessage{})...)
+	r := bytes.NewReader(stream)
+	if _, err := Read(r); err == nil {
+		t.Fatal("malformed Save was accepted")
+	}
+	msg, err := Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != (JoinConfirmMessage{}) {
+		t.Errorf("got %#v, want JoinConfirmMessage", msg)
+	}
+}
+
+// FuzzReadEnvelope checks that the decoder never panics, only fails with the
+// documented errors, and that whatever it decodes survives being written and
+// read back. The corpus in testdata holds frames captured from games played
+// against the local MW server.
+func FuzzReadEnvelope(f *testing.F) {
+	for _, msg := range sampleMessages {
+		f.Add(frameOf(f, msg))
+	}
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		env, err := ReadEnvelope(bytes.NewReader(stream))
+		if err != nil {
+			var (
+				ferr *FramingError
+				perr *PayloadError
+			)
+			if !errors.As(err, &ferr) && !errors.As(err, &perr) && !errors.Is(err, io.EOF) {
+				t.Fatalf("unexpected kind of error: %v", err)
+			}
+			return
+		}
+		var buf bytes.Buffer
+		if err := WriteEnvelope(&buf, env); err != nil {
+			t.Fatal(err)
+		}
+		again, err := ReadEnvelope(&buf)
+		if err != nil {
+			t.Fatalf("re-encoded %#v doesn't decode: %v", env, err)
+		}
+		if !reflect.DeepEqual(again, env) {
+			t.Fatalf("decoded %#v, which re-encodes as %#v", env, again)
+		}
+	})
+}
@@ -43,6 +43,26 @@ const (
 
 type Message interface {
 	msgType() messageType
+	appendPayload(b []byte) []byte
+}
+
+// An Envelope is a message together with the header fields that accompany it
+// on the wire.
+type Envelope struct {
+	SenderUID uint64
+	MessageID uint64
+	Message   Message
+}
+
+// RawMessage holds the undecoded payload of a message whose type this package
+// doesn't know about. Writing it sends the payload back out unchanged.
+type RawMessage struct {
+	Type    uint32
+	Payload []byte
+}
+
+func (m RawMessage) msgType() messageType {
+	return messageType(m.Type)
 }
 
 type ConnectMessage struct {
@@ -273,6 +293,71 @@ func (ConfirmCharmNotchCostsReceived) msgType() messageType {
 	return typeConfirmCharmNotchCostsReceived
 }
 
+type DatasSendMessage struct {
+	Datas []DataSendItem
+}
+
+type DataSendItem struct {
+	Label   string `json:"Item1"`
+	Content string `json:"Item2"`
+	To      int32  `json:"Item3"`
+}
+
+func (DatasSendMessage) msgType() messageType {
+	return typeDatasSend
+}
+
+type DatasSendConfirmMessage struct {
+	Count int32
+}
+
+func (DatasSendConfirmMessage) msgType() messageType {
+	return typeDatasSendConfirm
+}
+
+// The following messages are only used by ItemSync.
+
+type ISReadyMessage struct {
+	Room          string
+	Nickname      string
+	Hash          string
+	ReadyMetadata []KeyValuePair
+}
+
+func (ISReadyMessage) msgType() messageType {
+	return typeISReady
+}
+
+type InitiateSyncGameMessage struct {
+	Settings string
+}
+
+func (InitiateSyncGameMessage) msgType() messageType {
+	return typeInitiateSyncGame
+}
+
+type ApplySettingsMessage struct {
+	Settings string
+}
+
+func (ApplySettingsMessage) msgType() messageType {
+	return typeApplySettings
+}
+
+type RequestSettingsMessage struct{}
+
+func (RequestSettingsMessage) msgType() messageType {
+	return typeRequestSettings
+}
+
+type ConnectedPlayersChangedMessage struct {
+	Players map[string]string
+}
+
+func (ConnectedPlayersChangedMessage) msgType() messageType {
+	return typeConnectedPlayersChanged
+}
+
 const LabelMultiworldItem = "MultiWorld-Item"
 
 type Placement struct {
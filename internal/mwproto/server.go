@@ -0,0 +1,144 @@
+package mwproto
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"net"
+)
+
+// A Listener accepts connections from MW clients, for implementing the
+// server side of the protocol.
+type Listener struct {
+	listener net.Listener
+}
+
+func Listen(addr string) (*Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{listener: l}, nil
+}
+
+func (l *Listener) Accept() (*ServerConn, error) {
+	conn, err := l.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	c := &ServerConn{
+		conn:   conn,
+		inbox:  make(chan Message, chanBufferSize),
+		outbox: make(chan Envelope, chanBufferSize),
+		pings:  make(chan PingMessage, 1),
+	}
+	go c.recvMessages()
+	go c.sendMessages()
+	return c, nil
+}
+
+func (l *Listener) Addr() net.Addr { return l.listener.Addr() }
+
+func (l *Listener) Close() error { return l.listener.Close() }
+
+// A ServerConn is the server's end of a connection to a MW client.
+// Pings are answered automatically and never appear in the inbox.
+type ServerConn struct {
+	conn   net.Conn
+	inbox  chan Message
+	outbox chan Envelope
+	pings  chan PingMessage
+}
+
+// Inbox is closed once the client goes away.
+func (c *ServerConn) Inbox() <-chan Message { return c.inbox }
+
+func (c *ServerConn) Send(m Message) { c.outbox <- Envelope{Message: m} }
+
+// SendEnvelope is like Send, but allows setting the header fields; the
+// server's reply to Connect carries the client's UID in SenderUID.
+func (c *ServerConn) SendEnvelope(env Envelope) { c.outbox <- env }
+
+// TrySend is like Send, but if the client isn't keeping up with the messages
+// sent to it, it returns false instead of waiting.
+func (c *ServerConn) TrySend(m Message) bool {
+	return c.TrySendEnvelope(Envelope{Message: m})
+}
+
+// TrySendEnvelope is to SendEnvelope what TrySend is to Send.
+func (c *ServerConn) TrySendEnvelope(env Envelope) bool {
+	select {
+	case c.outbox <- env:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close flushes any pending messages and then closes the connection.
+// Send must not be called afterwards.
+func (c *ServerConn) Close() { close(c.outbox) }
+
+// Disconnect drops the connection immediately, without flushing pending
+// messages, so that the inbox closes. Close must still be called afterwards.
+func (c *ServerConn) Disconnect() { c.conn.Close() }
+
+func (c *ServerConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Will terminate when outbox is closed.
+func (c *ServerConn) sendMessages() {
+	defer c.conn.Close()
+	w := bufio.NewWriter(c.conn)
+	for {
+		var (
+			env Envelope
+			ok  bool
+		)
+		select {
+		case env, ok = <-c.outbox:
+			if !ok {
+				_ = w.Flush()
+				return
+			}
+		case ping := <-c.pings:
+			env = Envelope{Message: ping}
+		}
+		err := WriteEnvelope(w, env)
+		if err == nil && len(c.outbox) == 0 {
+			err = w.Flush()
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Println("error sending MW message:", err)
+		}
+	}
+}
+
+// Will terminate when the network connection is closed from either side.
+func (c *ServerConn) recvMessages() {
+	defer close(c.inbox)
+	for {
+		msg, err := Read(c.conn)
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+			return
+		}
+		var ferr *FramingError
+		if errors.As(err, &ferr) {
+			log.Printf("dropping MW client %v: %v", c.conn.RemoteAddr(), err)
+			c.conn.Close()
+			return
+		}
+		if err != nil {
+			log.Println("error reading MW message:", err)
+			continue
+		}
+		if ping, isPing := msg.(PingMessage); isPing {
+			select {
+			case c.pings <- ping:
+			default:
+			}
+			continue
+		}
+		c.inbox <- msg
+	}
+}
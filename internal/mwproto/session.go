@@ -0,0 +1,247 @@
+package mwproto
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// A Session runs the message flows described in mw-protocol.md on top of a
+// Client, one step at a time:
+//
+//	Connect → Ready → ReadyConfirm/ReadyDeny → RequestRando →
+//	RandoGenerated → Result → Join → JoinConfirm
+//
+// Messages that arrive while a step is waiting for something else are
+// reported through OnEvent, except during Join, where they are kept and
+// returned by Next so that no items are lost.
+type Session struct {
+	Client *Client
+	// Timeout bounds each request/response step; zero means wait forever.
+	// Waiting for another player to start the game is never timed out.
+	Timeout time.Duration
+	// OnEvent, if set, is called with every Event that occurs during a step.
+	OnEvent func(Event)
+
+	pending []Message
+}
+
+func NewSession(c *Client) *Session {
+	return &Session{Client: c}
+}
+
+var (
+	ErrDisconnected = errors.New("disconnected from MW server")
+	ErrTimeout      = errors.New("timed out waiting for MW server")
+)
+
+// DeniedError is returned by JoinRoom when the server sends a ReadyDeny.
+type DeniedError struct {
+	Room        string
+	Description string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("denied entry to room %s: %s", e.Room, e.Description)
+}
+
+type Event interface {
+	isSessionEvent()
+}
+
+// PlayersChangedEvent is reported whenever the server sends a ReadyConfirm
+// after the room has been joined.
+type PlayersChangedEvent struct {
+	Names []string
+}
+
+// UnexpectedMessageEvent is reported for messages that have no meaning at the
+// current step.
+type UnexpectedMessageEvent struct {
+	Step    string
+	Message Message
+}
+
+func (PlayersChangedEvent) isSessionEvent()    {}
+func (UnexpectedMessageEvent) isSessionEvent() {}
+
+// Connect performs the initial handshake and returns the server's name.
+func (s *Session) Connect() (serverName string, err error) {
+	s.Client.Send(ConnectMessage{})
+	err = s.await("connect", s.Timeout, func(msg Message) verdict {
+		c, ok := msg.(ConnectMessage)
+		if !ok {
+			return unexpected
+		}
+		serverName = c.ServerName
+		return finished
+	})
+	return
+}
+
+// JoinRoom sends ready and waits until the server lets us into the room,
+// returning the names of the players in it.
+// If the server refuses, the returned error is a *DeniedError.
+func (s *Session) JoinRoom(ready ReadyMessage) (names []string, err error) {
+	if ready.ReadyMetadata == nil {
+		ready.ReadyMetadata = []KeyValuePair{}
+	}
+	s.Client.Send(ready)
+	var denied *DeniedError
+	err = s.await("join room", s.Timeout, func(msg Message) verdict {
+		switch msg := msg.(type) {
+		case ReadyConfirmMessage:
+			names = msg.Names
+			return finished
+		case ReadyDenyMessage:
+			denied = &DeniedError{Room: ready.Room, Description: msg.Description}
+			return finished
+		}
+		return unexpected
+	})
+	if err == nil && denied != nil {
+		err = denied
+	}
+	return
+}
+
+// AwaitRandoRequest waits until some player in the room initiates the game,
+// reporting changes to the player list in the meantime.
+func (s *Session) AwaitRandoRequest() error {
+	return s.await("wait in room", 0, func(msg Message) verdict {
+		switch msg := msg.(type) {
+		case ReadyConfirmMessage:
+			s.emit(PlayersChangedEvent{Names: msg.Names})
+			return handled
+		case RequestRandoMessage:
+			return finished
+		}
+		return unexpected
+	})
+}
+
+// SendRando sends our placements and waits for the mixed result.
+func (s *Session) SendRando(rando RandoGeneratedMessage) (result ResultMessage, err error) {
+	s.Client.Send(rando)
+	err = s.await("wait for result", s.Timeout, func(msg Message) verdict {
+		r, ok := msg.(ResultMessage)
+		if !ok {
+			return unexpected
+		}
+		result = r
+		return finished
+	})
+	return
+}
+
+// Join joins an already generated game and waits for the server to confirm
+// it. Any other messages received in the meantime are returned by later calls
+// to Next.
+func (s *Session) Join(join JoinMessage) error {
+	s.Client.Send(join)
+	return s.await("join game", s.Timeout, func(msg Message) verdict {
+		if _, ok := msg.(JoinConfirmMessage); ok {
+			return finished
+		}
+		s.pending = append(s.pending, msg)
+		return handled
+	})
+}
+
+// Next returns the next message received during the game, or ErrDisconnected
+// once the connection is lost.
+func (s *Session) Next() (Message, error) {
+	return s.next(nil)
+}
+
+// next is like Next, but gives up with errStopped once done is closed.
+func (s *Session) next(done <-chan struct{}) (Message, error) {
+	if len(s.pending) > 0 {
+		msg := s.pending[0]
+		s.pending = s.pending[1:]
+		return msg, nil
+	}
+	select {
+	case msg, ok := <-s.Client.Inbox():
+		if !ok {
+			return nil, ErrDisconnected
+		}
+		if _, ok := msg.(DisconnectMessage); ok {
+			return nil, ErrDisconnected
+		}
+		return msg, nil
+	case <-done:
+		return nil, errStopped
+	}
+}
+
+var errStopped = errors.New("stopped reading messages")
+
+// Messages returns a channel that receives what Next would return, for use in
+// select statements. It is closed once the connection is lost, or done is
+// closed. A message that was read but not yet delivered when done was closed
+// is kept for Next, which may be called again once the channel is closed.
+func (s *Session) Messages(done <-chan struct{}) <-chan Message {
+	ch := make(chan Message)
+	go func() {
+		defer close(ch)
+		for {
+			msg, err := s.next(done)
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-done:
+				s.pending = slices.Insert(s.pending, 0, msg)
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+type verdict int
+
+const (
+	unexpected verdict = iota
+	handled
+	finished
+)
+
+// await reads messages until step returns finished for one of them.
+func (s *Session) await(name string, timeout time.Duration, step func(Message) verdict) error {
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	inbox := s.Client.Inbox()
+	for {
+		select {
+		case msg, ok := <-inbox:
+			if !ok {
+				return ErrDisconnected
+			}
+			if _, ok := msg.(DisconnectMessage); ok {
+				return ErrDisconnected
+			}
+			switch step(msg) {
+			case finished:
+				return nil
+			case unexpected:
+				s.emit(UnexpectedMessageEvent{Step: name, Message: msg})
+			}
+		case <-timer:
+			return fmt.Errorf("%s: %w", name, ErrTimeout)
+		}
+	}
+}
+
+func (s *Session) emit(e Event) {
+	if s.OnEvent != nil {
+		s.OnEvent(e)
+	}
+}
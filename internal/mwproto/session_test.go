@@ -0,0 +1,270 @@
+package mwproto
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+// serveOne runs script against the first client to connect to a server on
+// localhost, and returns the server's address.
+func serveOne(t *testing.T, script func(c *ServerConn)) string {
+	t.Helper()
+	l, err := Listen("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		script(c)
+		c.Close()
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+	return l.Addr().String()
+}
+
+func dialSession(t *testing.T, addr string) *Session {
+	t.Helper()
+	c, err := Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	s := NewSession(c)
+	s.Timeout = 5 * time.Second
+	return s
+}
+
+// expect reads the next message a client sent, reporting an error if it's
+// not a T.
+func expect[T Message](t *testing.T, c *ServerConn) (msg T, ok bool) {
+	select {
+	case m, open := <-c.Inbox():
+		if !open {
+			t.Errorf("client disconnected while waiting for %T", msg)
+			return msg, false
+		}
+		msg, ok = m.(T)
+		if !ok {
+			t.Errorf("got %#v, want %T", m, msg)
+		}
+		return msg, ok
+	case <-time.After(5 * time.Second):
+		t.Errorf("timed out waiting for %T", msg)
+		return msg, false
+	}
+}
+
+func TestSessionFlow(t *testing.T) {
+	received := DataReceiveMessage{Label: LabelMultiworldItem, Content: "Lantern", From: "Other", FromID: 1}
+	addr := serveOne(t, func(c *ServerConn) {
+		if _, ok := expect[ConnectMessage](t, c); !ok {
+			return
+		}
+		c.SendEnvelope(Envelope{SenderUID: 7, Message: ConnectMessage{ServerName: "Test Server"}})
+		ready, ok := expect[ReadyMessage](t, c)
+		if !ok {
+			return
+		}
+		if ready.ReadyMetadata == nil {
+			t.Error("Ready sent without metadata")
+		}
+		c.Send(ReadyConfirmMessage{Ready: 1, Names: []string{ready.Nickname}})
+		c.Send(ReadyConfirmMessage{Ready: 2, Names: []string{ready.Nickname, "Other"}})
+		c.Send(RequestRandoMessage{})
+		if _, ok := expect[RandoGeneratedMessage](t, c); !ok {
+			return
+		}
+		c.Send(ResultMessage{PlayerID: 0, RandoID: 42, Nicknames: []string{ready.Nickname, "Other"}})
+		if _, ok := expect[JoinMessage](t, c); !ok {
+			return
+		}
+		// Items may arrive before the join is confirmed.
+		c.Send(received)
+		c.Send(JoinConfirmMessage{})
+		c.Send(DataSendConfirmMessage{Label: LabelMultiworldItem, Content: "Grub", To: 1})
+		expect[SaveMessage](t, c)
+	})
+
+	s := dialSession(t, addr)
+	var events []Event
+	s.OnEvent = func(e Event) { events = append(events, e) }
+
+	serverName, err := s.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverName != "Test Server" {
+		t.Errorf("server name = %q, want %q", serverName, "Test Server")
+	}
+	names, err := s.JoinRoom(ReadyMessage{Room: "room", Nickname: "Me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"Me"}) {
+		t.Errorf("names = %v, want [Me]", names)
+	}
+	if err := s.AwaitRandoRequest(); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("events = %#v, want one PlayersChangedEvent", events)
+	}
+	if e, ok := events[0].(PlayersChangedEvent); !ok || !slices.Equal(e.Names, []string{"Me", "Other"}) {
+		t.Errorf("event = %#v, want PlayersChangedEvent for [Me Other]", events[0])
+	}
+	result, err := s.SendRando(RandoGeneratedMessage{Items: map[string][]Placement{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.RandoID != 42 {
+		t.Errorf("rando ID = %d, want 42", result.RandoID)
+	}
+	if err := s.Join(JoinMessage{DisplayName: "Me", RandoID: result.RandoID, PlayerID: result.PlayerID}); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg != received {
+		t.Errorf("first message after join = %#v, want %#v", msg, received)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	msg = <-s.Messages(done)
+	if _, ok := msg.(DataSendConfirmMessage); !ok {
+		t.Errorf("second message after join = %#v, want a DataSendConfirmMessage", msg)
+	}
+	s.Client.Send(SaveMessage{})
+}
+
+func TestSessionDenied(t *testing.T) {
+	addr := serveOne(t, func(c *ServerConn) {
+		if _, ok := expect[ReadyMessage](t, c); !ok {
+			return
+		}
+		c.Send(ReadyDenyMessage{Description: "room is full"})
+	})
+	s := dialSession(t, addr)
+	_, err := s.JoinRoom(ReadyMessage{Room: "room", Nickname: "Me"})
+	var denied *DeniedError
+	if !errors.As(err, &denied) {
+		t.Fatalf("JoinRoom returned %v, want a *DeniedError", err)
+	}
+	if denied.Room != "room" || denied.Description != "room is full" {
+		t.Errorf("got %#v", denied)
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	release := make(chan struct{})
+	addr := serveOne(t, func(c *ServerConn) {
+		expect[ConnectMessage](t, c)
+		<-release
+	})
+	defer close(release)
+	s := dialSession(t, addr)
+	s.Timeout = 50 * time.Millisecond
+	if _, err := s.Connect(); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Connect returned %v, want ErrTimeout", err)
+	}
+}
+
+func TestSessionDisconnected(t *testing.T) {
+	addr := serveOne(t, func(c *ServerConn) {
+		if _, ok := expect[JoinMessage](t, c); !ok {
+			return
+		}
+		c.Send(DisconnectMessage{})
+	})
+	s := dialSession(t, addr)
+	if err := s.Join(JoinMessage{DisplayName: "Me"}); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("Join returned %v, want ErrDisconnected", err)
+	}
+}
+
+func TestSessionUnexpectedMessage(t *testing.T) {
+	addr := serveOne(t, func(c *ServerConn) {
+		if _, ok := expect[ConnectMessage](t, c); !ok {
+			return
+		}
+		c.Send(JoinConfirmMessage{})
+		c.Send(ConnectMessage{ServerName: "Test Server"})
+	})
+	s := dialSession(t, addr)
+	var events []Event
+	s.OnEvent = func(e Event) { events = append(events, e) }
+	if _, err := s.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{UnexpectedMessageEvent{Step: "connect", Message: JoinConfirmMessage{}}}
+	if !slices.Equal(events, want) {
+		t.Errorf("events = %#v, want %#v", events, want)
+	}
+}
+
+func TestSessionMessagesStopsOnQuietConnection(t *testing.T) {
+	release := make(chan struct{})
+	addr := serveOne(t, func(c *ServerConn) { <-release })
+	defer close(release)
+	s := dialSession(t, addr)
+	done := make(chan struct{})
+	ch := s.Messages(done)
+	close(done)
+	select {
+	case msg, ok := <-ch:
+		if ok {
+			t.Errorf("got %#v, want the channel to be closed", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Messages kept waiting for a message after done was closed")
+	}
+}
+
+func TestSessionMessagesKeepsUndelivered(t *testing.T) {
+	sent := []Message{
+		DataReceiveMessage{Label: LabelMultiworldItem, Content: "Lantern", From: "Other", FromID: 1},
+		DataReceiveMessage{Label: LabelMultiworldItem, Content: "Grub", From: "Other", FromID: 1},
+		DataReceiveMessage{Label: LabelMultiworldItem, Content: "Sword", From: "Other", FromID: 1},
+	}
+	release := make(chan struct{})
+	addr := serveOne(t, func(c *ServerConn) {
+		for _, msg := range sent {
+			c.Send(msg)
+		}
+		<-release
+	})
+	defer close(release)
+	s := dialSession(t, addr)
+	done := make(chan struct{})
+	ch := s.Messages(done)
+	got := []Message{<-ch}
+	// Give the goroutine time to read the next message, so that it's waiting
+	// to deliver it when done is closed.
+	time.Sleep(50 * time.Millisecond)
+	close(done)
+	for msg := range ch {
+		got = append(got, msg)
+	}
+	for len(got) < len(sent) {
+		msg, err := s.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, msg)
+	}
+	if !slices.Equal(got, sent) {
+		t.Errorf("got %#v, want %#v", got, sent)
+	}
+}
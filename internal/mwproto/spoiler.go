@@ -0,0 +1,68 @@
+package mwproto
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A SpoilerEntry is one line of a spoiler log: an item and the location it
+// was placed at, each with the ID of the player it belongs to.
+type SpoilerEntry struct {
+	ItemOwner     int
+	Item          string
+	LocationOwner int
+	Location      string
+}
+
+// Format returns the line for e in a spoiler log, given the nicknames of the
+// players in the game.
+func (e SpoilerEntry) Format(nicknames []string) string {
+	return fmt.Sprintf("%s's %s at %s's %s\n", nicknames[e.ItemOwner], e.Item, nicknames[e.LocationOwner], e.Location)
+}
+
+// ParseSpoilerLog parses the lines of a textual spoiler log, as found in
+// SpoilerLogs, given the nicknames of the players in the game. The protocol
+// doesn't specify the format of these logs, so lines that aren't in the
+// format that Format produces, or that can be read in more than one way,
+// are returned in unparsed rather than as an error.
+func ParseSpoilerLog(log string, nicknames []string) (entries []SpoilerEntry, unparsed []string) {
+	for _, line := range strings.Split(log, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" {
+			continue
+		}
+		if e, ok := parseSpoilerLine(line, nicknames); ok {
+			entries = append(entries, e)
+		} else {
+			unparsed = append(unparsed, line)
+		}
+	}
+	return
+}
+
+func parseSpoilerLine(line string, nicknames []string) (entry SpoilerEntry, ok bool) {
+	matches := 0
+	for i, itemOwner := range nicknames {
+		rest, found := strings.CutPrefix(line, itemOwner+"'s ")
+		if !found {
+			continue
+		}
+		for j, locationOwner := range nicknames {
+			sep := " at " + locationOwner + "'s "
+			for k := 0; ; {
+				n := strings.Index(rest[k:], sep)
+				if n == -1 {
+					break
+				}
+				k += n
+				item, location := rest[:k], rest[k+len(sep):]
+				if item != "" && location != "" {
+					entry = SpoilerEntry{ItemOwner: i, Item: item, LocationOwner: j, Location: location}
+					matches++
+				}
+				k++
+			}
+		}
+	}
+	return entry, matches == 1
+}
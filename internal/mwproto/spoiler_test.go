@@ -0,0 +1,50 @@
+package mwproto
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSpoilerLogRoundTrip(t *testing.T) {
+	nicknames := []string{"Alice", "Bob", "Carol Ann"}
+	entries := []SpoilerEntry{
+		{ItemOwner: 0, Item: "Mothwing_Cloak", LocationOwner: 1, Location: "Mothwing_Cloak"},
+		{ItemOwner: 1, Item: "Grub", LocationOwner: 1, Location: "Grub-Crossroads_Acid_(3)"},
+		{ItemOwner: 2, Item: "Item that's at the end", LocationOwner: 0, Location: "Chest at the top"},
+		{ItemOwner: 2, Item: "Sword", LocationOwner: 2, Location: "Bob's House"},
+	}
+	var log strings.Builder
+	for _, e := range entries {
+		log.WriteString(e.Format(nicknames))
+	}
+	got, unparsed := ParseSpoilerLog(log.String(), nicknames)
+	if !reflect.DeepEqual(got, entries) || len(unparsed) != 0 {
+		t.Errorf("parsed\n%s\nas %+v, leaving %q; want %+v", log.String(), got, unparsed, entries)
+	}
+}
+
+func TestParseSpoilerLogLeavesUnclearLines(t *testing.T) {
+	nicknames := []string{"Al", "Al's Friend", "Bob"}
+	log := strings.Join([]string{
+		"Bob's Lantern at Al's Crossroads",
+		// Either Al's "Friend's Sword", or Al's Friend's "Sword".
+		"Al's Friend's Sword at Bob's Chest",
+		// Either Bob's "Key" at Al's "Gate at Bob's Door", or Bob's
+		// "Key at Al's Gate" at Bob's "Door".
+		"Bob's Key at Al's Gate at Bob's Door",
+		"Unknown's Item at Bob's Chest",
+		"Bob's Item at nowhere",
+		"Bob's  at Al's Chest",
+		"-- Spoiler log for room eggu --",
+	}, "\r\n")
+	got, unparsed := ParseSpoilerLog(log+"\r\n\r\n", nicknames)
+	want := []SpoilerEntry{{ItemOwner: 2, Item: "Lantern", LocationOwner: 0, Location: "Crossroads"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+	wantUnparsed := strings.Split(log, "\r\n")[1:]
+	if !reflect.DeepEqual(unparsed, wantUnparsed) {
+		t.Errorf("left %q unparsed, want %q", unparsed, wantUnparsed)
+	}
+}
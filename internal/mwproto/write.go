@@ -4,44 +4,109 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"reflect"
+	"sync"
+	"sync/atomic"
 )
 
+// Write writes msg with a blank SenderUID and MessageID.
 func Write(w io.Writer, msg Message) error {
-	encoded := make([]byte, headerSize)
-	encoded = appendMessage(encoded, msg)
-	byteOrder.PutUint32(encoded[:4], toUint32(len(encoded)))
-	byteOrder.PutUint32(encoded[4:8], uint32(msg.msgType()))
+	return WriteEnvelope(w, Envelope{Message: msg})
+}
+
+func WriteEnvelope(w io.Writer, env Envelope) error {
+	return writeEnvelope(w, env, nil)
+}
+
+func writeEnvelope(w io.Writer, env Envelope, tap Tap) error {
+	t := env.Message.msgType()
+	var sizeHint *atomic.Int32
+	hint := 0
+	if int(t) < len(lastFrameSizes) {
+		sizeHint = &lastFrameSizes[t]
+		hint = int(sizeHint.Load())
+	}
+	bufp := getFrameBuffer(hint)
+	defer putFrameBuffer(bufp)
+	encoded := appendFrame((*bufp)[:0], env)
+	*bufp = encoded
+	if sizeHint != nil {
+		sizeHint.Store(int32(len(encoded)))
+	}
+	if tap != nil {
+		tap(true, encoded, env.Message)
+	}
 	_, err := w.Write(encoded)
 	return err
 }
 
-func appendMessage(b []byte, m Message) []byte {
-	v := reflect.ValueOf(m)
-	for i := range v.NumField() {
-		field := v.Field(i)
-		switch field.Kind() {
-		case reflect.Uint8:
-			b = append(b, byte(field.Uint()))
-		case reflect.Int32:
-			b = byteOrder.AppendUint32(b, uint32(field.Int()))
-		case reflect.Uint32:
-			b = byteOrder.AppendUint32(b, uint32(field.Uint()))
-		case reflect.String:
-			b = appendString(b, field.String())
-		default:
-			b = appendJSON(b, field.Interface())
-		}
-	}
+func appendFrame(b []byte, env Envelope) []byte {
+	start := len(b)
+	b = append(b, make([]byte, headerSize)...)
+	b = env.Message.appendPayload(b)
+	header := b[start : start+headerSize]
+	byteOrder.PutUint32(header[:4], toUint32(len(b)-start))
+	byteOrder.PutUint32(header[4:8], uint32(env.Message.msgType()))
+	byteOrder.PutUint64(header[8:16], env.SenderUID)
+	byteOrder.PutUint64(header[16:24], env.MessageID)
 	return b
 }
 
+// frameBuffers holds buffers for encoding and decoding whole frames, so that
+// bursts of messages don't allocate a new one each time. Buffers are pooled
+// by size class, each four times as large as the last, so that large frames
+// can reuse large buffers without small frames holding on to them.
+var frameBuffers [frameBufferClasses]sync.Pool
+
+const (
+	minFrameBuffer = 4 << 10
+	// The largest class fits the largest frame that can be read, 16MiB.
+	frameBufferClasses = 7
+)
+
+// lastFrameSizes holds the size of the last frame written of each message
+// type, so that the next one can be encoded into a buffer that fits it.
+var lastFrameSizes [typeConnectedPlayersChanged + 1]atomic.Int32
+
+// frameBufferClassSize returns the smallest capacity of buffers in the given
+// class.
+func frameBufferClassSize(class int) int {
+	return minFrameBuffer << (2 * class)
+}
+
+// getFrameBuffer returns an empty buffer with room for at least n bytes.
+func getFrameBuffer(n int) *[]byte {
+	class := 0
+	for class < frameBufferClasses-1 && frameBufferClassSize(class) < n {
+		class++
+	}
+	if bufp, ok := frameBuffers[class].Get().(*[]byte); ok && cap(*bufp) >= n {
+		*bufp = (*bufp)[:0]
+		return bufp
+	}
+	b := make([]byte, 0, max(n, frameBufferClassSize(class)))
+	return &b
+}
+
+func putFrameBuffer(bufp *[]byte) {
+	class := -1
+	for class < frameBufferClasses-1 && frameBufferClassSize(class+1) <= cap(*bufp) {
+		class++
+	}
+	if class >= 0 {
+		frameBuffers[class].Put(bufp)
+	}
+}
+
 func appendString(out []byte, s string) []byte {
 	out = appendVarint32(out, len(s))
 	out = append(out, s...)
 	return out
 }
 
+func appendInt32(out []byte, x int32) []byte {
+	return byteOrder.AppendUint32(out, uint32(x))
+}
+
 func appendJSON(out []byte, value any) []byte {
 	s, err := json.Marshal(value)
 	if err != nil {
@@ -0,0 +1,516 @@
+// Package mwserver implements the server side of the MultiWorld protocol, as
+// described in mw-protocol.md.
+//
+// All state is kept in memory; games only last as long as the server process.
+package mwserver
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+type Server struct {
+	Name string
+
+	listener *mwproto.Listener
+	events   chan event
+	nextUID  uint64
+	rooms    map[string]*room
+	games    map[int32]*game
+}
+
+type event struct {
+	client *client
+	// msg is nil when the client has disconnected.
+	msg mwproto.Message
+}
+
+type client struct {
+	conn *mwproto.ServerConn
+	// dropped is set once the client has been disconnected for not keeping
+	// up with the messages sent to it.
+	dropped  bool
+	uid      uint64
+	room     *room
+	nickname string
+	metadata []mwproto.KeyValuePair
+	rando    *mwproto.RandoGeneratedMessage
+	player   *player
+}
+
+type room struct {
+	name       string
+	members    []*client
+	generating bool
+}
+
+type game struct {
+	randoID   int32
+	nicknames []string
+	players   []*player
+}
+
+type player struct {
+	game   *game
+	id     int32
+	client *client
+	// Items sent to this player that it hasn't confirmed yet.
+	undelivered []mwproto.DataReceiveMessage
+	// Confirmations for items this player sent, which it wasn't around to
+	// receive at the time.
+	unsentConfirms []mwproto.DataSendConfirmMessage
+	// Items this player has confirmed receiving, so that resent items can be
+	// confirmed straight away.
+	received map[itemKey]struct{}
+}
+
+type itemKey struct {
+	label, content string
+}
+
+// Listen opens a listener on addr; call Serve to start accepting clients.
+func Listen(addr, name string) (*Server, error) {
+	l, err := mwproto.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		Name:     name,
+		listener: l,
+		events:   make(chan event, 100),
+		rooms:    map[string]*room{},
+		games:    map[int32]*game{},
+	}, nil
+}
+
+func (s *Server) Addr() net.Addr { return s.listener.Addr() }
+
+func (s *Server) Close() error { return s.listener.Close() }
+
+// Serve runs the server until its listener is closed, then disconnects all
+// clients.
+func (s *Server) Serve() {
+	closed := make(chan struct{})
+	go s.acceptClients(closed)
+	for {
+		select {
+		case ev := <-s.events:
+			s.handleEvent(ev)
+		case <-closed:
+			// Every client is gone by now, but the server may not have
+			// heard about all of them yet.
+			for {
+				select {
+				case ev := <-s.events:
+					s.handleEvent(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) handleEvent(ev event) {
+	if ev.msg == nil {
+		s.leave(ev.client)
+		ev.client.conn.Close()
+		return
+	}
+	s.handle(ev.client, ev.msg)
+}
+
+// acceptClients accepts clients until the listener is closed, then
+// disconnects them and waits for them to be gone before closing closed.
+func (s *Server) acceptClients(closed chan<- struct{}) {
+	defer close(closed)
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		conns = map[*mwproto.ServerConn]struct{}{}
+	)
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			break
+		}
+		if err != nil {
+			log.Println("error accepting MW client:", err)
+			continue
+		}
+		mu.Lock()
+		conns[conn] = struct{}{}
+		mu.Unlock()
+		c := &client{conn: conn}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for msg := range conn.Inbox() {
+				s.events <- event{client: c, msg: msg}
+			}
+			s.events <- event{client: c}
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+	mu.Lock()
+	for conn := range conns {
+		conn.Disconnect()
+	}
+	mu.Unlock()
+	wg.Wait()
+}
+
+// send sends msg to c, unless c isn't keeping up with the messages sent to
+// it, in which case it is disconnected instead, so that it can't hold up the
+// rest of the server.
+func (s *Server) send(c *client, msg mwproto.Message) {
+	s.sendEnvelope(c, mwproto.Envelope{Message: msg})
+}
+
+func (s *Server) sendEnvelope(c *client, env mwproto.Envelope) {
+	if c.dropped {
+		return
+	}
+	if !c.conn.TrySendEnvelope(env) {
+		log.Printf("disconnecting %v, which isn't keeping up with its messages", c.conn.RemoteAddr())
+		c.dropped = true
+		c.conn.Disconnect()
+	}
+}
+
+func (s *Server) handle(c *client, msg mwproto.Message) {
+	switch msg := msg.(type) {
+	case mwproto.ConnectMessage:
+		s.nextUID++
+		c.uid = s.nextUID
+		s.sendEnvelope(c, mwproto.Envelope{
+			SenderUID: c.uid,
+			Message:   mwproto.ConnectMessage{ServerName: s.Name},
+		})
+	case mwproto.DisconnectMessage:
+		s.leave(c)
+	case mwproto.ReadyMessage:
+		s.ready(c, msg)
+	case mwproto.UnreadyMessage:
+		s.leaveRoom(c)
+	case mwproto.InitiateGameMessage:
+		s.initiateGame(c)
+	case mwproto.RandoGeneratedMessage:
+		if c.room == nil || !c.room.generating {
+			log.Printf("%s sent placements without being asked", c.nickname)
+			return
+		}
+		c.rando = &msg
+		s.maybeFinishGeneration(c.room)
+	case mwproto.JoinMessage:
+		s.join(c, msg)
+	case mwproto.DataSendMessage:
+		s.dataSend(c, msg)
+	case mwproto.DataReceiveConfirmMessage:
+		s.dataReceiveConfirm(c, msg)
+	case mwproto.SaveMessage:
+		// Nothing to do; all state is in memory.
+	default:
+		log.Printf("ignoring %T from %s", msg, c.conn.RemoteAddr())
+	}
+}
+
+func (s *Server) ready(c *client, msg mwproto.ReadyMessage) {
+	s.leaveRoom(c)
+	r := s.rooms[msg.Room]
+	if r == nil {
+		r = &room{name: msg.Room}
+		s.rooms[msg.Room] = r
+	}
+	if r.generating {
+		s.send(c, mwproto.ReadyDenyMessage{Description: "A game is already being generated in this room"})
+		return
+	}
+	if slices.ContainsFunc(r.members, func(m *client) bool { return m.nickname == msg.Nickname }) {
+		s.send(c, mwproto.ReadyDenyMessage{Description: fmt.Sprintf("The nickname %q is already in use in this room", msg.Nickname)})
+		return
+	}
+	c.room = r
+	c.nickname = msg.Nickname
+	c.metadata = msg.ReadyMetadata
+	c.rando = nil
+	r.members = append(r.members, c)
+	log.Printf("%s joined room %s", c.nickname, r.name)
+	s.broadcastReady(r)
+}
+
+func (s *Server) broadcastReady(r *room) {
+	names := make([]string, len(r.members))
+	for i, m := range r.members {
+		names[i] = m.nickname
+	}
+	for _, m := range r.members {
+		s.send(m, mwproto.ReadyConfirmMessage{Ready: int32(len(names)), Names: names})
+	}
+}
+
+func (s *Server) initiateGame(c *client) {
+	r := c.room
+	if r == nil || r.generating {
+		return
+	}
+	log.Printf("%s started the game in room %s", c.nickname, r.name)
+	r.generating = true
+	for _, m := range r.members {
+		s.send(m, mwproto.RequestRandoMessage{})
+	}
+}
+
+func (s *Server) maybeFinishGeneration(r *room) {
+	if len(r.members) == 0 {
+		delete(s.rooms, r.name)
+		return
+	}
+	for _, m := range r.members {
+		if m.rando == nil {
+			return
+		}
+	}
+	delete(s.rooms, r.name)
+
+	randos := make([]mwproto.RandoGeneratedMessage, len(r.members))
+	g := &game{
+		nicknames: make([]string, len(r.members)),
+		players:   make([]*player, len(r.members)),
+	}
+	metadata := make([][]mwproto.KeyValuePair, len(r.members))
+	for i, m := range r.members {
+		randos[i] = *m.rando
+		g.nicknames[i] = m.nickname
+		g.players[i] = &player{game: g, id: int32(i), received: map[itemKey]struct{}{}}
+		metadata[i] = m.metadata
+		if metadata[i] == nil {
+			metadata[i] = []mwproto.KeyValuePair{}
+		}
+	}
+	for {
+		g.randoID = rand.Int32()
+		if _, taken := s.games[g.randoID]; !taken {
+			break
+		}
+	}
+	s.games[g.randoID] = g
+
+	results := mix(randos, g.nicknames)
+	for i, m := range r.members {
+		res := results[i]
+		res.PlayerID = int32(i)
+		res.RandoID = g.randoID
+		res.Nicknames = g.nicknames
+		res.ReadyMetadata = metadata
+		s.send(m, res)
+		m.room = nil
+		m.rando = nil
+	}
+	log.Printf("generated game %d for room %s with players %v", g.randoID, r.name, g.nicknames)
+}
+
+func (s *Server) join(c *client, msg mwproto.JoinMessage) {
+	g := s.games[msg.RandoID]
+	if g == nil || !(msg.PlayerID >= 0 && int(msg.PlayerID) < len(g.players)) {
+		log.Printf("%s tried to join unknown game %d as player %d", msg.DisplayName, msg.RandoID, msg.PlayerID)
+		return
+	}
+	p := g.players[msg.PlayerID]
+	if p.client != nil && p.client != c {
+		p.client.player = nil
+	}
+	s.leaveGame(c)
+	p.client = c
+	c.player = p
+	log.Printf("%s joined game %d as player %d", msg.DisplayName, g.randoID, p.id)
+	s.send(c, mwproto.JoinConfirmMessage{})
+	for _, item := range p.undelivered {
+		s.send(c, item)
+	}
+	for _, confirm := range p.unsentConfirms {
+		s.send(c, confirm)
+	}
+	p.unsentConfirms = nil
+}
+
+func (s *Server) dataSend(c *client, msg mwproto.DataSendMessage) {
+	from := c.player
+	if from == nil {
+		log.Printf("ignoring item sent from outside of a game: %q", msg.Content)
+		return
+	}
+	g := from.game
+	if !(msg.To >= 0 && int(msg.To) < len(g.players)) {
+		log.Printf("ignoring item sent to nonexistent player %d: %q", msg.To, msg.Content)
+		return
+	}
+	to := g.players[msg.To]
+	key := itemKey{msg.Label, msg.Content}
+	if _, ok := to.received[key]; ok {
+		s.send(c, mwproto.DataSendConfirmMessage{Label: msg.Label, Content: msg.Content, To: msg.To})
+		return
+	}
+	item := mwproto.DataReceiveMessage{
+		Label:   msg.Label,
+		Content: msg.Content,
+		From:    g.nicknames[from.id],
+		FromID:  from.id,
+	}
+	if !slices.Contains(to.undelivered, item) {
+		to.undelivered = append(to.undelivered, item)
+	}
+	if to.client != nil {
+		s.send(to.client, item)
+	}
+}
+
+func (s *Server) dataReceiveConfirm(c *client, msg mwproto.DataReceiveConfirmMessage) {
+	to := c.player
+	if to == nil {
+		return
+	}
+	g := to.game
+	i := slices.IndexFunc(to.undelivered, func(item mwproto.DataReceiveMessage) bool {
+		return item.Label == msg.Label && item.Content == msg.Data && item.From == msg.From
+	})
+	if i == -1 {
+		return
+	}
+	item := to.undelivered[i]
+	to.undelivered = slices.Delete(to.undelivered, i, i+1)
+	to.received[itemKey{item.Label, item.Content}] = struct{}{}
+	confirm := mwproto.DataSendConfirmMessage{Label: item.Label, Content: item.Content, To: to.id}
+	from := g.players[item.FromID]
+	if from.client != nil {
+		s.send(from.client, confirm)
+	} else {
+		from.unsentConfirms = append(from.unsentConfirms, confirm)
+	}
+}
+
+func (s *Server) leave(c *client) {
+	s.leaveRoom(c)
+	s.leaveGame(c)
+}
+
+func (s *Server) leaveRoom(c *client) {
+	r := c.room
+	if r == nil {
+		return
+	}
+	c.room = nil
+	c.rando = nil
+	r.members = slices.DeleteFunc(r.members, func(m *client) bool { return m == c })
+	log.Printf("%s left room %s", c.nickname, r.name)
+	if r.generating {
+		s.maybeFinishGeneration(r)
+		return
+	}
+	if len(r.members) == 0 {
+		delete(s.rooms, r.name)
+		return
+	}
+	s.broadcastReady(r)
+}
+
+func (s *Server) leaveGame(c *client) {
+	if c.player != nil {
+		c.player.client = nil
+		c.player = nil
+	}
+}
+
+type placedItem struct {
+	owner int
+	name  string
+}
+
+type placedLocation struct {
+	owner int
+	name  string
+}
+
+// mix shuffles together the items from all players' placements within each
+// item group, and returns the result to be sent to each player, minus the
+// fields common to all of them.
+func mix(randos []mwproto.RandoGeneratedMessage, nicknames []string) []mwproto.ResultMessage {
+	var seed uint64
+	for _, r := range randos {
+		seed = seed*31 + uint64(uint32(r.Seed))
+	}
+	rng := rand.New(rand.NewPCG(seed, uint64(len(randos))))
+
+	results := make([]mwproto.ResultMessage, len(randos))
+	for i := range results {
+		results[i].Placements = map[string][]mwproto.ResultPlacement{}
+		results[i].PlayerItemsPlacements = map[string]string{}
+	}
+	worldSpoilers := make([]strings.Builder, len(randos))
+	var fullSpoiler strings.Builder
+
+	var groups []string
+	for _, r := range randos {
+		for g := range r.Items {
+			if !slices.Contains(groups, g) {
+				groups = append(groups, g)
+			}
+		}
+	}
+	slices.Sort(groups)
+
+	for _, group := range groups {
+		var (
+			items     []placedItem
+			locations []placedLocation
+		)
+		for i, r := range randos {
+			for _, p := range r.Items[group] {
+				items = append(items, placedItem{owner: i, name: p.Item})
+				locations = append(locations, placedLocation{owner: i, name: p.Location})
+			}
+		}
+		rng.Shuffle(len(items), func(i, j int) { items[i], items[j] = items[j], items[i] })
+		for i, loc := range locations {
+			item := items[i]
+			results[loc.owner].Placements[group] = append(results[loc.owner].Placements[group], mwproto.ResultPlacement{
+				Item:     mwproto.QualifyName(item.owner, item.name),
+				Location: loc.name,
+			})
+			results[item.owner].PlayerItemsPlacements[item.name] = mwproto.QualifyName(loc.owner, loc.name)
+			line := mwproto.SpoilerEntry{
+				ItemOwner:     item.owner,
+				Item:          item.name,
+				LocationOwner: loc.owner,
+				Location:      loc.name,
+			}.Format(nicknames)
+			fullSpoiler.WriteString(line)
+			worldSpoilers[loc.owner].WriteString(line)
+		}
+	}
+
+	spoiler := mwproto.SpoilerLogs{
+		FullOrderedItemsLog:     fullSpoiler.String(),
+		IndividualWorldSpoilers: make(map[string]string, len(randos)),
+	}
+	for i, name := range nicknames {
+		spoiler.IndividualWorldSpoilers[name] = worldSpoilers[i].String()
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256([]byte(spoiler.FullOrderedItemsLog)))[:16]
+	for i := range results {
+		results[i].ItemsSpoiler = spoiler
+		results[i].GeneratedHash = hash
+	}
+	return results
+}
@@ -0,0 +1,333 @@
+package mwserver
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dpinela/mmm/internal/mwproto"
+)
+
+const testTimeout = 5 * time.Second
+
+func startServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := Listen("localhost:0", "Test Server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Serve()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		select {
+		case <-done:
+		case <-time.After(testTimeout):
+			t.Error("Serve didn't return after the server was closed")
+		}
+	})
+	return s
+}
+
+func connect(t *testing.T, s *Server) *mwproto.Session {
+	t.Helper()
+	c, err := mwproto.Dial(s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	session := mwproto.NewSession(c)
+	session.Timeout = testTimeout
+	if _, err := session.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func placements(prefix string, n int) map[string][]mwproto.Placement {
+	var ps []mwproto.Placement
+	for i := range n {
+		ps = append(ps, mwproto.Placement{
+			Item:     mwproto.Name{Name: prefix + " Item", Discriminator: int64(i), HasDiscriminator: true}.Encode(),
+			Location: mwproto.Name{Name: prefix + " Location", Discriminator: int64(i), HasDiscriminator: true}.Encode(),
+		})
+	}
+	return map[string][]mwproto.Placement{"Main Item Group": ps}
+}
+
+// playGame has each session join room, with one of them starting the game,
+// and returns their results.
+func playGame(t *testing.T, room string, sessions []*mwproto.Session) []mwproto.ResultMessage {
+	t.Helper()
+	for i, session := range sessions {
+		names, err := session.JoinRoom(mwproto.ReadyMessage{Room: room, Nickname: string(rune('A' + i))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != i+1 {
+			t.Fatalf("room has players %v after %d joined", names, i+1)
+		}
+	}
+	sessions[0].Client.Send(mwproto.InitiateGameMessage{})
+	results := make([]mwproto.ResultMessage, len(sessions))
+	errs := make([]error, len(sessions))
+	var wg sync.WaitGroup
+	for i, session := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = session.AwaitRandoRequest(); errs[i] != nil {
+				return
+			}
+			results[i], errs[i] = session.SendRando(mwproto.RandoGeneratedMessage{Items: placements(string(rune('A'+i)), 3)})
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+// messages returns the messages that session receives from now on.
+func messages(t *testing.T, session *mwproto.Session) <-chan mwproto.Message {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	return session.Messages(done)
+}
+
+func next(t *testing.T, messages <-chan mwproto.Message) mwproto.Message {
+	t.Helper()
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatal("disconnected")
+		}
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+func TestGame(t *testing.T) {
+	s := startServer(t)
+	sessions := []*mwproto.Session{connect(t, s), connect(t, s)}
+	results := playGame(t, "room", sessions)
+
+	var placedItems []string
+	for i, res := range results {
+		if res.PlayerID != int32(i) {
+			t.Errorf("player %d got player ID %d", i, res.PlayerID)
+		}
+		if res.RandoID != results[0].RandoID || res.GeneratedHash != results[0].GeneratedHash {
+			t.Errorf("players got different games: %d/%s and %d/%s", res.RandoID, res.GeneratedHash, results[0].RandoID, results[0].GeneratedHash)
+		}
+		if !slices.Equal(res.Nicknames, []string{"A", "B"}) {
+			t.Errorf("player %d got nicknames %v", i, res.Nicknames)
+		}
+		ps := res.Placements["Main Item Group"]
+		if len(ps) != 3 {
+			t.Errorf("player %d got %d placements, want 3", i, len(ps))
+		}
+		for _, p := range ps {
+			if !strings.HasPrefix(p.Location, string(rune('A'+i))) {
+				t.Errorf("player %d got a placement at someone else's location %s", i, p.Location)
+			}
+			placedItems = append(placedItems, p.Item)
+		}
+		if len(res.PlayerItemsPlacements) != 3 {
+			t.Errorf("player %d got %d item placements, want 3", i, len(res.PlayerItemsPlacements))
+		}
+	}
+	var allItems []string
+	for i := range results {
+		for _, p := range placements(string(rune('A'+i)), 3)["Main Item Group"] {
+			allItems = append(allItems, mwproto.QualifyName(i, p.Item))
+		}
+	}
+	slices.Sort(placedItems)
+	slices.Sort(allItems)
+	if !slices.Equal(placedItems, allItems) {
+		t.Errorf("placed items %v, want each of %v once", placedItems, allItems)
+	}
+
+	for i, session := range sessions {
+		if err := session.Join(mwproto.JoinMessage{DisplayName: string(rune('A' + i)), RandoID: results[i].RandoID, PlayerID: int32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inboxes := []<-chan mwproto.Message{messages(t, sessions[0]), messages(t, sessions[1])}
+	send := mwproto.DataSendMessage{Label: mwproto.LabelMultiworldItem, Content: "B Item_(0)", To: 1}
+	sessions[0].Client.Send(send)
+	want := mwproto.DataReceiveMessage{Label: send.Label, Content: send.Content, From: "A", FromID: 0}
+	if msg := next(t, inboxes[1]); msg != want {
+		t.Fatalf("B got %#v, want %#v", msg, want)
+	}
+	sessions[1].Client.Send(mwproto.DataReceiveConfirmMessage{Label: want.Label, Data: want.Content, From: want.From})
+	wantConfirm := mwproto.DataSendConfirmMessage{Label: send.Label, Content: send.Content, To: 1}
+	if msg := next(t, inboxes[0]); msg != wantConfirm {
+		t.Fatalf("A got %#v, want %#v", msg, wantConfirm)
+	}
+	// Items that were already delivered are confirmed straight away.
+	sessions[0].Client.Send(send)
+	if msg := next(t, inboxes[0]); msg != wantConfirm {
+		t.Fatalf("A got %#v for a resent item, want %#v", msg, wantConfirm)
+	}
+}
+
+func TestItemsAreKeptForAbsentPlayers(t *testing.T) {
+	s := startServer(t)
+	sessions := []*mwproto.Session{connect(t, s), connect(t, s)}
+	results := playGame(t, "room", sessions)
+	if err := sessions[0].Join(mwproto.JoinMessage{DisplayName: "A", RandoID: results[0].RandoID, PlayerID: 0}); err != nil {
+		t.Fatal(err)
+	}
+	send := mwproto.DataSendMessage{Label: mwproto.LabelMultiworldItem, Content: "B Item_(1)", To: 1}
+	sessions[0].Client.Send(send)
+
+	late := connect(t, s)
+	if err := late.Join(mwproto.JoinMessage{DisplayName: "B", RandoID: results[1].RandoID, PlayerID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	want := mwproto.DataReceiveMessage{Label: send.Label, Content: send.Content, From: "A", FromID: 0}
+	if msg := next(t, messages(t, late)); msg != want {
+		t.Fatalf("B got %#v, want %#v", msg, want)
+	}
+}
+
+func TestDuplicateNickname(t *testing.T) {
+	s := startServer(t)
+	a, b := connect(t, s), connect(t, s)
+	if _, err := a.JoinRoom(mwproto.ReadyMessage{Room: "room", Nickname: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	var denied *mwproto.DeniedError
+	if _, err := b.JoinRoom(mwproto.ReadyMessage{Room: "room", Nickname: "A"}); !errors.As(err, &denied) {
+		t.Fatalf("joining with a nickname in use returned %v, want a *DeniedError", err)
+	}
+}
+
+// A client that stops reading is disconnected, instead of holding up
+// everyone else.
+func TestSlowClient(t *testing.T) {
+	s := startServer(t)
+	sender := connect(t, s)
+
+	// The slow client plays by the rules until the game has started, then
+	// never reads again.
+	slow, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	readUntil := func(done func(mwproto.Message) bool) {
+		t.Helper()
+		slow.SetReadDeadline(time.Now().Add(testTimeout))
+		for {
+			msg, err := mwproto.Read(slow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if done(msg) {
+				return
+			}
+		}
+	}
+	if err := mwproto.Write(slow, mwproto.ConnectMessage{}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(func(msg mwproto.Message) bool { _, ok := msg.(mwproto.ConnectMessage); return ok })
+	if _, err := sender.JoinRoom(mwproto.ReadyMessage{Room: "room", Nickname: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mwproto.Write(slow, mwproto.ReadyMessage{Room: "room", Nickname: "B", ReadyMetadata: []mwproto.KeyValuePair{}}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(func(msg mwproto.Message) bool { _, ok := msg.(mwproto.ReadyConfirmMessage); return ok })
+	sender.Client.Send(mwproto.InitiateGameMessage{})
+	readUntil(func(msg mwproto.Message) bool { _, ok := msg.(mwproto.RequestRandoMessage); return ok })
+	if err := mwproto.Write(slow, mwproto.RandoGeneratedMessage{Items: placements("B", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sender.AwaitRandoRequest(); err != nil {
+		t.Fatal(err)
+	}
+	result, err := sender.SendRando(mwproto.RandoGeneratedMessage{Items: placements("A", 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readUntil(func(msg mwproto.Message) bool { _, ok := msg.(mwproto.ResultMessage); return ok })
+	if err := mwproto.Write(slow, mwproto.JoinMessage{DisplayName: "B", RandoID: result.RandoID, PlayerID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	readUntil(func(msg mwproto.Message) bool { _, ok := msg.(mwproto.JoinConfirmMessage); return ok })
+	if err := sender.Join(mwproto.JoinMessage{DisplayName: "A", RandoID: result.RandoID, PlayerID: 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Send the slow client far more than fits in its outbox and the socket
+	// buffers together.
+	padding := strings.Repeat("x", 64<<10)
+	for i := range 1000 {
+		sender.Client.Send(mwproto.DataSendMessage{
+			Label:   mwproto.LabelMultiworldItem,
+			Content: mwproto.Name{Name: padding, Discriminator: int64(i), HasDiscriminator: true}.Encode(),
+			To:      1,
+		})
+	}
+	// The server must still be answering everyone else.
+	other := connect(t, s)
+	if _, err := other.JoinRoom(mwproto.ReadyMessage{Room: "other room", Nickname: "C"}); err != nil {
+		t.Fatal(err)
+	}
+	// And the slow client must have been cut off: reading what's left
+	// ends before all of the items have arrived.
+	received := 0
+	slow.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		msg, err := mwproto.Read(slow)
+		if err != nil {
+			break
+		}
+		if _, ok := msg.(mwproto.DataReceiveMessage); ok {
+			received++
+		}
+	}
+	if received == 1000 {
+		t.Error("slow client received every item instead of being disconnected")
+	}
+}
+
+// Closing the server disconnects its clients.
+func TestClose(t *testing.T) {
+	s, err := Listen("localhost:0", "Test Server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		s.Serve()
+		close(done)
+	}()
+	session := connect(t, s)
+	if _, err := session.JoinRoom(mwproto.ReadyMessage{Room: "room", Nickname: "A"}); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("Serve didn't return after the server was closed")
+	}
+	if _, err := session.Next(); !errors.Is(err, mwproto.ErrDisconnected) {
+		t.Errorf("client still connected after server was closed: %v", err)
+	}
+}
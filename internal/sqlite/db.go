@@ -21,7 +21,7 @@ func init() {
 
 type DB struct {
 	conn       *C.sqlite3
-	statements []Statement
+	statements []*Statement
 }
 
 func Open(location string) (*DB, error) {
@@ -40,9 +40,8 @@ func (db *DB) NumChanges() int64 {
 }
 
 func (db *DB) Prepare(sql string) *Statement {
-	n := len(db.statements)
-	db.statements = append(db.statements, Statement{})
-	s := &db.statements[n]
+	s := &Statement{}
+	db.statements = append(db.statements, s)
 	must(C.sqlite3_prepare_v2(db.conn, cPointer(sql), C.int(len(sql)), &s.stmt, nil))
 	return s
 }
@@ -60,8 +59,8 @@ func (db *DB) Exec(sql string) error {
 }
 
 func (db *DB) Close() {
-	for i := range db.statements {
-		db.statements[i].Close()
+	for _, s := range db.statements {
+		s.Close()
 	}
 	must(C.sqlite3_close(db.conn))
 	db.conn = nil
@@ -84,7 +83,7 @@ func (s *Statement) BindString(param int, value string) {
 }
 
 func (s *Statement) BindBytes(param int, value []byte) {
-	must(C.sqlite3_bind_text(s.stmt, C.int(param), (*C.char)(unsafe.Pointer(unsafe.SliceData(value))), C.int(len(value)), C.SQLITE_TRANSIENT))
+	must(C.sqlite3_bind_text(s.stmt, C.int(param), cPointer(unsafe.String(unsafe.SliceData(value), len(value))), C.int(len(value)), C.SQLITE_TRANSIENT))
 }
 
 func (s *Statement) ReadInt32(column int) int {
@@ -150,7 +149,14 @@ func (s *Statement) Close() {
 	s.stmt = nil
 }
 
+// emptyString stands in for the data of empty strings, which may be nil;
+// SQLite binds a nil pointer as NULL instead of as an empty string.
+var emptyString = [1]byte{}
+
 func cPointer(s string) *C.char {
+	if len(s) == 0 {
+		return (*C.char)(unsafe.Pointer(&emptyString[0]))
+	}
 	return (*C.char)(unsafe.Pointer(unsafe.StringData(s)))
 }
 